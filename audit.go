@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	cli "github.com/urfave/cli/v2"
+
+	"webpsmux/pkg/audit"
+	"webpsmux/pkg/homedir"
+	"webpsmux/pkg/rotate"
+)
+
+func auditVerifyCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "audit-verify",
+		Usage:     "Check that an audit log and its rotated files were not altered",
+		ArgsUsage: "<audit log>",
+		Description: "Verifies the hash of every entry and that each entry follows the one before,\n" +
+			"across the rotated files next to the audit log, oldest first.",
+		Action: runAuditVerify,
+	}
+}
+
+func runAuditVerify(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("Error: exactly one audit log is required", 1)
+	}
+	path := homedir.Expand(c.Args().First())
+
+	files, err := rotate.Files(path)
+	if err != nil {
+		return cli.Exit(err, 2)
+	}
+	if len(files) == 0 {
+		return cli.Exit(fmt.Sprintf("Error: no audit log at %s", path), 2)
+	}
+
+	var seq uint64
+	var prev string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return cli.Exit(err, 2)
+		}
+		seq, prev, err = audit.Verify(f, seq, prev)
+		f.Close()
+		if errors.Is(err, audit.ErrIncompleteLine) {
+			// The server moved the file aside and started a new chain.
+			fmt.Printf("%s: %s\n", file, err)
+			continue
+		}
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("%s: %s", file, err), 1)
+		}
+	}
+	fmt.Printf("Verified %d files up to entry %d, last hash %s\n", len(files), seq, prev)
+	return nil
+}
@@ -1,6 +1,7 @@
 package localcommand
 
 import (
+	"log/slog"
 	"time"
 
 	"webpsmux/server"
@@ -9,6 +10,9 @@ import (
 type Options struct {
 	CloseSignal  int `hcl:"close_signal" flagName:"close-signal" flagSName:"" flagDescribe:"Signal sent to the command process when gotty close it (default: unused on Windows)" default:"0"`
 	CloseTimeout int `hcl:"close_timeout" flagName:"close-timeout" flagSName:"" flagDescribe:"Time in seconds to force kill process after client is disconnected (default: -1)" default:"-1"`
+
+	// Logger receives the log records of commands, slog.Default() if nil.
+	Logger *slog.Logger
 }
 
 type Factory struct {
@@ -23,6 +27,9 @@ func NewFactory(command string, argv []string, options *Options) (*Factory, erro
 	if options.CloseTimeout >= 0 {
 		opts = append(opts, WithCloseTimeout(time.Duration(options.CloseTimeout)*time.Second))
 	}
+	if options.Logger != nil {
+		opts = append(opts, WithLogger(options.Logger))
+	}
 
 	return &Factory{
 		command: command,
@@ -2,6 +2,7 @@ package localcommand
 
 import (
 	"context"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
@@ -20,6 +21,7 @@ type LocalCommand struct {
 	argv    []string
 
 	closeTimeout time.Duration
+	logger       *slog.Logger
 
 	cpty      *conpty.ConPty
 	closeOnce sync.Once
@@ -49,6 +51,7 @@ func New(command string, argv []string, headers map[string][]string, options ...
 		argv:    argv,
 
 		closeTimeout: DefaultCloseTimeout,
+		logger:       slog.Default(),
 
 		cpty:      cpty,
 		ptyClosed: ptyClosed,
@@ -57,10 +60,13 @@ func New(command string, argv []string, headers map[string][]string, options ...
 	for _, option := range options {
 		option(lcmd)
 	}
+	lcmd.logger = lcmd.logger.With("command", command, "pid", cpty.Pid())
+	lcmd.logger.Debug("Started command", "argv", argv)
 
 	go func() {
 		defer close(lcmd.ptyClosed)
-		_, _ = lcmd.cpty.Wait(context.Background())
+		code, err := lcmd.cpty.Wait(context.Background())
+		lcmd.logger.Debug("Command exited", "exit_code", code, "error", err)
 	}()
 
 	return lcmd, nil
@@ -82,6 +88,7 @@ func (lcmd *LocalCommand) Close() error {
 	case <-lcmd.ptyClosed:
 		return nil
 	case <-lcmd.closeTimeoutC():
+		lcmd.logger.Warn("Command did not exit in time after closing", "timeout", lcmd.closeTimeout)
 		return nil
 	}
 }
@@ -1,6 +1,7 @@
 package localcommand
 
 import (
+	"log/slog"
 	"time"
 )
 
@@ -11,3 +12,10 @@ func WithCloseTimeout(timeout time.Duration) Option {
 		lcmd.closeTimeout = timeout
 	}
 }
+
+// WithLogger sets the logger that process starts and exits are logged to.
+func WithLogger(logger *slog.Logger) Option {
+	return func(lcmd *LocalCommand) {
+		lcmd.logger = logger
+	}
+}
@@ -29,8 +29,13 @@ const MSG = {
   SetReconnect: '5',
   SetBufferSize: '6',
   PsmuxLayoutUpdate: '7',
+  PsmuxPaneOutput: '8',
+  PsmuxError: 'B',
 };
 
+// Websocket close code of connections terminated by an administrator
+const CLOSE_TERMINATED = 4000;
+
 class WebPsmux {
   constructor() {
     this.terminal = null;
@@ -171,19 +176,44 @@ class WebPsmux {
     window.webpsmux = this;
   }
 
-  connect() {
+  // Fetch a single-use ticket that authenticates the next websocket.
+  async fetchTicket(base) {
+    const response = await fetch(new URL('ws_ticket', base), {
+      cache: 'no-store',
+      credentials: 'same-origin',
+    });
+    if (response.status === 401) {
+      // Session ended, reload to get to the login
+      window.location.reload();
+    }
+    if (!response.ok) {
+      throw new Error(`ticket request failed: ${response.status}`);
+    }
+    const body = await response.json();
+    return body.ticket;
+  }
+
+  async connect() {
     const base = window.location.href.endsWith('/') ? window.location.href : window.location.href + '/';
     const wsUrl = new URL('ws', base);
     wsUrl.protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
 
+    let ticket;
+    try {
+      ticket = await this.fetchTicket(base);
+    } catch (e) {
+      console.error('Failed to get websocket ticket:', e);
+      setTimeout(() => this.connect(), 2000);
+      return;
+    }
+
     this.ws = new WebSocket(wsUrl.toString(), ['webtty']);
 
     this.ws.onopen = () => {
       console.log('WebSocket connected');
 
-      // Send auth token
-      const authToken = window.gotty_auth_token || '';
-      this.ws.send(JSON.stringify({ AuthToken: authToken, Arguments: '' }));
+      // Authenticate with the ticket
+      this.ws.send(JSON.stringify({ AuthToken: ticket, Arguments: '' }));
 
       // Tell server to expect base64 encoded input
       this.sendMessage(MSG.SetEncoding, 'base64');
@@ -208,9 +238,16 @@ class WebPsmux {
       this.handleMessage(event.data);
     };
 
-    this.ws.onclose = () => {
+    this.ws.onclose = (event) => {
       console.log('WebSocket closed');
 
+      // Terminated by an administrator: say why and stay disconnected
+      if (event.code === CLOSE_TERMINATED) {
+        const reason = event.reason.replace(/[\x00-\x1f\x7f]/g, '');
+        this.terminal.write(`\r\n\x1b[31m${reason}\x1b[0m\r\n`);
+        return;
+      }
+
       // Check if there are other sessions to switch to
       const otherSessions = this.layout?.sessions?.filter(s => !s.active) || [];
       if (otherSessions.length > 0) {
@@ -275,6 +312,15 @@ class WebPsmux {
         this.dispatchLayoutUpdate();
         break;
 
+      case MSG.PsmuxPaneOutput:
+        // Contents of a pane selected in our own view only
+        this.showPanePreview(JSON.parse(payload));
+        break;
+
+      case MSG.PsmuxError:
+        this.showNotice(JSON.parse(payload).message);
+        break;
+
       default:
         console.warn('Unknown message type:', type);
     }
@@ -300,6 +346,49 @@ class WebPsmux {
     }));
   }
 
+  // Show a short-lived notice, e.g. when the server refused an action.
+  // Repeats of the visible notice (every keystroke of a viewer) only
+  // extend it.
+  showNotice(message) {
+    if (!this.notice) {
+      this.notice = document.createElement('div');
+      this.notice.style.cssText = 'position:fixed;bottom:16px;left:50%;transform:translateX(-50%);' +
+        'background:#e94560;color:#fff;padding:6px 12px;border-radius:4px;font:13px sans-serif;z-index:100;';
+      document.body.appendChild(this.notice);
+    }
+    this.notice.textContent = message;
+    this.notice.hidden = false;
+    clearTimeout(this.noticeTimer);
+    this.noticeTimer = setTimeout(() => { this.notice.hidden = true; }, 3000);
+  }
+
+  // Show a snapshot of a pane the user navigated to without changing
+  // what the terminal shows to everyone else.
+  showPanePreview({ paneId, content }) {
+    if (!this.preview) {
+      this.preview = document.createElement('div');
+      this.preview.style.cssText = 'position:absolute;inset:0;background:#1a1a2e;color:#eaeaea;z-index:50;' +
+        'display:flex;flex-direction:column;font:13px Menlo, Monaco, "Courier New", monospace;';
+      const bar = document.createElement('div');
+      bar.style.cssText = 'display:flex;justify-content:space-between;padding:4px 8px;background:#16213e;color:#888;';
+      this.previewTitle = document.createElement('span');
+      const close = document.createElement('button');
+      close.textContent = 'Back to live view';
+      close.style.cssText = 'color:#e94560;background:none;border:none;cursor:pointer;';
+      close.onclick = () => { this.preview.style.display = 'none'; };
+      bar.append(this.previewTitle, close);
+      this.previewContent = document.createElement('pre');
+      this.previewContent.style.cssText = 'flex:1;margin:0;padding:8px;overflow:auto;white-space:pre;';
+      this.preview.append(bar, this.previewContent);
+      const container = document.getElementById('terminal-container');
+      container.style.position = 'relative';
+      container.appendChild(this.preview);
+    }
+    this.previewTitle.textContent = `Pane ${paneId} (read-only snapshot)`;
+    this.previewContent.textContent = content;
+    this.preview.style.display = 'flex';
+  }
+
   // Public API for components
   selectPane(paneId) {
     this.sendMessage(MSG.PsmuxSelectPane, paneId);
@@ -344,7 +344,7 @@ foreach ($section in $sections) {
 
 Write-Step "Allow rewrite server variables"
 
-$serverVars = @('HTTP_X_FORWARDED_PROTO', 'HTTP_X_FORWARDED_HOST')
+$serverVars = @('HTTP_X_FORWARDED_PROTO', 'HTTP_X_FORWARDED_HOST', 'HTTP_X_FORWARDED_FOR')
 foreach ($var in $serverVars) {
     try {
         $existing = Get-WebConfigurationProperty -pspath 'MACHINE/WEBROOT/APPHOST' `
@@ -407,7 +407,7 @@ Write-Step "Create scheduled task"
 # Remove existing
 Unregister-ScheduledTask -TaskName 'webpsmux' -Confirm:$false -ErrorAction SilentlyContinue
 
-$taskArgs = "-w -a 127.0.0.1 -p $Port -c ${Username}:${Password} psmux attach -t $PsmuxSession"
+$taskArgs = "-w -a 127.0.0.1 -p $Port --trusted-proxies 127.0.0.1,::1 -c ${Username}:${Password} psmux attach -t $PsmuxSession"
 
 $action = New-ScheduledTaskAction `
     -Execute "$InstallDir\webpsmux.exe" `
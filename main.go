@@ -5,17 +5,18 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	cli "github.com/urfave/cli/v2"
 
 	"webpsmux/backend/localcommand"
 	"webpsmux/pkg/homedir"
+	"webpsmux/pkg/logging"
 	"webpsmux/server"
 	"webpsmux/utils"
 )
@@ -41,6 +42,8 @@ func main() {
 		exit(err, 3)
 	}
 
+	app.Commands = []*cli.Command{passwdCommand(), totpCommand(), auditVerifyCommand()}
+
 	app.Flags = append(
 		cliFlags,
 		&cli.StringFlag{
@@ -68,16 +71,31 @@ func main() {
 
 		utils.ApplyFlags(cliFlags, flagMappings, c, appOptions, backendOptions)
 
-		if appOptions.Quiet {
-			log.SetFlags(0)
-			log.SetOutput(io.Discard)
+		logger, logFile, err := logging.New(logging.Config{
+			Level:   appOptions.LogLevel,
+			Format:  appOptions.LogFormat,
+			File:    homedir.Expand(appOptions.LogFile),
+			MaxSize: int64(appOptions.LogFileMaxSize) * 1024 * 1024,
+			MaxAge:  time.Duration(appOptions.LogFileMaxAge) * time.Second,
+			Quiet:   appOptions.Quiet,
+		})
+		if err != nil {
+			exit(err, 2)
+		}
+		if logFile != nil {
+			defer logFile.Close()
 		}
+		// Libraries logging with the log package end up here as well.
+		slog.SetDefault(logger)
+		appOptions.Logger = logger
+		backendOptions.Logger = logger
 
 		// Handle authentication
 		if appOptions.NoAuth {
 			appOptions.EnableBasicAuth = false
-			log.Printf("WARNING: Authentication disabled. Terminal is publicly accessible!")
-		} else if c.IsSet("credential") {
+			logger.Warn("Authentication disabled, the terminal is publicly accessible")
+		} else if appOptions.Credential != "" || appOptions.UsersFile != "" || appOptions.LDAPURL != "" ||
+			appOptions.OIDCIssuer != "" || appOptions.ProxyUserHeader != "" || appOptions.TLSClientMapFile != "" {
 			appOptions.EnableBasicAuth = true
 		} else {
 			// Generate random credentials
@@ -125,7 +143,7 @@ func main() {
 		ctx, cancel := context.WithCancel(context.Background())
 		gCtx, gCancel := context.WithCancel(context.Background())
 
-		log.Printf("WebPsmux is starting with command: %s", strings.Join(args.Slice(), " "))
+		logger.Info("WebPsmux is starting", "command", strings.Join(args.Slice(), " "))
 
 		errs := make(chan error, 1)
 		go func() {
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/term"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/homedir"
+)
+
+func passwdCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "passwd",
+		Usage:     "Add a user to a users file, or change a user's password or role",
+		ArgsUsage: "<user>",
+		Description: "Prompts for the password of a new user, or of an existing user unless only --role is given.\n" +
+			"The password is read from stdin when it is not a terminal.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "file",
+				Aliases:  []string{"f"},
+				Usage:    "Users file (htpasswd format if the file name contains \"htpasswd\", HCL otherwise)",
+				EnvVars:  []string{"GOTTY_USERS_FILE"},
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "role",
+				Usage: "Role of the user: viewer, operator or admin",
+			},
+			&cli.BoolFlag{
+				Name:  "delete",
+				Usage: "Remove the user",
+			},
+		},
+		Action: runPasswd,
+	}
+}
+
+func runPasswd(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("Error: exactly one user name is required", 1)
+	}
+	name := c.Args().First()
+	path := homedir.Expand(c.String("file"))
+
+	store, err := auth.LoadUserStore(path)
+	if os.IsNotExist(err) {
+		store = auth.NewUserStore(path)
+	} else if err != nil {
+		return cli.Exit(err, 2)
+	}
+
+	_, exists := store.Lookup(name)
+
+	if c.Bool("delete") {
+		if err := store.Delete(name); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return saveUsers(store, fmt.Sprintf("Removed user %s", name))
+	}
+
+	if !exists || !c.IsSet("role") {
+		password, err := readNewPassword()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		if err := store.SetPassword(name, password); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	if c.IsSet("role") {
+		role, err := auth.ParseRole(c.String("role"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		if err := store.SetRole(name, role); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	user, _ := store.Lookup(name)
+	if exists {
+		return saveUsers(store, fmt.Sprintf("Updated user %s (%s)", name, user.Role))
+	}
+	return saveUsers(store, fmt.Sprintf("Added user %s (%s)", name, user.Role))
+}
+
+func saveUsers(store *auth.UserStore, message string) error {
+	if err := store.Save(); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: failed to save users file: %s", err), 2)
+	}
+	fmt.Println(message)
+	return nil
+}
+
+// readNewPassword prompts twice on a terminal, or reads one line otherwise.
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("Error: failed to read password from stdin: %s", err)
+		}
+		return checkPassword(strings.TrimRight(line, "\r\n"))
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype new password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("Error: passwords do not match")
+	}
+	return checkPassword(string(first))
+}
+
+func checkPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("Error: empty password")
+	}
+	return password, nil
+}
@@ -0,0 +1,265 @@
+// Package audit writes a tamper-evident audit trail: JSON lines in which
+// every entry carries the hash of the one before it.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"webpsmux/pkg/rotate"
+)
+
+// Events recorded in the audit trail.
+const (
+	EventLogin       = "login"
+	EventLoginFailed = "login_failed"
+	EventConnect     = "connect"
+	EventDisconnect  = "disconnect"
+	EventAction      = "action"
+	EventInput       = "input"
+	// EventChainBreak starts a new chain after the audit log was found to
+	// end in an incomplete line, as a crash while writing leaves it.
+	EventChainBreak = "chain_break"
+)
+
+// ErrIncompleteLine is returned for a last line without a newline, which
+// a crash while writing an entry leaves behind.
+var ErrIncompleteLine = errors.New("incomplete last line")
+
+// Entry is one line of the audit trail.
+type Entry struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// User, Role and Method tell who acted and how they authenticated,
+	// IP from where.
+	User   string `json:"user,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Method string `json:"method,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	// Conn is the websocket connection of the entry, 0 for HTTP requests.
+	Conn int64 `json:"conn,omitempty"`
+	// Action is the psmux operation, e.g. "ClosePane", and Target the
+	// session, window or pane it applied to.
+	Action string `json:"action,omitempty"`
+	Target string `json:"target,omitempty"`
+	Input  string `json:"input,omitempty"`
+	// Duration is in seconds; it and the byte counts are set when a
+	// connection closes.
+	Duration float64 `json:"duration,omitempty"`
+	BytesIn  int64   `json:"bytes_in,omitempty"`
+	BytesOut int64   `json:"bytes_out,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	// Prev is the hash of the previous entry, empty for the first one.
+	// Hash is the SHA-256 of the line up to it.
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+const hashField = `,"hash":"`
+
+// Logger appends entries to a writer, chaining each to the one before.
+type Logger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	seq  uint64
+	prev string
+}
+
+// NewLogger returns a logger writing to w that continues the chain after
+// the entry with seq and hash prev; zero values start a new chain.
+func NewLogger(w io.Writer, seq uint64, prev string) *Logger {
+	return &Logger{w: w, seq: seq, prev: prev}
+}
+
+// Open returns a logger appending to the file at path. It continues the
+// chain of the entries already there and moves the file aside once it
+// grows beyond maxSize bytes or gets older than maxAge; zero disables
+// either limit.
+func Open(path string, maxSize int64, maxAge time.Duration) (*Logger, error) {
+	files, err := rotate.Files(path)
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64
+	var prev string
+	var started time.Time
+	var broken *Entry
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		seq, prev, started, err = tail(last)
+		if errors.Is(err, ErrIncompleteLine) {
+			// The file is kept as it is, for the incomplete line is not
+			// evidence of tampering, and a new chain starts that records
+			// where the old one ended.
+			broken = &Entry{Event: EventChainBreak, Target: last, Error: fmt.Sprintf("%s, last entry %d has hash %s", err, seq, prev)}
+			if last == path {
+				if broken.Target, err = rotate.MoveAside(path); err != nil {
+					return nil, err
+				}
+			}
+			seq, prev, started, err = 0, "", time.Time{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if last != path {
+			// The chain continues from a rotated file.
+			started = time.Time{}
+		}
+	}
+	file, err := rotate.Open(path, maxSize, maxAge, started)
+	if err != nil {
+		return nil, err
+	}
+	logger := NewLogger(file, seq, prev)
+	if broken != nil {
+		if err := logger.Log(*broken); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return logger, nil
+}
+
+// Log appends entry. Its sequence number, time if unset and hashes are
+// filled in.
+func (logger *Logger) Log(entry Entry) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	entry.Seq = logger.seq + 1
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Prev = logger.prev
+	entry.Hash = ""
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	hash := hashLine(body)
+	line := append(body[:len(body)-1], hashField+hash+"\"}\n"...)
+	if _, err := logger.w.Write(line); err != nil {
+		return err
+	}
+	logger.seq = entry.Seq
+	logger.prev = hash
+	return nil
+}
+
+// Close closes the underlying writer if it is a file.
+func (logger *Logger) Close() error {
+	if closer, ok := logger.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func hashLine(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseLine checks the hash of one line and decodes it.
+func parseLine(line []byte) (Entry, error) {
+	var entry Entry
+	i := bytes.LastIndex(line, []byte(hashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return entry, errors.New("entry has no hash")
+	}
+	body := append(line[:i:i], '}')
+	hash := string(line[i+len(hashField) : len(line)-2])
+	if hashLine(body) != hash {
+		return entry, errors.New("hash does not match the entry")
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return entry, err
+	}
+	entry.Hash = hash
+	return entry, nil
+}
+
+// Verify checks the hashes of the entries read from r and that each one
+// follows the one before, starting after the entry with seq and hash prev.
+// With seq zero, the first entry is taken as it is, so that single rotated
+// files can be checked, and so is a chain break that starts a new chain.
+// It returns the sequence number and hash of the last entry, to verify the
+// next file with, and ErrIncompleteLine if r ends in an incomplete line.
+func Verify(r io.Reader, seq uint64, prev string) (uint64, string, error) {
+	err := readEntries(r, func(n int, entry Entry) error {
+		restart := entry.Event == EventChainBreak && entry.Seq == 1 && entry.Prev == ""
+		if seq != 0 && !restart && (entry.Seq != seq+1 || entry.Prev != prev) {
+			return fmt.Errorf("line %d: entry %d does not follow entry %d", n, entry.Seq, seq)
+		}
+		seq, prev = entry.Seq, entry.Hash
+		return nil
+	})
+	return seq, prev, err
+}
+
+// readEntries calls fn with every entry read from r and its line number.
+// Lines with a wrong hash are refused.
+func readEntries(r io.Reader, fn func(n int, entry Entry) error) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return fmt.Errorf("line %d: %w", n, ErrIncompleteLine)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := parseLine(line[:len(line)-1])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if err := fn(n, entry); err != nil {
+			return err
+		}
+	}
+}
+
+// tail returns the sequence number and hash of the last entry in the file
+// at path and the time of its first entry, or zero values for an empty
+// file. Lines with a wrong hash are refused rather than continued. If the
+// file ends in an incomplete line, the values of the last complete entry
+// are returned together with ErrIncompleteLine.
+func tail(path string) (uint64, string, time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	defer file.Close()
+
+	var seq uint64
+	var prev string
+	var started time.Time
+	err = readEntries(file, func(n int, entry Entry) error {
+		if started.IsZero() {
+			started = entry.Time
+		}
+		seq, prev = entry.Seq, entry.Hash
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("audit log `%s` %w", path, err)
+		if !errors.Is(err, ErrIncompleteLine) {
+			return 0, "", time.Time{}, err
+		}
+	}
+	return seq, prev, started, err
+}
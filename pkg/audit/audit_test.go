@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"webpsmux/pkg/rotate"
+)
+
+func TestLoggerChain(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, 0, "")
+	for _, event := range []string{EventConnect, EventAction, EventDisconnect} {
+		if err := logger.Log(Entry{Event: event, User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seq, _, err := Verify(bytes.NewReader(buf.Bytes()), 0, "")
+	if err != nil || seq != 3 {
+		t.Fatalf("expected three valid entries, got %d, %v", seq, err)
+	}
+
+	tampered := strings.Replace(buf.String(), `"event":"action","user":"alice"`, `"event":"action","user":"mallory"`, 1)
+	if _, _, err := Verify(strings.NewReader(tampered), 0, ""); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected the edited entry to fail, got %v", err)
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	if _, _, err := Verify(strings.NewReader(lines[0]+lines[2]), 0, ""); err == nil {
+		t.Error("expected a removed entry to break the chain")
+	}
+}
+
+func TestOpenContinuesAndRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logger, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(Entry{Event: EventLogin, User: "alice"})
+	logger.Close()
+
+	// A size limit below one entry rotates before every further entry.
+	logger, err = Open(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(Entry{Event: EventAction, Action: "ClosePane", Target: "%1"})
+	logger.Log(Entry{Event: EventAction, Action: "NewWindow"})
+	logger.Close()
+
+	files, err := rotate.Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[2] != path {
+		t.Fatalf("expected two rotated files and the current one, got %v", files)
+	}
+	var seq uint64
+	var prev string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, prev, err = Verify(f, seq, prev)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+	}
+	if seq != 3 {
+		t.Errorf("expected the chain to continue across files, got %d entries", seq)
+	}
+}
+
+func TestOpenAfterIncompleteLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logger, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(Entry{Event: EventLogin, User: "alice"})
+	logger.Log(Entry{Event: EventAction, Action: "NewWindow"})
+	logger.Close()
+
+	// A crash in the middle of writing the third entry.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"time":"2026-10-18T09:30:12Z","ev`)
+	f.Close()
+
+	logger, err = Open(path, 0, 0)
+	if err != nil {
+		t.Fatalf("expected the log to open after an incomplete line, got %v", err)
+	}
+	logger.Log(Entry{Event: EventAction, Action: "ClosePane", Target: "%1"})
+	logger.Close()
+
+	files, err := rotate.Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[1] != path {
+		t.Fatalf("expected the broken file moved aside next to a new one, got %v", files)
+	}
+	f, err = os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, prev, err := Verify(f, 0, "")
+	f.Close()
+	if !errors.Is(err, ErrIncompleteLine) || seq != 2 {
+		t.Fatalf("expected two entries and an incomplete line, got %d, %v", seq, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := parseLine(bytes.SplitN(data, []byte("\n"), 2)[0])
+	if err != nil || first.Event != EventChainBreak || first.Seq != 1 || !strings.Contains(first.Error, prev) {
+		t.Fatalf("expected the new chain to start with the break, got %+v, %v", first, err)
+	}
+	if seq, _, err := Verify(bytes.NewReader(data), seq, prev); err != nil || seq != 2 {
+		t.Errorf("expected the new chain to verify after the old one, got %d, %v", seq, err)
+	}
+}
+
+func TestOpenRefusesTamperedLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logger, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(Entry{Event: EventLogin, User: "alice"})
+	logger.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, bytes.Replace(data, []byte("alice"), []byte("mallory"), 1), 0600)
+	if _, err := Open(path, 0, 0); err == nil {
+		t.Error("expected a complete line with a wrong hash to be refused")
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+// ErrInvalidCredentials is returned when a user name and password do not match.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator verifies a user name and password.
+type Authenticator interface {
+	Authenticate(user, password string) (*Identity, error)
+}
+
+// UserLookup is implemented by authenticators that know the current role of
+// a user without their password. API tokens rely on it to follow role
+// changes and deleted accounts.
+type UserLookup interface {
+	// LookupRole returns the role of user, or false if there is no such user.
+	LookupRole(user string) (Role, bool)
+}
+
+// StaticCredential is a single user with a plaintext password, as given by
+// the `--credential user:pass` option. The user gets the admin role.
+type StaticCredential struct {
+	User     string
+	Password string
+}
+
+func (sc *StaticCredential) Authenticate(user, password string) (*Identity, error) {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(sc.User)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(sc.Password)) == 1
+	if !userOK || !passOK {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{User: sc.User, Role: RoleAdmin, Method: "basic"}, nil
+}
+
+func (sc *StaticCredential) LookupRole(user string) (Role, bool) {
+	if user != sc.User {
+		return 0, false
+	}
+	return RoleAdmin, true
+}
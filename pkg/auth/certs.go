@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yudai/hcl"
+)
+
+// certRule maps certificates whose subject or SAN matches a value to a
+// user and a role.
+type certRule struct {
+	// User names the user; empty for the CN or email of the certificate.
+	User string `hcl:"user"`
+	Role string `hcl:"role"`
+
+	role Role
+}
+
+type certMapFile struct {
+	Emails map[string]*certRule `hcl:"email"`
+	CNs    map[string]*certRule `hcl:"cn"`
+	OUs    map[string]*certRule `hcl:"ou"`
+}
+
+// CertMapper maps verified client certificates to identities. The mapping
+// file is HCL:
+//
+//	email "alice@example.com" {
+//	  role = "admin"
+//	}
+//
+//	cn "build-agent-1" {
+//	  user = "ci"
+//	  role = "operator"
+//	}
+//
+//	ou "Operations" {
+//	  role = "viewer"
+//	}
+//
+// A SAN email takes precedence over the subject CN, which takes precedence
+// over the OUs. Among several mapped OUs the highest role wins.
+type CertMapper struct {
+	rules certMapFile
+}
+
+// LoadCertMapper reads the mapping file at path.
+func LoadCertMapper(path string) (*CertMapper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file certMapFile
+	if err := hcl.Decode(&file, string(data)); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate mapping %s: %w", path, err)
+	}
+	for _, rules := range []map[string]*certRule{file.Emails, file.CNs, file.OUs} {
+		for value, rule := range rules {
+			role, err := ParseRole(rule.Role)
+			if err != nil {
+				return nil, fmt.Errorf("certificate mapping `%s`: %w", value, err)
+			}
+			rule.role = role
+		}
+	}
+	return &CertMapper{rules: file}, nil
+}
+
+// Identity returns the user a certificate maps to, or nil if no rule
+// matches it.
+func (mapper *CertMapper) Identity(cert *x509.Certificate) *Identity {
+	name := cert.Subject.CommonName
+	for _, email := range cert.EmailAddresses {
+		if rule := lookupCertRule(mapper.rules.Emails, email); rule != nil {
+			return rule.identity(email)
+		}
+	}
+	if len(cert.EmailAddresses) > 0 && name == "" {
+		name = cert.EmailAddresses[0]
+	}
+	if rule := lookupCertRule(mapper.rules.CNs, cert.Subject.CommonName); rule != nil {
+		return rule.identity(cert.Subject.CommonName)
+	}
+
+	var best *certRule
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if rule := lookupCertRule(mapper.rules.OUs, ou); rule != nil && (best == nil || rule.role > best.role) {
+			best = rule
+		}
+	}
+	if best == nil || (best.User == "" && name == "") {
+		return nil
+	}
+	return best.identity(name)
+}
+
+// lookupCertRule finds the rule for value, ignoring case as certificate
+// names are usually compared.
+func lookupCertRule(rules map[string]*certRule, value string) *certRule {
+	if value == "" {
+		return nil
+	}
+	if rule, ok := rules[value]; ok {
+		return rule
+	}
+	for key, rule := range rules {
+		if strings.EqualFold(key, value) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *certRule) identity(name string) *Identity {
+	if rule.User != "" {
+		name = rule.User
+	}
+	return &Identity{User: name, Role: rule.role, Method: "cert"}
+}
+
+// RevocationList rejects client certificates listed in a file, which is
+// either a CRL (PEM or DER) signed by one of the client CAs, or text with
+// one serial number (hex) or SHA-256 fingerprint per line:
+//
+//	# lost laptop of alice
+//	3a:f1:09:...
+//	sha256:9f86d081884c7d659a2feaa0c55ad015...
+//
+// Serial numbers are only unique per CA, so they are matched together with
+// the issuer: that of the CRL, or the single client CA for text. Text with
+// serial numbers is refused when there are several client CAs. The file is
+// re-read when it changes.
+type RevocationList struct {
+	path    string
+	issuers []*x509.Certificate
+
+	mu      sync.Mutex
+	modTime time.Time
+	// serials are keyed by revocationKey.
+	serials      map[string]bool
+	fingerprints map[string]bool
+}
+
+// LoadRevocationList reads the list at path. CRLs must be signed by one of
+// issuers.
+func LoadRevocationList(path string, issuers []*x509.Certificate) (*RevocationList, error) {
+	list := &RevocationList{path: path, issuers: issuers}
+	if err := list.load(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (list *RevocationList) load() error {
+	info, err := os.Stat(list.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(list.path)
+	if err != nil {
+		return err
+	}
+
+	serials := make(map[string]bool)
+	fingerprints := make(map[string]bool)
+	if der, ok := crlDER(data); ok {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse CRL %s: %w", list.path, err)
+		}
+		if err := list.checkCRLSignature(crl); err != nil {
+			return err
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[revocationKey(crl.RawIssuer, entry.SerialNumber)] = true
+		}
+	} else if err := parseDenyList(data, list.issuers, serials, fingerprints); err != nil {
+		return fmt.Errorf("failed to parse deny list %s: %w", list.path, err)
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.serials = serials
+	list.fingerprints = fingerprints
+	list.modTime = info.ModTime()
+	return nil
+}
+
+// crlDER returns the DER bytes of a PEM or DER encoded CRL.
+func crlDER(data []byte) ([]byte, bool) {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, block.Type == "X509 CRL"
+	}
+	// DER starts with a SEQUENCE, which text never does.
+	return data, len(data) > 0 && data[0] == 0x30
+}
+
+func (list *RevocationList) checkCRLSignature(crl *x509.RevocationList) error {
+	for _, issuer := range list.issuers {
+		if crl.CheckSignatureFrom(issuer) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("CRL %s is not signed by a client CA", list.path)
+}
+
+// parseDenyList reads a text deny list. Its serial numbers belong to the
+// only one of issuers, or to any issuer if there are none.
+func parseDenyList(data []byte, issuers []*x509.Certificate, serials, fingerprints map[string]bool) error {
+	var issuer []byte
+	if len(issuers) == 1 {
+		issuer = issuers[0].RawSubject
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fingerprint, ok := strings.CutPrefix(strings.ToLower(line), "sha256:"); ok {
+			fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+			if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("line %d: invalid SHA-256 fingerprint", lineNo)
+			}
+			fingerprints[fingerprint] = true
+			continue
+		}
+		serial, ok := new(big.Int).SetString(strings.NewReplacer(":", "", " ", "").Replace(line), 16)
+		if !ok {
+			return fmt.Errorf("line %d: invalid serial number", lineNo)
+		}
+		if len(issuers) > 1 {
+			return fmt.Errorf("line %d: serial numbers are ambiguous with several client CAs, list SHA-256 fingerprints or use a CRL", lineNo)
+		}
+		serials[revocationKey(issuer, serial)] = true
+	}
+	return scanner.Err()
+}
+
+// revocationKey identifies the certificate with serial issued by the CA
+// with the DER encoded subject issuer; an empty issuer matches any.
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return hex.EncodeToString(issuer) + "/" + serial.Text(16)
+}
+
+// Revoked reports whether cert is on the list.
+func (list *RevocationList) Revoked(cert *x509.Certificate) bool {
+	list.reloadIfChanged()
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	return list.serials[revocationKey(cert.RawIssuer, cert.SerialNumber)] ||
+		list.serials[revocationKey(nil, cert.SerialNumber)] ||
+		list.fingerprints[hex.EncodeToString(fingerprint[:])]
+}
+
+// reloadIfChanged re-reads the file when its modification time changed.
+// A file that fails to load leaves the previous list in place.
+func (list *RevocationList) reloadIfChanged() {
+	info, err := os.Stat(list.path)
+	if err != nil {
+		return
+	}
+	list.mu.Lock()
+	changed := !info.ModTime().Equal(list.modTime)
+	list.mu.Unlock()
+	if changed {
+		list.load()
+	}
+}
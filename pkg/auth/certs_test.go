@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	return newNamedTestCA(t, "Test CA")
+}
+
+func newNamedTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name, emails ...string) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        subject,
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestCertMapper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certs.hcl")
+	os.WriteFile(path, []byte(`
+email "alice@example.com" {
+  role = "admin"
+}
+
+cn "build-agent-1" {
+  user = "ci"
+  role = "operator"
+}
+
+ou "Operations" {
+  role = "viewer"
+}
+
+ou "Developers" {
+  role = "operator"
+}
+`), 0600)
+	mapper, err := LoadCertMapper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		user string
+		role Role
+	}{
+		{"email", ca.issue(t, 2, pkix.Name{CommonName: "build-agent-1"}, "Alice@example.com"), "Alice@example.com", RoleAdmin},
+		{"cn", ca.issue(t, 3, pkix.Name{CommonName: "build-agent-1"}), "ci", RoleOperator},
+		{"highest ou", ca.issue(t, 4, pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"Operations", "Developers"}}), "bob", RoleOperator},
+		{"unmapped", ca.issue(t, 5, pkix.Name{CommonName: "mallory", OrganizationalUnit: []string{"Sales"}}), "", 0},
+	}
+	for _, tc := range tests {
+		id := mapper.Identity(tc.cert)
+		if tc.role == 0 {
+			if id != nil {
+				t.Errorf("%s: expected no identity, got %+v", tc.name, id)
+			}
+			continue
+		}
+		if id == nil || id.User != tc.user || id.Role != tc.role || id.Method != "cert" {
+			t.Errorf("%s: expected %s as %s, got %+v", tc.name, tc.user, tc.role, id)
+		}
+	}
+}
+
+func TestRevocationListDenyFile(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, 0x1f2e, pkix.Name{CommonName: "alice"})
+	fingerprinted := ca.issue(t, 7, pkix.Name{CommonName: "bob"})
+	valid := ca.issue(t, 8, pkix.Name{CommonName: "carol"})
+	sum := sha256.Sum256(fingerprinted.Raw)
+
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(path, []byte("# lost laptop\n1F:2E\nsha256:"+hex.EncodeToString(sum[:])+"\n"), 0600)
+	list, err := LoadRevocationList(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Revoked(revoked) || !list.Revoked(fingerprinted) {
+		t.Error("expected listed certificates to be revoked")
+	}
+	if list.Revoked(valid) {
+		t.Error("expected other certificates to be accepted")
+	}
+
+	// Changes are picked up without a restart.
+	os.WriteFile(path, []byte("8\n"), 0600)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if !list.Revoked(valid) || list.Revoked(revoked) {
+		t.Error("expected the changed deny list to be reloaded")
+	}
+
+	os.WriteFile(path, []byte("not a serial\n"), 0600)
+	if _, err := LoadRevocationList(path, nil); err == nil {
+		t.Error("expected an invalid line to be rejected")
+	}
+}
+
+func TestRevocationListIssuers(t *testing.T) {
+	ca, other := newTestCA(t), newNamedTestCA(t, "Other CA")
+	revoked := ca.issue(t, 9, pkix.Name{CommonName: "alice"})
+	sameSerial := other.issue(t, 9, pkix.Name{CommonName: "bob"})
+
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(path, []byte("9\n"), 0600)
+	list, err := LoadRevocationList(path, []*x509.Certificate{ca.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Revoked(revoked) {
+		t.Error("expected the listed serial of the CA to be revoked")
+	}
+	if list.Revoked(sameSerial) {
+		t.Error("expected the same serial of another CA to be accepted")
+	}
+
+	if _, err := LoadRevocationList(path, []*x509.Certificate{ca.cert, other.cert}); err == nil {
+		t.Error("expected serial numbers to be refused with several CAs")
+	}
+	sum := sha256.Sum256(revoked.Raw)
+	os.WriteFile(path, []byte("sha256:"+hex.EncodeToString(sum[:])+"\n"), 0600)
+	if _, err := LoadRevocationList(path, []*x509.Certificate{ca.cert, other.cert}); err != nil {
+		t.Errorf("expected fingerprints to work with several CAs, got %v", err)
+	}
+}
+
+func TestRevocationListCRL(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, 42, pkix.Name{CommonName: "alice"})
+	valid := ca.issue(t, 43, pkix.Name{CommonName: "bob"})
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600)
+
+	list, err := LoadRevocationList(path, []*x509.Certificate{ca.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Revoked(revoked) || list.Revoked(valid) {
+		t.Error("expected exactly the certificate in the CRL to be revoked")
+	}
+
+	if _, err := LoadRevocationList(path, []*x509.Certificate{newTestCA(t).cert}); err == nil {
+		t.Error("expected a CRL of another CA to be rejected")
+	}
+}
@@ -0,0 +1,3 @@
+// Package auth provides user identities, roles and the credential stores
+// webpsmux authenticates against.
+package auth
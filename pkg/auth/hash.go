@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns a bcrypt hash of password, compatible with the
+// hashes `htpasswd -B` writes.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkHash returns an error unless VerifyPassword can check hash. Other
+// htpasswd formats ($apr1$, {SHA}, crypt) and argon2id hashes with unusable
+// parameters are refused when loading users rather than failing every login.
+func checkHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2id(hash)
+		return err
+	default:
+		return errors.New("unsupported password hash, expected bcrypt ($2a$, $2b$, $2y$, `htpasswd -B`) or argon2id ($argon2id$)")
+	}
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// VerifyPassword checks password against a bcrypt ($2a$, $2b$, $2y$) or
+// argon2id ($argon2id$) hash.
+func VerifyPassword(hash, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	default:
+		return false
+	}
+}
+
+// Limits on the argon2id parameters of stored hashes, so that a users file
+// cannot make every login allocate gigabytes or run for minutes.
+const (
+	maxArgon2Memory  = 1 << 20 // KiB, 1 GiB
+	maxArgon2Time    = 16
+	maxArgon2Threads = 64
+)
+
+// argon2idHash is a parsed argon2id hash.
+type argon2idHash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+// parseArgon2id parses a hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key> and checks its parameters.
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version `%s`", parts[2])
+	}
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters `%s`", parts[3])
+	}
+	switch {
+	case h.threads < 1 || h.threads > maxArgon2Threads:
+		return nil, fmt.Errorf("argon2id parallelism %d is outside 1-%d", h.threads, maxArgon2Threads)
+	case h.time < 1 || h.time > maxArgon2Time:
+		return nil, fmt.Errorf("argon2id time %d is outside 1-%d", h.time, maxArgon2Time)
+	case h.memory < 8*uint32(h.threads) || h.memory > maxArgon2Memory:
+		return nil, fmt.Errorf("argon2id memory %d KiB is outside %d-%d", h.memory, 8*uint32(h.threads), maxArgon2Memory)
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("malformed argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("malformed argon2id key")
+	}
+	return h, nil
+}
+
+// verifyArgon2id checks password against an argon2id hash.
+func verifyArgon2id(hash, password string) bool {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	derived := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(derived, h.key) == 1
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Role is the permission level of an authenticated user.
+// Higher roles include every permission of the lower ones.
+type Role int
+
+const (
+	// RoleViewer may watch the terminal and the layout.
+	RoleViewer Role = iota + 1
+	// RoleOperator may also send input and act on panes and windows.
+	RoleOperator
+	// RoleAdmin may do everything, including switching sessions.
+	RoleAdmin
+)
+
+// ParseRole parses a role name as written in configuration files.
+func ParseRole(name string) (Role, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown role `%s` (expected viewer, operator or admin)", name)
+	}
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// ParseRoleMap parses a comma separated list of value=role pairs such as
+// "admins=admin,devs=operator,*=viewer".
+func ParseRoleMap(s string) (map[string]Role, error) {
+	roles := make(map[string]Role)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		value, name, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("invalid role mapping `%s` (expected value=role)", entry)
+		}
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, err
+		}
+		roles[strings.TrimSpace(value)] = role
+	}
+	return roles, nil
+}
+
+// Identity describes who is behind a request or connection.
+type Identity struct {
+	User string `json:"user"`
+	Role Role   `json:"role"`
+	// Method names the mechanism that authenticated the user, e.g. "basic".
+	Method string `json:"method"`
+	// Scopes restricts what an API token may do; zero for other logins.
+	Scopes Scope `json:"scopes,omitempty"`
+}
+
+// Allows reports whether the identity has at least the given role.
+// A nil identity, which is used when authentication is disabled,
+// is allowed everything.
+func (id *Identity) Allows(role Role) bool {
+	return id == nil || id.Role >= role
+}
+
+// HasScope reports whether the identity may use scope. Only API tokens are
+// restricted to their scopes, and ScopeAdmin includes every other scope.
+func (id *Identity) HasScope(scope Scope) bool {
+	return id == nil || id.Scopes == 0 || scope == 0 || id.Scopes&(scope|ScopeAdmin) != 0
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig configures authentication against an LDAP directory such as
+// Active Directory.
+type LDAPConfig struct {
+	// URL of the directory, ldap://host:389 or ldaps://host:636.
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before binding.
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are a service account that searches for
+	// users. Without one, users bind with the name they log in with
+	// (e.g. alice@corp.example.com) and look up themselves.
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched, e.g. "DC=corp,DC=example,DC=com".
+	BaseDN string
+	// UserFilter finds a user; %s is replaced by the escaped login name.
+	UserFilter string
+	// GroupAttribute lists the groups of a user entry.
+	GroupAttribute string
+	// Roles maps group DNs or common names to roles. The key "*" matches
+	// any user. When several groups match, the highest role wins.
+	Roles map[string]Role
+	// CacheTTL is how long a successful login is remembered, so that
+	// every request with Basic Auth does not reach the directory.
+	CacheTTL time.Duration
+	// Timeout limits each directory request.
+	Timeout time.Duration
+}
+
+// ldapConn is the part of *ldap.Conn the authenticator uses.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPAuthenticator checks user names and passwords by binding to an LDAP
+// directory and assigns roles by group membership.
+type LDAPAuthenticator struct {
+	config LDAPConfig
+	dial   func() (ldapConn, error)
+
+	// cacheKey keys the password digests in cache, so that they are
+	// worthless outside of this process.
+	cacheKey []byte
+	mu       sync.Mutex
+	cache    map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	digest   []byte
+	identity Identity
+	expires  time.Time
+}
+
+// NewLDAPAuthenticator returns an authenticator for config. It does not
+// connect until the first login.
+func NewLDAPAuthenticator(config LDAPConfig) (*LDAPAuthenticator, error) {
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, errors.New("LDAP URL and base DN are required")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(sAMAccountName=%s)"
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, fmt.Errorf("LDAP user filter `%s` has no %%s", config.UserFilter)
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	authenticator := &LDAPAuthenticator{
+		config:   config,
+		cacheKey: key,
+		cache:    make(map[string]ldapCacheEntry),
+	}
+	authenticator.dial = authenticator.dialDirectory
+	return authenticator, nil
+}
+
+func (authenticator *LDAPAuthenticator) dialDirectory() (ldapConn, error) {
+	config := authenticator.config
+	conn, err := ldap.DialURL(config.URL, ldap.DialWithTLSConfig(config.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(config.Timeout)
+	if config.StartTLS {
+		if err := conn.StartTLS(config.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate implements Authenticator. Wrong passwords, unknown users
+// and users without a role yield ErrInvalidCredentials; other errors mean
+// that the directory could not be asked.
+func (authenticator *LDAPAuthenticator) Authenticate(user, password string) (*Identity, error) {
+	// An empty password would be an unauthenticated bind, which
+	// directories accept for any DN.
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	digest := authenticator.digest(user, password)
+	if identity, ok := authenticator.cached(user, digest); ok {
+		return identity, nil
+	}
+
+	identity, err := authenticator.authenticate(user, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if authenticator.config.CacheTTL > 0 {
+		authenticator.mu.Lock()
+		authenticator.cache[user] = ldapCacheEntry{
+			digest:   digest,
+			identity: *identity,
+			expires:  time.Now().Add(authenticator.config.CacheTTL),
+		}
+		authenticator.mu.Unlock()
+	}
+	return identity, nil
+}
+
+func (authenticator *LDAPAuthenticator) authenticate(user, password string) (*Identity, error) {
+	conn, err := authenticator.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	config := authenticator.config
+	if config.BindDN != "" {
+		err = conn.Bind(config.BindDN, config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP service account bind failed: %w", err)
+		}
+	} else if err = conn.Bind(user, password); err != nil {
+		return nil, bindError(err)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(config.Timeout.Seconds()), false,
+		fmt.Sprintf(config.UserFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP search failed: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if config.BindDN != "" {
+		if err := conn.Bind(entry.DN, password); err != nil {
+			return nil, bindError(err)
+		}
+	}
+
+	role := authenticator.role(entry.GetAttributeValues(config.GroupAttribute))
+	if role == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{User: user, Role: role, Method: "ldap"}, nil
+}
+
+// bindError turns a rejected user bind into ErrInvalidCredentials.
+func bindError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return fmt.Errorf("LDAP bind failed: %w", err)
+}
+
+// role returns the highest role any of the groups maps to.
+func (authenticator *LDAPAuthenticator) role(groups []string) Role {
+	roles := authenticator.config.Roles
+	var role Role
+	for _, group := range groups {
+		for key, r := range roles {
+			if r > role && (strings.EqualFold(key, group) || strings.EqualFold(key, groupCN(group))) {
+				role = r
+			}
+		}
+	}
+	if role == 0 {
+		role = roles["*"]
+	}
+	return role
+}
+
+// groupCN returns the common name of a group DN, or "" if it has none.
+func groupCN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "CN") {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func (authenticator *LDAPAuthenticator) digest(user, password string) []byte {
+	mac := hmac.New(sha256.New, authenticator.cacheKey)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func (authenticator *LDAPAuthenticator) cached(user string, digest []byte) (*Identity, bool) {
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	now := time.Now()
+	for name, entry := range authenticator.cache {
+		if now.After(entry.expires) {
+			delete(authenticator.cache, name)
+		}
+	}
+	entry, ok := authenticator.cache[user]
+	if !ok || !hmac.Equal(entry.digest, digest) {
+		return nil, false
+	}
+	identity := entry.identity
+	return &identity, true
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth/ldaptest"
+)
+
+func newTestDirectory() *ldaptest.Server {
+	return ldaptest.NewServer(
+		ldaptest.Entry{
+			DN:       "CN=svc-webpsmux,OU=Service,DC=corp,DC=example,DC=com",
+			Password: "service",
+		},
+		ldaptest.Entry{
+			DN:       "CN=Alice,OU=Users,DC=corp,DC=example,DC=com",
+			Password: "alice-pw",
+			Attributes: map[string][]string{
+				"sAMAccountName":    {"alice"},
+				"userPrincipalName": {"alice@corp.example.com"},
+				"memberOf": {
+					"CN=Domain Users,OU=Groups,DC=corp,DC=example,DC=com",
+					"CN=Terminal Admins,OU=Groups,DC=corp,DC=example,DC=com",
+				},
+			},
+		},
+		ldaptest.Entry{
+			DN:       "CN=Bob,OU=Users,DC=corp,DC=example,DC=com",
+			Password: "bob-pw",
+			Attributes: map[string][]string{
+				"sAMAccountName":    {"bob"},
+				"userPrincipalName": {"bob@corp.example.com"},
+				"memberOf":          {"CN=Domain Users,OU=Groups,DC=corp,DC=example,DC=com"},
+			},
+		},
+	)
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	directory := newTestDirectory()
+	defer directory.Close()
+
+	authenticator, err := NewLDAPAuthenticator(LDAPConfig{
+		URL:          directory.URL,
+		BindDN:       "CN=svc-webpsmux,OU=Service,DC=corp,DC=example,DC=com",
+		BindPassword: "service",
+		BaseDN:       "DC=corp,DC=example,DC=com",
+		Roles: map[string]Role{
+			"Terminal Admins": RoleAdmin,
+			"CN=Domain Users,OU=Groups,DC=corp,DC=example,DC=com": RoleViewer,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		role           Role
+	}{
+		{"alice", "alice-pw", RoleAdmin},
+		{"bob", "bob-pw", RoleViewer},
+		{"alice", "wrong", 0},
+		{"alice", "", 0},
+		{"mallory", "alice-pw", 0},
+		{"*", "alice-pw", 0},
+	}
+	for _, tc := range tests {
+		id, err := authenticator.Authenticate(tc.user, tc.password)
+		if tc.role == 0 {
+			if err != ErrInvalidCredentials {
+				t.Errorf("%s/%s: expected ErrInvalidCredentials, got %v, %v", tc.user, tc.password, id, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.user, err)
+			continue
+		}
+		if id.User != tc.user || id.Role != tc.role || id.Method != "ldap" {
+			t.Errorf("%s: unexpected identity %+v", tc.user, id)
+		}
+	}
+}
+
+func TestLDAPAuthenticatorUserBind(t *testing.T) {
+	directory := newTestDirectory()
+	defer directory.Close()
+
+	// Without a service account users bind as themselves.
+	authenticator, err := NewLDAPAuthenticator(LDAPConfig{
+		URL:        directory.URL,
+		BaseDN:     "DC=corp,DC=example,DC=com",
+		UserFilter: "(userPrincipalName=%s)",
+		Roles:      map[string]Role{"*": RoleOperator},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := authenticator.Authenticate("bob@corp.example.com", "bob-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != RoleOperator {
+		t.Errorf("expected the wildcard role, got %s", id.Role)
+	}
+	if _, err := authenticator.Authenticate("bob@corp.example.com", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestLDAPAuthenticatorCache(t *testing.T) {
+	directory := newTestDirectory()
+	defer directory.Close()
+
+	authenticator, _ := NewLDAPAuthenticator(LDAPConfig{
+		URL:      directory.URL,
+		BaseDN:   "DC=corp,DC=example,DC=com",
+		Roles:    map[string]Role{"Domain Users": RoleViewer},
+		CacheTTL: time.Minute,
+	})
+	authenticator.config.UserFilter = "(userPrincipalName=%s)"
+
+	for i := 0; i < 3; i++ {
+		if _, err := authenticator.Authenticate("alice@corp.example.com", "alice-pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if binds := directory.Binds(); binds != 1 {
+		t.Errorf("expected repeated logins to be served from the cache, got %d binds", binds)
+	}
+	if _, err := authenticator.Authenticate("alice@corp.example.com", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected a wrong password not to match the cache, got %v", err)
+	}
+}
+
+func TestLDAPAuthenticatorUnreachable(t *testing.T) {
+	directory := newTestDirectory()
+	directory.Close()
+
+	authenticator, _ := NewLDAPAuthenticator(LDAPConfig{
+		URL:     directory.URL,
+		BaseDN:  "DC=corp,DC=example,DC=com",
+		Roles:   map[string]Role{"*": RoleViewer},
+		Timeout: time.Second,
+	})
+	if _, err := authenticator.Authenticate("alice", "alice-pw"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+// Package ldaptest provides a minimal in-process LDAP directory for tests.
+package ldaptest
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// LDAP protocol operations and result codes the server implements.
+const (
+	opBindRequest      = 0
+	opBindResponse     = 1
+	opUnbindRequest    = 2
+	opSearchRequest    = 3
+	opSearchEntry      = 4
+	opSearchDone       = 5
+	opExtendedRequest  = 23
+	opExtendedResponse = 24
+
+	// startTLSOID names the StartTLS extended operation.
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+	resultInsufficientRights = 50
+)
+
+// Entry is an object in the directory. Users have a Password.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server answers simple binds and searches with equality, presence, and,
+// or and not filters over its entries. It supports StartTLS once
+// EnableStartTLS is called, but not ldaps://.
+type Server struct {
+	// URL is the ldap:// URL the server listens at.
+	URL string
+
+	listener net.Listener
+
+	mu        sync.Mutex
+	entries   []Entry
+	binds     int
+	tlsConfig *tls.Config
+}
+
+// NewServer starts a directory with the given entries. The caller must
+// Close it.
+func NewServer(entries ...Entry) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	server := &Server{
+		URL:      "ldap://" + listener.Addr().String(),
+		listener: listener,
+		entries:  entries,
+	}
+	go server.serve()
+	return server
+}
+
+// Close stops the server.
+func (server *Server) Close() {
+	server.listener.Close()
+}
+
+// EnableStartTLS makes the server accept StartTLS with config.
+func (server *Server) EnableStartTLS(config *tls.Config) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.tlsConfig = config
+}
+
+// Binds returns the number of bind requests received so far.
+func (server *Server) Binds() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.binds
+}
+
+func (server *Server) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case opBindRequest:
+			code := server.bind(op)
+			if code == resultSuccess {
+				bound = dataString(op.Children[1])
+			}
+			writeResult(conn, id, opBindResponse, code)
+		case opSearchRequest:
+			if bound == "" {
+				writeResult(conn, id, opSearchDone, resultInsufficientRights)
+				continue
+			}
+			server.search(conn, id, op)
+		case opUnbindRequest:
+			return
+		case opExtendedRequest:
+			server.mu.Lock()
+			config := server.tlsConfig
+			server.mu.Unlock()
+			if config == nil || len(op.Children) == 0 || dataString(op.Children[0]) != startTLSOID {
+				writeResult(conn, id, opExtendedResponse, resultProtocolError)
+				continue
+			}
+			writeResult(conn, id, opExtendedResponse, resultSuccess)
+			tlsConn := tls.Server(conn, config)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+func (server *Server) bind(op *ber.Packet) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.binds++
+
+	if len(op.Children) < 3 {
+		return resultProtocolError
+	}
+	name := dataString(op.Children[1])
+	password := dataString(op.Children[2])
+	for _, entry := range server.entries {
+		if entry.Password == "" || password != entry.Password {
+			continue
+		}
+		if strings.EqualFold(entry.DN, name) || userPrincipal(entry, name) {
+			return resultSuccess
+		}
+	}
+	return resultInvalidCredentials
+}
+
+// userPrincipal reports whether name is the userPrincipalName of entry,
+// which Active Directory accepts in place of the DN.
+func userPrincipal(entry Entry, name string) bool {
+	for _, upn := range entry.Attributes["userPrincipalName"] {
+		if strings.EqualFold(upn, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) search(conn net.Conn, id interface{}, op *ber.Packet) {
+	if len(op.Children) < 8 {
+		writeResult(conn, id, opSearchDone, resultProtocolError)
+		return
+	}
+	base := strings.ToLower(dataString(op.Children[0]))
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var attributes []string
+	for _, attr := range op.Children[7].Children {
+		attributes = append(attributes, dataString(attr))
+	}
+
+	server.mu.Lock()
+	var found []Entry
+	for _, entry := range server.entries {
+		if strings.HasSuffix(strings.ToLower(entry.DN), base) && matches(entry, filter) {
+			found = append(found, entry)
+		}
+	}
+	server.mu.Unlock()
+
+	for i, entry := range found {
+		if sizeLimit > 0 && int64(i) >= sizeLimit {
+			writeResult(conn, id, opSearchDone, resultSizeLimitExceeded)
+			return
+		}
+		writeEntry(conn, id, entry, attributes)
+	}
+	writeResult(conn, id, opSearchDone, resultSuccess)
+}
+
+// matches evaluates an LDAP filter against entry.
+func matches(entry Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, child := range filter.Children {
+			if !matches(entry, child) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, child := range filter.Children {
+			if matches(entry, child) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return len(filter.Children) == 1 && !matches(entry, filter.Children[0])
+	case 3: // equality
+		if len(filter.Children) != 2 {
+			return false
+		}
+		attr := dataString(filter.Children[0])
+		value := dataString(filter.Children[1])
+		for _, v := range attribute(entry, attr) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case 7: // present
+		return len(attribute(entry, dataString(filter))) > 0
+	default:
+		return false
+	}
+}
+
+func attribute(entry Entry, name string) []string {
+	if strings.EqualFold(name, "objectClass") && entry.Attributes["objectClass"] == nil {
+		return []string{"top"}
+	}
+	for key, values := range entry.Attributes {
+		if strings.EqualFold(key, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func writeEntry(conn net.Conn, id interface{}, entry Entry, attributes []string) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, opSearchEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, ""))
+	list := ber.NewSequence("")
+	for _, name := range attributes {
+		values := attribute(entry, name)
+		if len(values) == 0 {
+			continue
+		}
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	op.AppendChild(list)
+	writeMessage(conn, id, op)
+}
+
+func writeResult(conn net.Conn, id interface{}, tag ber.Tag, code int) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	writeMessage(conn, id, op)
+}
+
+func writeMessage(conn net.Conn, id interface{}, op *ber.Packet) {
+	message := ber.NewSequence("")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
+
+// dataString returns the content of a primitive packet as a string.
+func dataString(packet *ber.Packet) string {
+	if packet.Data == nil {
+		return ""
+	}
+	return packet.Data.String()
+}
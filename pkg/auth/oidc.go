@@ -0,0 +1,405 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is the leeway allowed when checking token timestamps.
+const clockSkew = time.Minute
+
+// OIDCConfig configures an OpenID Connect relying party.
+type OIDCConfig struct {
+	// Issuer is the issuer URL; the provider metadata is discovered below
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes requested in addition to "openid".
+	Scopes []string
+	// RoleClaim names the ID token claim mapped to a role, e.g. "email"
+	// or "groups". The claim may be a string or a list of strings.
+	RoleClaim string
+	// Roles maps claim values to roles. The key "*" matches any user.
+	// When several values match, the highest role wins.
+	Roles map[string]Role
+	// HTTPClient is used to talk to the provider, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// OIDCProvider runs the authorization code flow against an OpenID Connect
+// provider and verifies the ID tokens it issues.
+type OIDCProvider struct {
+	config   OIDCConfig
+	metadata oidcMetadata
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider fetches the provider metadata of config.Issuer.
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = "email"
+	}
+	provider := &OIDCProvider{config: config}
+
+	discovery := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(ctx, discovery, &provider.metadata); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	if provider.metadata.Issuer != config.Issuer {
+		return nil, fmt.Errorf("OIDC provider reports issuer `%s`, expected `%s`", provider.metadata.Issuer, config.Issuer)
+	}
+	if provider.metadata.AuthorizationEndpoint == "" || provider.metadata.TokenEndpoint == "" || provider.metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC provider metadata is incomplete")
+	}
+	return provider, nil
+}
+
+// AuthCodeURL returns the URL the user is sent to in order to log in.
+// The provider redirects back to redirectURL with state and a code.
+func (provider *OIDCProvider) AuthCodeURL(redirectURL, state, nonce string) string {
+	scopes := append([]string{"openid"}, provider.config.Scopes...)
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {provider.config.ClientID},
+		"redirect_uri":  {redirectURL},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	endpoint := provider.metadata.AuthorizationEndpoint
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + params.Encode()
+	}
+	return endpoint + "?" + params.Encode()
+}
+
+// Exchange redeems an authorization code and returns the verified identity
+// of the user. nonce must be the value passed to AuthCodeURL.
+func (provider *OIDCProvider) Exchange(ctx context.Context, code, redirectURL, nonce string) (*Identity, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", provider.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := provider.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, token.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Identity(claims)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, lifetime and nonce
+// of an ID token and returns its claims.
+func (provider *OIDCProvider) VerifyIDToken(ctx context.Context, rawToken, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	key, err := provider.publicKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != provider.metadata.Issuer {
+		return nil, fmt.Errorf("ID token issued by `%s`, expected `%s`", iss, provider.metadata.Issuer)
+	}
+	if !audienceContains(claims["aud"], provider.config.ClientID) {
+		return nil, errors.New("ID token is not intended for this client")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("ID token is expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("ID token is issued in the future")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// Identity maps verified ID token claims to an identity. It fails with
+// ErrInvalidCredentials if no role is configured for the user.
+func (provider *OIDCProvider) Identity(claims map[string]interface{}) (*Identity, error) {
+	var user string
+	for _, claim := range []string{"email", "preferred_username", "sub"} {
+		if value, _ := claims[claim].(string); value != "" {
+			user = value
+			break
+		}
+	}
+	if user == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	var role Role
+	for _, value := range claimValues(claims[provider.config.RoleClaim]) {
+		if r := provider.config.Roles[value]; r > role {
+			role = r
+		}
+	}
+	if role == 0 {
+		role = provider.config.Roles["*"]
+	}
+	if role == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{User: user, Role: role, Method: "oidc"}, nil
+}
+
+// publicKey returns the signing key with the given ID, refreshing the key
+// set when the provider has rotated its keys.
+func (provider *OIDCProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := provider.getJSON(ctx, provider.metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %w", err)
+	}
+	provider.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		provider.keys[jwk.Kid] = key
+	}
+
+	if key, ok := provider.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token signing key `%s`", kid)
+}
+
+// lookupKey finds a cached key. A token without a key ID is accepted when
+// the provider has a single key.
+func (provider *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(provider.keys) == 1 {
+		for _, key := range provider.keys {
+			return key, true
+		}
+	}
+	key, ok := provider.keys[kid]
+	return key, ok
+}
+
+func (provider *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return provider.doJSON(req, v)
+}
+
+func (provider *OIDCProvider) doJSON(req *http.Request, v interface{}) error {
+	resp, err := provider.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", req.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve `%s`", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type `%s`", jwk.Kty)
+	}
+}
+
+// verifySignature checks a JWS signature. Only RS256 and ES256 are
+// accepted, which rules out "none" and algorithm confusion.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("ID token algorithm does not match its key")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("ID token algorithm does not match its key")
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported ID token algorithm `%s`", alg)
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	for _, value := range claimValues(aud) {
+		if value == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// claimValues returns a string claim or the strings of a list claim.
+func claimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth/oidctest"
+)
+
+func newTestOIDCProvider(t *testing.T, idp *oidctest.Provider) *OIDCProvider {
+	t.Helper()
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:       idp.Issuer(),
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RoleClaim:    "groups",
+		Roles:        map[string]Role{"admins": RoleAdmin, "devs": RoleOperator},
+	})
+	if err != nil {
+		t.Fatalf("failed to discover provider: %v", err)
+	}
+	return provider
+}
+
+func TestOIDCProvider_CodeFlow(t *testing.T) {
+	idp := oidctest.NewProvider("webpsmux", "s3cret")
+	defer idp.Close()
+	idp.Claims["groups"] = []string{"staff", "devs"}
+
+	provider := newTestOIDCProvider(t, idp)
+	redirectURL := "http://localhost:8080/auth/callback"
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(provider.AuthCodeURL(redirectURL, "the-state", "the-nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location.Query().Get("state"); got != "the-state" {
+		t.Fatalf("expected state to be passed back, got %q", got)
+	}
+
+	id, err := provider.Exchange(context.Background(), location.Query().Get("code"), redirectURL, "the-nonce")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id.User != "user@example.com" || id.Role != RoleOperator || id.Method != "oidc" {
+		t.Errorf("unexpected identity %+v", id)
+	}
+}
+
+func TestOIDCProvider_VerifyIDToken(t *testing.T) {
+	idp := oidctest.NewProvider("webpsmux", "s3cret")
+	defer idp.Close()
+	provider := newTestOIDCProvider(t, idp)
+
+	tampered := idp.IDToken("n", nil)
+	parts := strings.Split(tampered, ".")
+	other := strings.Split(idp.IDToken("n", map[string]interface{}{"email": "admin@example.com"}), ".")
+	tampered = parts[0] + "." + other[1] + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		ok    bool
+	}{
+		{name: "valid", token: idp.IDToken("n", nil), nonce: "n", ok: true},
+		{name: "wrong nonce", token: idp.IDToken("n", nil), nonce: "m"},
+		{name: "wrong audience", token: idp.IDToken("n", map[string]interface{}{"aud": "other"}), nonce: "n"},
+		{name: "audience list", token: idp.IDToken("n", map[string]interface{}{"aud": []string{"other", "webpsmux"}}), nonce: "n", ok: true},
+		{name: "wrong issuer", token: idp.IDToken("n", map[string]interface{}{"iss": "https://evil.example.com"}), nonce: "n"},
+		{name: "expired", token: idp.IDToken("n", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), nonce: "n"},
+		{name: "tampered claims", token: tampered, nonce: "n"},
+		{name: "unsigned", token: "eyJhbGciOiJub25lIn0." + parts[1] + ".", nonce: "n"},
+		{name: "garbage", token: "not-a-token", nonce: "n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := provider.VerifyIDToken(context.Background(), tc.token, tc.nonce)
+			if tc.ok && err != nil {
+				t.Fatalf("expected token to verify: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected token to be rejected")
+			}
+		})
+	}
+}
+
+func TestOIDCProvider_Identity(t *testing.T) {
+	provider := &OIDCProvider{config: OIDCConfig{
+		RoleClaim: "email",
+		Roles:     map[string]Role{"boss@example.com": RoleAdmin, "*": RoleViewer},
+	}}
+
+	id, err := provider.Identity(map[string]interface{}{"email": "boss@example.com"})
+	if err != nil || id.Role != RoleAdmin {
+		t.Errorf("expected admin, got %+v, %v", id, err)
+	}
+	id, err = provider.Identity(map[string]interface{}{"email": "intern@example.com"})
+	if err != nil || id.Role != RoleViewer {
+		t.Errorf("expected the wildcard to grant viewer, got %+v, %v", id, err)
+	}
+
+	delete(provider.config.Roles, "*")
+	if _, err := provider.Identity(map[string]interface{}{"email": "intern@example.com"}); err != ErrInvalidCredentials {
+		t.Errorf("expected unmapped users to be rejected, got %v", err)
+	}
+}
+
+func TestSessionCodec(t *testing.T) {
+	codec := NewSessionCodec([]byte("secret"))
+	id := &Identity{User: "alice", Role: RoleOperator, Method: "oidc"}
+	session := NewSession(id, time.Hour)
+
+	value, err := codec.Encode(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := codec.Decode(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *got != *session || *got.Identity() != *id {
+		t.Errorf("expected %+v, got %+v", session, got)
+	}
+
+	if _, err := NewSessionCodec([]byte("other")).Decode(value); err != ErrInvalidSession {
+		t.Errorf("expected a different key to be rejected, got %v", err)
+	}
+	if _, err := codec.Decode("x" + value); err != ErrInvalidSession {
+		t.Errorf("expected a modified value to be rejected, got %v", err)
+	}
+	expired, _ := codec.Encode(NewSession(id, -time.Second))
+	if _, err := codec.Decode(expired); err != ErrInvalidSession {
+		t.Errorf("expected an expired value to be rejected, got %v", err)
+	}
+
+	token := codec.CSRFToken(session)
+	if !codec.VerifyCSRF(session, token) {
+		t.Error("expected the CSRF token to verify")
+	}
+	if codec.VerifyCSRF(NewSession(id, time.Hour), token) || codec.VerifyCSRF(session, "") {
+		t.Error("expected the CSRF token to be bound to its session")
+	}
+}
@@ -0,0 +1,179 @@
+// Package oidctest provides a minimal OpenID Connect provider for tests.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Provider is an OpenID Connect provider that logs every authorization
+// request in as the user described by Claims, without asking.
+type Provider struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	// Claims are added to every ID token, e.g. "email" or "groups".
+	Claims map[string]interface{}
+
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]string // code -> nonce
+}
+
+// NewProvider starts a provider accepting the given client credentials.
+// The caller must Close it.
+func NewProvider(clientID, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	provider := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Claims:       map[string]interface{}{"sub": "1234", "email": "user@example.com"},
+		key:          key,
+		codes:        make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.handleDiscovery)
+	mux.HandleFunc("/authorize", provider.handleAuthorize)
+	mux.HandleFunc("/token", provider.handleToken)
+	mux.HandleFunc("/keys", provider.handleKeys)
+	provider.Server = httptest.NewServer(mux)
+	return provider
+}
+
+// Issuer returns the issuer URL to configure the relying party with.
+func (provider *Provider) Issuer() string {
+	return provider.URL
+}
+
+// IDToken returns a token signed by the provider for the current claims.
+// extra claims override the defaults.
+func (provider *Provider) IDToken(nonce string, extra map[string]interface{}) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   provider.URL,
+		"aud":   provider.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	provider.mu.Lock()
+	for k, v := range provider.Claims {
+		claims[k] = v
+	}
+	provider.mu.Unlock()
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return input + "." + encode(signature)
+}
+
+func (provider *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 provider.URL,
+		"authorization_endpoint": provider.URL + "/authorize",
+		"token_endpoint":         provider.URL + "/token",
+		"jwks_uri":               provider.URL + "/keys",
+	})
+}
+
+func (provider *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != provider.ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	provider.mu.Lock()
+	provider.codes[code] = query.Get("nonce")
+	provider.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (provider *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != provider.ClientID || secret != provider.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+	provider.mu.Lock()
+	nonce, ok := provider.codes[code]
+	delete(provider.codes, code)
+	provider.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     provider.IDToken(nonce, nil),
+	})
+}
+
+func (provider *Provider) handleKeys(w http.ResponseWriter, r *http.Request) {
+	pub := provider.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(pub.N.Bytes()),
+			"e":   encode(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return encode(buf)
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// NormalizeOrigin returns origin as scheme://host[:port] in lower case and
+// without the default port of the scheme.
+func NormalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme in origin `%s`", origin)
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("origin `%s` is not of the form scheme://host[:port]", origin)
+	}
+	host := strings.ToLower(u.Host)
+	if h, port, err := net.SplitHostPort(host); err == nil &&
+		(scheme == "http" && port == "80" || scheme == "https" && port == "443") {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+	return scheme + "://" + host, nil
+}
+
+// canonicalOrigin returns origin normalized, or as it is if it cannot be,
+// so that origins compare equal however the client spelled them.
+func canonicalOrigin(origin string) string {
+	if normalized, err := NormalizeOrigin(origin); err == nil {
+		return normalized
+	}
+	return origin
+}
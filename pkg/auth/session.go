@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSession is returned for session values that are malformed,
+// tampered with or expired.
+var ErrInvalidSession = errors.New("invalid session")
+
+// Session is a login kept in a session cookie.
+type Session struct {
+	ID     string `json:"i"`
+	User   string `json:"u"`
+	Role   Role   `json:"r"`
+	Method string `json:"m"`
+	// Expires is the absolute end of the session and LastSeen the time of
+	// the latest request, both in Unix seconds.
+	Expires  int64 `json:"e"`
+	LastSeen int64 `json:"s"`
+}
+
+// NewSession starts a session for id that ends after lifetime.
+func NewSession(id *Identity, lifetime time.Duration) *Session {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	return &Session{
+		ID:       base64.RawURLEncoding.EncodeToString(buf),
+		User:     id.User,
+		Role:     id.Role,
+		Method:   id.Method,
+		Expires:  now.Add(lifetime).Unix(),
+		LastSeen: now.Unix(),
+	}
+}
+
+// Identity returns the user of the session.
+func (s *Session) Identity() *Identity {
+	return &Identity{User: s.User, Role: s.Role, Method: s.Method}
+}
+
+// ExpiresAt returns the absolute end of the session.
+func (s *Session) ExpiresAt() time.Time {
+	return time.Unix(s.Expires, 0)
+}
+
+// IdleSince returns how long the session has not been used at now.
+func (s *Session) IdleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(s.LastSeen, 0))
+}
+
+// SessionCodec signs and verifies values stored in cookies.
+// A value is the base64url encoded payload followed by "." and its
+// HMAC-SHA256 signature, so it can be read but not forged by the client.
+type SessionCodec struct {
+	key []byte
+}
+
+// NewSessionCodec returns a codec signing with a key derived from secret.
+func NewSessionCodec(secret []byte) *SessionCodec {
+	key := sha256.Sum256(secret)
+	return &SessionCodec{key: key[:]}
+}
+
+// Encode returns the signed cookie value of s.
+func (codec *SessionCodec) Encode(s *Session) (string, error) {
+	return codec.Seal(s)
+}
+
+// Decode verifies a value returned by Encode. Expired sessions are rejected.
+func (codec *SessionCodec) Decode(value string) (*Session, error) {
+	var s Session
+	if err := codec.Open(value, &s); err != nil {
+		return nil, err
+	}
+	if s.ID == "" || s.User == "" || !time.Now().Before(s.ExpiresAt()) {
+		return nil, ErrInvalidSession
+	}
+	return &s, nil
+}
+
+// CSRFToken returns the token that state-changing requests made with the
+// session must carry. It is bound to the session and cannot be derived
+// from the cookie without the key.
+func (codec *SessionCodec) CSRFToken(s *Session) string {
+	return codec.sign("csrf." + s.ID)
+}
+
+// VerifyCSRF checks a token returned by CSRFToken.
+func (codec *SessionCodec) VerifyCSRF(s *Session, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(codec.CSRFToken(s)))
+}
+
+// Seal signs the JSON encoding of v.
+func (codec *SessionCodec) Seal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + codec.sign(payload), nil
+}
+
+// Open verifies a value returned by Seal and decodes it into v.
+func (codec *SessionCodec) Open(value string, v interface{}) error {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(codec.sign(payload))) {
+		return ErrInvalidSession
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrInvalidSession
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrInvalidSession
+	}
+	return nil
+}
+
+func (codec *SessionCodec) sign(payload string) string {
+	mac := hmac.New(sha256.New, codec.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidShare is returned for share links that are unknown, revoked,
+// expired or used up.
+var ErrInvalidShare = errors.New("invalid share link")
+
+// ShareLink grants view-only access to one session, window or pane to
+// anyone who has the link, without an account.
+type ShareLink struct {
+	ID string `json:"id"`
+	// Kind is "session", "window" or "pane", and Target its psmux name or
+	// ID, e.g. "main", "@1" or "%3".
+	Kind      string     `json:"kind"`
+	Target    string     `json:"target"`
+	CreatedBy string     `json:"created_by"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	// MaxUses limits how often the link can be opened, 0 for no limit.
+	MaxUses int `json:"max_uses,omitempty"`
+	Uses    int `json:"uses"`
+
+	hash string
+}
+
+// ShareStore keeps share links in memory, so they end on restart.
+// A link secret is "<id>_<secret>"; only the hash of the secret is kept.
+type ShareStore struct {
+	mu    sync.Mutex
+	links map[string]*ShareLink
+}
+
+// NewShareStore returns an empty store.
+func NewShareStore() *ShareStore {
+	return &ShareStore{links: make(map[string]*ShareLink)}
+}
+
+// Create adds a link to target and returns its secret. A ttl or maxUses of
+// zero does not limit the link; it lasts until revoked.
+func (store *ShareStore) Create(createdBy, kind, target string, ttl time.Duration, maxUses int) (string, ShareLink, error) {
+	switch kind {
+	case "session", "window", "pane":
+	default:
+		return "", ShareLink{}, fmt.Errorf("unknown share kind `%s` (expected session, window or pane)", kind)
+	}
+	if target == "" {
+		return "", ShareLink{}, errors.New("a share link needs a target")
+	}
+	if ttl < 0 || maxUses < 0 {
+		return "", ShareLink{}, errors.New("share limits must not be negative")
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", ShareLink{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", ShareLink{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	link := &ShareLink{
+		ID:        hex.EncodeToString(id),
+		Kind:      kind,
+		Target:    target,
+		CreatedBy: createdBy,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		MaxUses:   maxUses,
+		hash:      hashTokenSecret(encoded),
+	}
+	if ttl > 0 {
+		expires := link.Created.Add(ttl)
+		link.Expires = &expires
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.links[link.ID] = link
+	return link.ID + "_" + encoded, *link, nil
+}
+
+// Redeem opens the link with secret, which counts as one use.
+func (store *ShareStore) Redeem(secret string) (ShareLink, error) {
+	id, value, ok := strings.Cut(secret, "_")
+	if !ok {
+		return ShareLink{}, ErrInvalidShare
+	}
+	hash := hashTokenSecret(value)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	link, ok := store.active(id, time.Now())
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(link.hash)) != 1 {
+		return ShareLink{}, ErrInvalidShare
+	}
+	if link.MaxUses > 0 && link.Uses >= link.MaxUses {
+		return ShareLink{}, ErrInvalidShare
+	}
+	link.Uses++
+	return *link, nil
+}
+
+// Active returns the link with id unless it was revoked or expired. Links
+// that are used up stay active for those who opened them already.
+func (store *ShareStore) Active(id string) (ShareLink, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	link, ok := store.active(id, time.Now())
+	if !ok {
+		return ShareLink{}, false
+	}
+	return *link, true
+}
+
+// active looks up a link and drops it once expired. The caller must hold
+// store.mu.
+func (store *ShareStore) active(id string, now time.Time) (*ShareLink, bool) {
+	link, ok := store.links[id]
+	if !ok {
+		return nil, false
+	}
+	if link.Expires != nil && !now.Before(*link.Expires) {
+		delete(store.links, id)
+		return nil, false
+	}
+	return link, true
+}
+
+// Links returns the active links, oldest first.
+func (store *ShareStore) Links() []ShareLink {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	links := []ShareLink{}
+	for id := range store.links {
+		if link, ok := store.active(id, now); ok {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].Created.Equal(links[j].Created) {
+			return links[i].Created.Before(links[j].Created)
+		}
+		return links[i].ID < links[j].ID
+	})
+	return links
+}
+
+// Revoke ends the link with id for everyone.
+func (store *ShareStore) Revoke(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.links[id]; !ok {
+		return fmt.Errorf("no such share link `%s`", id)
+	}
+	delete(store.links, id)
+	return nil
+}
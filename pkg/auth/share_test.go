@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareStore(t *testing.T) {
+	store := NewShareStore()
+	secret, link, err := store.Create("alice", "pane", "%3", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, link.ID+"_") {
+		t.Errorf("expected the secret to start with the link ID, got %s", secret)
+	}
+
+	for use := 1; use <= 2; use++ {
+		opened, err := store.Redeem(secret)
+		if err != nil {
+			t.Fatalf("expected use %d to succeed, got %s", use, err)
+		}
+		if opened.Uses != use || opened.Target != "%3" {
+			t.Errorf("unexpected link %+v", opened)
+		}
+	}
+	if _, err := store.Redeem(secret); err != ErrInvalidShare {
+		t.Errorf("expected a used up link to be rejected, got %v", err)
+	}
+	if _, ok := store.Active(link.ID); !ok {
+		t.Error("expected a used up link to stay active for those who opened it")
+	}
+	if _, err := store.Redeem(link.ID + "_wrong"); err != ErrInvalidShare {
+		t.Errorf("expected a wrong secret to be rejected, got %v", err)
+	}
+
+	if err := store.Revoke(link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Active(link.ID); ok {
+		t.Error("expected a revoked link to end")
+	}
+	if len(store.Links()) != 0 {
+		t.Error("expected a revoked link not to be listed")
+	}
+}
+
+func TestShareStoreExpiry(t *testing.T) {
+	store := NewShareStore()
+	secret, link, err := store.Create("alice", "session", "main", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Redeem(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := time.Now().Add(-time.Second)
+	store.links[link.ID].Expires = &expired
+	if _, err := store.Redeem(secret); err != ErrInvalidShare {
+		t.Errorf("expected an expired link to be rejected, got %v", err)
+	}
+	if _, ok := store.Active(link.ID); ok {
+		t.Error("expected an expired link to end")
+	}
+
+	if _, _, err := store.Create("alice", "host", "main", 0, 0); err == nil {
+		t.Error("expected an unknown kind to be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInvalidTicket is returned for tickets that are forged, expired, used
+// before or presented from another origin.
+var ErrInvalidTicket = errors.New("invalid websocket ticket")
+
+// TicketIssuer mints short-lived, single-use tickets with which an
+// authenticated page opens its websocket, so that no credential has to be
+// handed to JavaScript.
+type TicketIssuer struct {
+	codec *SessionCodec
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+type ticketPayload struct {
+	ID      string `json:"i"`
+	User    string `json:"u"`
+	Role    Role   `json:"r"`
+	Method  string `json:"m"`
+	Scopes  Scope  `json:"s,omitempty"`
+	Origin  string `json:"o"`
+	Expires int64  `json:"e"`
+}
+
+// NewTicketIssuer returns an issuer of tickets valid for ttl, signed with a
+// random key.
+func NewTicketIssuer(ttl time.Duration) *TicketIssuer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &TicketIssuer{
+		codec: NewSessionCodec(key),
+		ttl:   ttl,
+		used:  make(map[string]time.Time),
+	}
+}
+
+// Issue returns a ticket for id that can only be redeemed from origin.
+// Origins are compared normalized, see NormalizeOrigin.
+func (issuer *TicketIssuer) Issue(id *Identity, origin string) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return issuer.codec.Seal(ticketPayload{
+		ID:      base64.RawURLEncoding.EncodeToString(nonce),
+		User:    id.User,
+		Role:    id.Role,
+		Method:  id.Method,
+		Scopes:  id.Scopes,
+		Origin:  canonicalOrigin(origin),
+		Expires: time.Now().Add(issuer.ttl).UnixMilli(),
+	})
+}
+
+// Redeem verifies a ticket presented from origin and returns the identity
+// it was issued for. Every ticket can be redeemed only once.
+func (issuer *TicketIssuer) Redeem(ticket, origin string) (*Identity, error) {
+	var payload ticketPayload
+	if err := issuer.codec.Open(ticket, &payload); err != nil {
+		return nil, ErrInvalidTicket
+	}
+	expires := time.UnixMilli(payload.Expires)
+	now := time.Now()
+	if !now.Before(expires) || payload.Origin != canonicalOrigin(origin) {
+		return nil, ErrInvalidTicket
+	}
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	for id, exp := range issuer.used {
+		if now.After(exp) {
+			delete(issuer.used, id)
+		}
+	}
+	if _, ok := issuer.used[payload.ID]; ok {
+		return nil, ErrInvalidTicket
+	}
+	issuer.used[payload.ID] = expires
+
+	return &Identity{User: payload.User, Role: payload.Role, Method: payload.Method, Scopes: payload.Scopes}, nil
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTicketIssuer(t *testing.T) {
+	issuer := NewTicketIssuer(time.Minute)
+	id := &Identity{User: "alice", Role: RoleOperator, Method: "basic"}
+	origin := "https://term.example.com"
+
+	ticket, err := issuer.Issue(id, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.Redeem(ticket, "https://evil.example.com"); err != ErrInvalidTicket {
+		t.Errorf("expected a ticket from another origin to be rejected, got %v", err)
+	}
+	got, err := issuer.Redeem(ticket, origin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *got != *id {
+		t.Errorf("expected %+v, got %+v", id, got)
+	}
+	if _, err := issuer.Redeem(ticket, origin); err != ErrInvalidTicket {
+		t.Errorf("expected a ticket to be usable only once, got %v", err)
+	}
+
+	if _, err := NewTicketIssuer(time.Minute).Redeem(ticket, origin); err != ErrInvalidTicket {
+		t.Errorf("expected a ticket of another issuer to be rejected, got %v", err)
+	}
+
+	issuer.ttl = -time.Second
+	expired, _ := issuer.Issue(id, origin)
+	if _, err := issuer.Redeem(expired, origin); err != ErrInvalidTicket {
+		t.Errorf("expected an expired ticket to be rejected, got %v", err)
+	}
+}
+
+func TestTicketIssuerNormalizesOrigins(t *testing.T) {
+	issuer := NewTicketIssuer(time.Minute)
+	id := &Identity{User: "alice", Role: RoleOperator, Method: "basic"}
+	tests := []struct{ issued, presented string }{
+		{"https://Example.com:443", "https://example.com"},
+		{"http://TERM.example.com:80", "http://term.example.com"},
+		{"https://example.com", "HTTPS://Example.COM:443"},
+		{"http://[::1]:80", "http://[::1]"},
+	}
+	for _, test := range tests {
+		ticket, err := issuer.Issue(id, test.issued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := issuer.Redeem(ticket, test.presented); err != nil {
+			t.Errorf("expected a ticket issued for %s to be redeemable from %s, got %v", test.issued, test.presented, err)
+		}
+	}
+
+	ticket, _ := issuer.Issue(id, "https://example.com:8443")
+	if _, err := issuer.Redeem(ticket, "https://example.com"); err != ErrInvalidTicket {
+		t.Errorf("expected another port to be rejected, got %v", err)
+	}
+}
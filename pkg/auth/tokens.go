@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a set of permissions an API token is limited to.
+type Scope uint8
+
+const (
+	// ScopeLayoutRead allows reading the layout and watching the terminal.
+	ScopeLayoutRead Scope = 1 << iota
+	// ScopePanesWrite allows creating, selecting and closing panes and
+	// windows.
+	ScopePanesWrite
+	// ScopeInputSend allows sending input to panes.
+	ScopeInputSend
+	// ScopeAdmin allows everything the role of the token allows.
+	ScopeAdmin
+)
+
+var scopeNames = []struct {
+	scope Scope
+	name  string
+}{
+	{ScopeLayoutRead, "layout:read"},
+	{ScopePanesWrite, "panes:write"},
+	{ScopeInputSend, "input:send"},
+	{ScopeAdmin, "admin"},
+}
+
+// ParseScopes parses a comma or space separated list of scope names such as
+// "layout:read,input:send".
+func ParseScopes(s string) (Scope, error) {
+	var scopes Scope
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		scope, err := parseScope(name)
+		if err != nil {
+			return 0, err
+		}
+		scopes |= scope
+	}
+	return scopes, nil
+}
+
+func parseScope(name string) (Scope, error) {
+	for _, entry := range scopeNames {
+		if strings.EqualFold(entry.name, name) {
+			return entry.scope, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope `%s` (expected layout:read, panes:write, input:send or admin)", name)
+}
+
+// Names returns the names of the scopes in s.
+func (s Scope) Names() []string {
+	names := []string{}
+	for _, entry := range scopeNames {
+		if s&entry.scope != 0 {
+			names = append(names, entry.name)
+		}
+	}
+	return names
+}
+
+func (s Scope) String() string {
+	return strings.Join(s.Names(), ",")
+}
+
+func (s Scope) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Names())
+}
+
+func (s *Scope) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	*s = 0
+	for _, name := range names {
+		scope, err := parseScope(name)
+		if err != nil {
+			return err
+		}
+		*s |= scope
+	}
+	return nil
+}
+
+// MaxScopes returns the scopes a user with role may grant a token.
+func MaxScopes(role Role) Scope {
+	switch {
+	case role >= RoleAdmin:
+		return ScopeLayoutRead | ScopePanesWrite | ScopeInputSend | ScopeAdmin
+	case role >= RoleOperator:
+		return ScopeLayoutRead | ScopePanesWrite | ScopeInputSend
+	case role >= RoleViewer:
+		return ScopeLayoutRead
+	default:
+		return 0
+	}
+}
+
+// TokenPrefix starts every API token, which makes them easy to tell apart
+// from tickets and to find in leaked logs.
+const TokenPrefix = "wpt_"
+
+// ErrInvalidToken is returned for API tokens that are unknown, revoked or
+// expired.
+var ErrInvalidToken = errors.New("invalid API token")
+
+// Token is a personal API token. Only the hash of its secret is kept.
+type Token struct {
+	ID   string `json:"id"`
+	User string `json:"user"`
+	// Role is the role of the user when the token was created. The token
+	// never has more than that.
+	Role     Role       `json:"role"`
+	Name     string     `json:"name"`
+	Scopes   Scope      `json:"scopes"`
+	Hash     string     `json:"hash"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// IsToken reports whether s looks like an API token rather than another
+// credential.
+func IsToken(s string) bool {
+	return strings.HasPrefix(s, TokenPrefix)
+}
+
+// TokenStore keeps API tokens in a JSON file readable only by the owner.
+// A token is "wpt_<id>_<secret>"; the id selects the entry and the secret
+// is compared with its SHA-256 hash.
+type TokenStore struct {
+	path string
+
+	mu     sync.Mutex
+	tokens map[string]*Token
+}
+
+// lastUsedResolution limits how often the use of a token is written to the
+// file.
+const lastUsedResolution = time.Minute
+
+// LoadTokenStore reads the tokens at path. A missing file is an empty
+// store, created on the first token.
+func LoadTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path, tokens: make(map[string]*Token)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse tokens file %s: %w", path, err)
+	}
+	for _, token := range tokens {
+		store.tokens[token.ID] = token
+	}
+	return store, nil
+}
+
+// Create issues a token for owner and returns it together with its entry.
+// The token itself is not stored and cannot be shown again. A ttl of zero
+// never expires.
+func (store *TokenStore) Create(owner *Identity, name string, scopes Scope, ttl time.Duration) (string, Token, error) {
+	if scopes == 0 {
+		return "", Token{}, errors.New("a token needs at least one scope")
+	}
+	if extra := scopes &^ MaxScopes(owner.Role); extra != 0 {
+		return "", Token{}, fmt.Errorf("role %s may not grant %s", owner.Role, extra)
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", Token{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", Token{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	token := &Token{
+		ID:      hex.EncodeToString(id),
+		User:    owner.User,
+		Role:    owner.Role,
+		Name:    name,
+		Scopes:  scopes,
+		Hash:    hashTokenSecret(encoded),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		expires := token.Created.Add(ttl)
+		token.Expires = &expires
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.tokens[token.ID] = token
+	if err := store.save(); err != nil {
+		delete(store.tokens, token.ID)
+		return "", Token{}, err
+	}
+	return TokenPrefix + token.ID + "_" + encoded, *token, nil
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the identity of a token: its user with the role and
+// scopes of the token.
+func (store *TokenStore) Authenticate(value string) (*Identity, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(value, TokenPrefix), "_")
+	if !ok || !IsToken(value) {
+		return nil, ErrInvalidToken
+	}
+	hash := hashTokenSecret(secret)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	token, ok := store.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now().UTC()
+	if token.Expires != nil && !now.Before(*token.Expires) {
+		return nil, ErrInvalidToken
+	}
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) >= lastUsedResolution {
+		used := now.Truncate(time.Second)
+		token.LastUsed = &used
+		// The use is informational; a failed write must not fail the login.
+		store.save()
+	}
+	return &Identity{User: token.User, Role: token.Role, Method: "token", Scopes: token.Scopes}, nil
+}
+
+// Tokens returns the tokens of user, or of all users if user is empty,
+// oldest first.
+func (store *TokenStore) Tokens(user string) []Token {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tokens := []Token{}
+	for _, token := range store.tokens {
+		if user == "" || token.User == user {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.Before(tokens[j].Created)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens
+}
+
+// Lookup returns the token with id.
+func (store *TokenStore) Lookup(id string) (Token, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	token, ok := store.tokens[id]
+	if !ok {
+		return Token{}, false
+	}
+	return *token, true
+}
+
+// Revoke deletes the token with id.
+func (store *TokenStore) Revoke(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	token, ok := store.tokens[id]
+	if !ok {
+		return fmt.Errorf("no such token `%s`", id)
+	}
+	delete(store.tokens, id)
+	if err := store.save(); err != nil {
+		store.tokens[id] = token
+		return err
+	}
+	return nil
+}
+
+// save writes the tokens to the file. The caller must hold store.mu.
+func (store *TokenStore) save() error {
+	tokens := make([]*Token, 0, len(store.tokens))
+	for _, token := range store.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("layout:read, input:send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scopes != ScopeLayoutRead|ScopeInputSend || scopes.String() != "layout:read,input:send" {
+		t.Errorf("unexpected scopes %s", scopes)
+	}
+	if _, err := ParseScopes("layout:write"); err == nil {
+		t.Error("expected an unknown scope to be rejected")
+	}
+
+	token := &Identity{Role: RoleAdmin, Scopes: ScopeLayoutRead}
+	if !token.HasScope(ScopeLayoutRead) || token.HasScope(ScopeInputSend) {
+		t.Error("expected a token to be limited to its scopes")
+	}
+	if !(&Identity{Role: RoleAdmin, Scopes: ScopeAdmin}).HasScope(ScopeInputSend) {
+		t.Error("expected the admin scope to include the others")
+	}
+	if !(&Identity{Role: RoleViewer}).HasScope(ScopeAdmin) {
+		t.Error("expected logins other than tokens not to be limited by scopes")
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := LoadTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &Identity{User: "alice", Role: RoleOperator, Method: "basic"}
+	if _, _, err := store.Create(alice, "ci", ScopeAdmin, 0); err == nil {
+		t.Error("expected an operator not to grant the admin scope")
+	}
+	if _, _, err := store.Create(alice, "ci", 0, 0); err == nil {
+		t.Error("expected a token without scopes to be rejected")
+	}
+	value, token, err := store.Create(alice, "ci", ScopeLayoutRead|ScopeInputSend, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsToken(value) {
+		t.Errorf("unexpected token format %s", value)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), value[strings.LastIndex(value, "_")+1:]) {
+		t.Error("expected the secret not to be stored")
+	}
+
+	id, err := store.Authenticate(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "alice" || id.Role != RoleOperator || id.Method != "token" || id.Scopes != token.Scopes {
+		t.Errorf("unexpected identity %+v", id)
+	}
+	if _, err := store.Authenticate(value + "x"); err != ErrInvalidToken {
+		t.Errorf("expected a wrong secret to be rejected, got %v", err)
+	}
+
+	// Tokens survive a restart, revocation does too.
+	reloaded, err := LoadTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := reloaded.Tokens("alice"); len(tokens) != 1 || tokens[0].LastUsed == nil {
+		t.Fatalf("expected the token with its last use to be loaded, got %+v", tokens)
+	}
+	if err := reloaded.Revoke(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Authenticate(value); err != ErrInvalidToken {
+		t.Errorf("expected a revoked token to be rejected, got %v", err)
+	}
+	if len(reloaded.Tokens("")) != 0 {
+		t.Error("expected no tokens left")
+	}
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	store, _ := LoadTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	owner := &Identity{User: "alice", Role: RoleViewer}
+	value, _, err := store.Create(owner, "short", ScopeLayoutRead, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := store.Authenticate(value); err != ErrInvalidToken {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+}
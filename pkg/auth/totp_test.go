@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to six digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		code, err := TOTPCode(secret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("at %d: expected %s, got %s", tc.unix, tc.code, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	late, _ := TOTPCode(secret, now.Add(-totpPeriod*time.Second))
+	if _, ok := verifyTOTP(secret, late, now); !ok {
+		t.Error("expected the code of the previous step to be accepted")
+	}
+	old, _ := TOTPCode(secret, now.Add(-3*totpPeriod*time.Second))
+	if _, ok := verifyTOTP(secret, old, now); ok {
+		t.Error("expected an old code to be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("webpsmux", "alice", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/webpsmux:alice?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("unexpected URI %s", uri)
+	}
+}
+
+func TestUserStore_TOTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.hcl")
+	store := NewUserStore(path)
+	if err := store.SetPassword("alice", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	secret, codes, err := store.EnableTOTP("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Authenticate("alice", "s3cret"); err != ErrSecondFactorRequired {
+		t.Errorf("expected a code to be required, got %v", err)
+	}
+	code, _ := TOTPCode(secret, time.Now())
+	if _, err := store.Authenticate("alice", "wrong"+code); err != ErrInvalidCredentials {
+		t.Errorf("expected a wrong password to be rejected, got %v", err)
+	}
+	if _, err := store.Authenticate("alice", "s3cret"+code); err != nil {
+		t.Fatalf("expected password and code to authenticate: %v", err)
+	}
+	if _, err := store.Authenticate("alice", "s3cret"+code); err != ErrInvalidCredentials {
+		t.Errorf("expected a code to be usable only once, got %v", err)
+	}
+
+	if _, err := store.Authenticate("alice", "s3cret"+codes[0]); err != nil {
+		t.Fatalf("expected a recovery code to authenticate: %v", err)
+	}
+	reloaded, _ := LoadUserStore(path)
+	if _, err := reloaded.Authenticate("alice", "s3cret"+codes[0]); err != ErrInvalidCredentials {
+		t.Errorf("expected a used recovery code to be removed from the file, got %v", err)
+	}
+	if user, _ := reloaded.Lookup("alice"); len(user.RecoveryCodes) != len(codes)-1 {
+		t.Errorf("expected %d recovery codes left, got %d", len(codes)-1, len(user.RecoveryCodes))
+	}
+}
+
+func TestUserStore_TOTPLockout(t *testing.T) {
+	store := NewUserStore(filepath.Join(t.TempDir(), "users.hcl"))
+	store.SetPassword("alice", "s3cret")
+	secret, _, _ := store.EnableTOTP("alice")
+
+	for i := 0; i < maxCodeFailures; i++ {
+		store.Authenticate("alice", "s3cret000000")
+	}
+	code, _ := TOTPCode(secret, time.Now())
+	if _, err := store.Authenticate("alice", "s3cret"+code); err != ErrInvalidCredentials {
+		t.Errorf("expected the second factor to be locked after %d wrong codes, got %v", maxCodeFailures, err)
+	}
+}
+
+func TestUserStore_TOTPRequiresHCL(t *testing.T) {
+	store := NewUserStore(filepath.Join(t.TempDir(), "htpasswd"))
+	store.SetPassword("alice", "s3cret")
+	if _, _, err := store.EnableTOTP("alice"); err == nil {
+		t.Error("expected two-factor authentication to be refused for htpasswd files")
+	}
+}
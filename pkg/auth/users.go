@@ -0,0 +1,555 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yudai/hcl"
+)
+
+// User is an account in a users file.
+type User struct {
+	Name string
+	// Password is a bcrypt or argon2id hash, see VerifyPassword.
+	Password string
+	Role     Role
+	// TOTPSecret enables two-factor authentication if set, see
+	// UserStore.Authenticate.
+	TOTPSecret string
+	// RecoveryCodes are hashes of the unused one-time recovery codes.
+	RecoveryCodes []string
+}
+
+type fileFormat int
+
+const (
+	formatHCL fileFormat = iota
+	formatHtpasswd
+)
+
+// UserStore is a set of accounts backed by a users file. The file is either
+// HCL:
+//
+//	user "alice" {
+//	  password = "$2y$10$..."
+//	  role     = "admin"
+//	}
+//
+// or htpasswd lines with an optional third role field, such as
+// "alice:$2y$10$...:admin". Users without a role are viewers.
+// Two-factor authentication adds totp_secret and recovery_codes to a user
+// and is only available in HCL files.
+// Changes written to the file by another process, such as
+// `webpsmux passwd`, are picked up on the next authentication.
+type UserStore struct {
+	path   string
+	format fileFormat
+
+	mu      sync.RWMutex
+	users   map[string]*User
+	modTime time.Time
+	// codes tracks the second factor of each user across attempts.
+	codes map[string]*codeState
+}
+
+// codeState prevents the replay of TOTP codes and limits wrong codes.
+type codeState struct {
+	lastStep    uint64
+	failures    int
+	lockedUntil time.Time
+}
+
+const (
+	// maxCodeFailures wrong codes after a correct password lock the second
+	// factor of a user for codeLockout.
+	maxCodeFailures = 5
+	codeLockout     = 5 * time.Minute
+)
+
+// ErrSecondFactorRequired is returned when a user with two-factor
+// authentication gave the right password but no code.
+var ErrSecondFactorRequired = errors.New("authentication code required")
+
+// NewUserStore returns an empty store that will be saved to path.
+// Paths whose base name contains "htpasswd" use the htpasswd format,
+// anything else HCL.
+func NewUserStore(path string) *UserStore {
+	format := formatHCL
+	if strings.Contains(strings.ToLower(filepath.Base(path)), "htpasswd") {
+		format = formatHtpasswd
+	}
+	return &UserStore{
+		path:   path,
+		format: format,
+		users:  make(map[string]*User),
+		codes:  make(map[string]*codeState),
+	}
+}
+
+// LoadUserStore reads the users file at path.
+func LoadUserStore(path string) (*UserStore, error) {
+	store := NewUserStore(path)
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *UserStore) load() error {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+
+	users, format, err := parseUsers(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse users file %s: %w", store.path, err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.users = users
+	store.format = format
+	store.modTime = info.ModTime()
+	return nil
+}
+
+// reloadIfChanged re-reads the file when its modification time changed.
+// A file that fails to parse leaves the previous accounts in place.
+func (store *UserStore) reloadIfChanged() {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return
+	}
+	store.mu.RLock()
+	changed := !info.ModTime().Equal(store.modTime)
+	store.mu.RUnlock()
+	if changed {
+		store.load()
+	}
+}
+
+// Authenticate implements Authenticator. Users with two-factor
+// authentication append the current TOTP code or a recovery code to their
+// password, as in "s3cret123456" or "s3cretk3vq7-m2xwp". Recovery codes
+// are removed from the file once used.
+func (store *UserStore) Authenticate(name, password string) (*Identity, error) {
+	store.reloadIfChanged()
+
+	user, ok := store.Lookup(name)
+	if !ok {
+		// Spend the same time as for a real user so that response times
+		// do not reveal which accounts exist.
+		VerifyPassword(dummyHash(), password)
+		return nil, ErrInvalidCredentials
+	}
+	if user.TOTPSecret == "" {
+		if !VerifyPassword(user.Password, password) {
+			return nil, ErrInvalidCredentials
+		}
+		return &Identity{User: user.Name, Role: user.Role, Method: "basic"}, nil
+	}
+
+	secret, code := splitSecondFactor(password)
+	if code == "" || !VerifyPassword(user.Password, secret) {
+		if VerifyPassword(user.Password, password) {
+			return nil, ErrSecondFactorRequired
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if err := store.verifySecondFactor(user, code); err != nil {
+		return nil, err
+	}
+	return &Identity{User: user.Name, Role: user.Role, Method: "basic"}, nil
+}
+
+// splitSecondFactor splits a recovery code or a TOTP code off the end of
+// password. code is empty if password ends in neither.
+func splitSecondFactor(password string) (secret, code string) {
+	if n := len(password) - 11; n >= 0 && isRecoveryCode(password[n:]) {
+		return password[:n], password[n:]
+	}
+	n := len(password) - totpDigits
+	if n < 0 {
+		return password, ""
+	}
+	for _, c := range password[n:] {
+		if c < '0' || c > '9' {
+			return password, ""
+		}
+	}
+	return password[:n], password[n:]
+}
+
+// verifySecondFactor checks the code of a user whose password was right.
+func (store *UserStore) verifySecondFactor(user User, code string) error {
+	now := time.Now()
+	store.mu.Lock()
+	state, ok := store.codes[user.Name]
+	if !ok {
+		state = &codeState{}
+		store.codes[user.Name] = state
+	}
+	if now.Before(state.lockedUntil) {
+		store.mu.Unlock()
+		return ErrInvalidCredentials
+	}
+
+	valid := false
+	usedRecovery := false
+	if isRecoveryCode(code) {
+		valid = store.useRecoveryCode(user.Name, code)
+		usedRecovery = valid
+	} else if step, ok := verifyTOTP(user.TOTPSecret, code, now); ok && step > state.lastStep {
+		state.lastStep = step
+		valid = true
+	}
+
+	if !valid {
+		state.failures++
+		if state.failures >= maxCodeFailures {
+			state.failures = 0
+			state.lockedUntil = now.Add(codeLockout)
+		}
+		store.mu.Unlock()
+		return ErrInvalidCredentials
+	}
+	state.failures = 0
+	store.mu.Unlock()
+
+	if usedRecovery {
+		if err := store.Save(); err != nil {
+			return fmt.Errorf("failed to remove used recovery code: %w", err)
+		}
+	}
+	return nil
+}
+
+// useRecoveryCode removes code from the user's recovery codes and reports
+// whether it was one of them. The caller holds store.mu.
+func (store *UserStore) useRecoveryCode(name, code string) bool {
+	user := store.users[name]
+	hash := hashRecoveryCode(code)
+	for i, candidate := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(hash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns a copy of the named account.
+func (store *UserStore) Lookup(name string) (User, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	user, ok := store.users[name]
+	if !ok {
+		return User{}, false
+	}
+	return *user, true
+}
+
+// LookupRole returns the current role of the named account.
+func (store *UserStore) LookupRole(name string) (Role, bool) {
+	user, ok := store.Lookup(name)
+	return user.Role, ok
+}
+
+// Users returns copies of all accounts sorted by name.
+func (store *UserStore) Users() []User {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	users := make([]User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// SetPassword sets the password of a user, creating a viewer if the user
+// does not exist yet. Call Save to persist the change.
+func (store *UserStore) SetPassword(name, password string) error {
+	if err := validateUserName(name); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, ok := store.users[name]
+	if !ok {
+		user = &User{Name: name, Role: RoleViewer}
+		store.users[name] = user
+	}
+	user.Password = hash
+	return nil
+}
+
+// SetRole changes the role of an existing user.
+func (store *UserStore) SetRole(name string, role Role) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, ok := store.users[name]
+	if !ok {
+		return fmt.Errorf("no such user `%s`", name)
+	}
+	user.Role = role
+	return nil
+}
+
+// EnableTOTP gives an existing user a new TOTP secret and new recovery
+// codes, replacing any previous ones. It returns the secret and the
+// plaintext recovery codes, which are not stored.
+func (store *UserStore) EnableTOTP(name string) (secret string, codes []string, err error) {
+	if store.format == formatHtpasswd {
+		return "", nil, errors.New("two-factor authentication requires an HCL users file")
+	}
+	secret, err = GenerateTOTPSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return "", nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, ok := store.users[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such user `%s`", name)
+	}
+	user.TOTPSecret = secret
+	user.RecoveryCodes = hashes
+	delete(store.codes, name)
+	return secret, codes, nil
+}
+
+// ResetRecoveryCodes replaces the recovery codes of a user with two-factor
+// authentication and returns the new ones.
+func (store *UserStore) ResetRecoveryCodes(name string) ([]string, error) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, ok := store.users[name]
+	if !ok {
+		return nil, fmt.Errorf("no such user `%s`", name)
+	}
+	if user.TOTPSecret == "" {
+		return nil, fmt.Errorf("user `%s` has no two-factor authentication", name)
+	}
+	user.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for a user.
+func (store *UserStore) DisableTOTP(name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, ok := store.users[name]
+	if !ok {
+		return fmt.Errorf("no such user `%s`", name)
+	}
+	user.TOTPSecret = ""
+	user.RecoveryCodes = nil
+	delete(store.codes, name)
+	return nil
+}
+
+// Delete removes a user.
+func (store *UserStore) Delete(name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.users[name]; !ok {
+		return fmt.Errorf("no such user `%s`", name)
+	}
+	delete(store.users, name)
+	return nil
+}
+
+// Save writes the store back to its file, readable only by the owner.
+func (store *UserStore) Save() error {
+	var buf bytes.Buffer
+	for _, user := range store.Users() {
+		switch store.format {
+		case formatHtpasswd:
+			fmt.Fprintf(&buf, "%s:%s:%s\n", user.Name, user.Password, user.Role)
+		default:
+			fmt.Fprintf(&buf, "user %s {\n", strconv.Quote(user.Name))
+			fmt.Fprintf(&buf, "  password = %s\n", strconv.Quote(user.Password))
+			fmt.Fprintf(&buf, "  role     = %s\n", strconv.Quote(user.Role.String()))
+			if user.TOTPSecret != "" {
+				fmt.Fprintf(&buf, "  totp_secret    = %s\n", strconv.Quote(user.TOTPSecret))
+				fmt.Fprintf(&buf, "  recovery_codes = [")
+				for i, hash := range user.RecoveryCodes {
+					if i > 0 {
+						buf.WriteString(", ")
+					}
+					buf.WriteString(strconv.Quote(hash))
+				}
+				fmt.Fprintf(&buf, "]\n")
+			}
+			fmt.Fprintf(&buf, "}\n\n")
+		}
+	}
+
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if info, err := os.Stat(store.path); err == nil {
+		store.mu.Lock()
+		store.modTime = info.ModTime()
+		store.mu.Unlock()
+	}
+	return nil
+}
+
+type hclUsersFile struct {
+	Users map[string]hclUser `hcl:"user"`
+}
+
+type hclUser struct {
+	Password      string   `hcl:"password"`
+	Role          string   `hcl:"role"`
+	TOTPSecret    string   `hcl:"totp_secret"`
+	RecoveryCodes []string `hcl:"recovery_codes"`
+}
+
+// parseUsers detects the file format and parses the accounts in data.
+func parseUsers(data []byte) (map[string]*User, fileFormat, error) {
+	if isHtpasswd(data) {
+		users, err := parseHtpasswd(data)
+		return users, formatHtpasswd, err
+	}
+
+	var file hclUsersFile
+	if err := hcl.Decode(&file, string(data)); err != nil {
+		return nil, formatHCL, err
+	}
+	users := make(map[string]*User, len(file.Users))
+	for name, entry := range file.Users {
+		user, err := newUser(name, entry.Password, entry.Role)
+		if err != nil {
+			return nil, formatHCL, err
+		}
+		if entry.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(entry.TOTPSecret); err != nil {
+				return nil, formatHCL, fmt.Errorf("user `%s`: %w", name, err)
+			}
+			user.TOTPSecret = entry.TOTPSecret
+			user.RecoveryCodes = entry.RecoveryCodes
+		}
+		users[name] = user
+	}
+	return users, formatHCL, nil
+}
+
+// isHtpasswd reports whether the first meaningful line looks like
+// "name:hash", so that hashes in formats which are not supported are
+// reported as such rather than as HCL syntax errors.
+func isHtpasswd(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, found := strings.Cut(line, ":")
+		return found && name != "" && !strings.ContainsAny(name, " \t\"{=")
+	}
+	return false
+}
+
+func parseHtpasswd(data []byte) (map[string]*User, error) {
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected name:hash[:role]", lineNo)
+		}
+		role := ""
+		if len(fields) == 3 {
+			role = fields[2]
+		}
+		user, err := newUser(fields[0], fields[1], role)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		users[user.Name] = user
+	}
+	return users, scanner.Err()
+}
+
+func newUser(name, hash, role string) (*User, error) {
+	if err := validateUserName(name); err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		return nil, fmt.Errorf("user `%s` has no password", name)
+	}
+	if err := checkHash(hash); err != nil {
+		return nil, fmt.Errorf("user `%s`: %w", name, err)
+	}
+	user := &User{Name: name, Password: hash, Role: RoleViewer}
+	if role != "" {
+		r, err := ParseRole(role)
+		if err != nil {
+			return nil, fmt.Errorf("user `%s`: %w", name, err)
+		}
+		user.Role = r
+	}
+	return user, nil
+}
+
+func validateUserName(name string) error {
+	if name == "" || strings.ContainsAny(name, ":\"\n\r\t") {
+		return fmt.Errorf("invalid user name `%s`", name)
+	}
+	return nil
+}
+
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue string
+)
+
+func dummyHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHashValue, _ = HashPassword("dummy password")
+	})
+	return dummyHashValue
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestUserStore_HCL(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.hcl")
+	data := `
+user "alice" {
+  password = "` + hash + `"
+  role     = "admin"
+}
+
+user "bob" {
+  password = "` + hash + `"
+}
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	id, err := store.Authenticate("alice", "s3cret")
+	if err != nil {
+		t.Fatalf("expected alice to authenticate: %v", err)
+	}
+	if id.Role != RoleAdmin {
+		t.Errorf("expected admin role, got %s", id.Role)
+	}
+	if id, err := store.Authenticate("bob", "s3cret"); err != nil || id.Role != RoleViewer {
+		t.Errorf("expected bob to be a viewer, got %+v, %v", id, err)
+	}
+	if _, err := store.Authenticate("alice", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials for a wrong password, got %v", err)
+	}
+	if _, err := store.Authenticate("mallory", "s3cret"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials for an unknown user, got %v", err)
+	}
+}
+
+func TestUserStore_HtpasswdRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+
+	store := NewUserStore(path)
+	if err := store.SetPassword("carol", "pa:ss"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetRole("carol", RoleOperator); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if loaded.format != formatHtpasswd {
+		t.Errorf("expected htpasswd format to be detected")
+	}
+	id, err := loaded.Authenticate("carol", "pa:ss")
+	if err != nil {
+		t.Fatalf("expected carol to authenticate: %v", err)
+	}
+	if id.Role != RoleOperator {
+		t.Errorf("expected operator role, got %s", id.Role)
+	}
+}
+
+func TestUserStore_UnsupportedHash(t *testing.T) {
+	hashes := []string{
+		"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"rqXexS6ZhobKA",
+	}
+	for _, hash := range hashes {
+		path := filepath.Join(t.TempDir(), ".htpasswd")
+		if err := os.WriteFile(path, []byte("dave:"+hash+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadUserStore(path)
+		if err == nil {
+			t.Errorf("expected %q to be refused", hash)
+			continue
+		}
+		if !strings.Contains(err.Error(), "dave") || !strings.Contains(err.Error(), "bcrypt") {
+			t.Errorf("expected the error to name the user and the supported formats, got %v", err)
+		}
+	}
+}
+
+func TestUserStore_Argon2idParameters(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("somesalt"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	params := []string{"m=65536,t=2,p=0", "m=65536,t=0,p=1", "m=4294967295,t=2,p=1", "m=65536,t=1000,p=1"}
+	for _, p := range params {
+		hash := fmt.Sprintf("$argon2id$v=19$%s$%s$%s", p, salt, key)
+		path := filepath.Join(t.TempDir(), ".htpasswd")
+		if err := os.WriteFile(path, []byte("dave:"+hash+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUserStore(path); err == nil || !strings.Contains(err.Error(), "dave") {
+			t.Errorf("expected %s to be refused naming the user, got %v", p, err)
+		}
+		if VerifyPassword(hash, "password") {
+			t.Errorf("expected %s not to verify", p)
+		}
+	}
+}
+
+func TestVerifyPassword_Argon2id(t *testing.T) {
+	salt := []byte("somesalt")
+	key := argon2.IDKey([]byte("password"), salt, 2, 64*1024, 1, 32)
+	hash := fmt.Sprintf("$argon2id$v=19$m=65536,t=2,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	if !VerifyPassword(hash, "password") {
+		t.Error("expected argon2id hash to verify")
+	}
+	if VerifyPassword(hash, "Password") {
+		t.Error("expected wrong password to fail")
+	}
+}
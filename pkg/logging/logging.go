@@ -0,0 +1,69 @@
+// Package logging sets up the structured logger of the server.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"webpsmux/pkg/rotate"
+)
+
+// Config selects where and how log records are written.
+type Config struct {
+	// Level is debug, info, warn or error.
+	Level string
+	// Format is text or json.
+	Format string
+	// File is the path of the log file, standard error if empty. It is
+	// rotated after MaxSize bytes or MaxAge; zero disables either.
+	File    string
+	MaxSize int64
+	MaxAge  time.Duration
+	// Quiet discards all records.
+	Quiet bool
+}
+
+// ParseLevel parses a level name.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level `%s` (expected debug, info, warn or error)", name)
+	}
+	return level, nil
+}
+
+// New returns a logger for config and the file it writes to, if any, for
+// the caller to close.
+func New(config Config) (*slog.Logger, io.Closer, error) {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	var newHandler func(io.Writer, *slog.HandlerOptions) slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		newHandler = func(w io.Writer, options *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, options) }
+	case "json":
+		newHandler = func(w io.Writer, options *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, options) }
+	default:
+		return nil, nil, fmt.Errorf("unknown log format `%s` (expected text or json)", config.Format)
+	}
+
+	var w io.Writer = os.Stderr
+	var closer io.Closer
+	switch {
+	case config.Quiet:
+		w = io.Discard
+	case config.File != "":
+		file, err := rotate.Open(config.File, config.MaxSize, config.MaxAge, time.Time{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file `%s`: %w", config.File, err)
+		}
+		w, closer = file, file
+	}
+	return slog.New(newHandler(w, &slog.HandlerOptions{Level: level})), closer, nil
+}
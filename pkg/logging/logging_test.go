@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webpsmux.log")
+	logger, closer, err := New(Config{Level: "warn", Format: "json", File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "conn", 3)
+	closer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q", data)
+	}
+	if record["msg"] != "shown" || record["conn"] != 3.0 {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	if _, _, err := New(Config{Level: "verbose"}); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+	if _, _, err := New(Config{Level: "info", Format: "xml"}); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("test_requests_total", "Requests.\nBy method.", "method")
+	registry.GaugeFunc("test_up", "Whether it is up.", func() float64 { return 1 })
+	latency := registry.Histogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	registry.Gauge("test_unused", "Never set.", "label")
+
+	requests.Inc("GET")
+	requests.Add(2, `say "hi"`)
+	requests.Inc("GET")
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(5)
+
+	var out strings.Builder
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.15
+test_latency_seconds_count 3
+# HELP test_requests_total Requests.\nBy method.
+# TYPE test_requests_total counter
+test_requests_total{method="GET"} 2
+test_requests_total{method="say \"hi\""} 2
+# HELP test_unused Never set.
+# TYPE test_unused gauge
+# HELP test_up Whether it is up.
+# TYPE test_up gauge
+test_up 1
+`
+	if out.String() != expected {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.Counter("test_total", "Test.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a missing label value to panic")
+		}
+	}()
+	counter.Inc("only a")
+}
@@ -1,7 +1,9 @@
 package psmux
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"os/exec"
 	"strings"
 	"sync"
@@ -10,6 +12,7 @@ import (
 
 type Controller struct {
 	sessionName string
+	version     string
 	layoutCache *Layout
 	layoutMu    sync.RWMutex
 	refreshMu   sync.Mutex
@@ -17,11 +20,22 @@ type Controller struct {
 	minInterval time.Duration
 	eventChan   chan Event
 	closeChan   chan struct{}
+	logger      *slog.Logger
+	observe     func(command string, duration time.Duration, err error)
+	// noFormat is set once psmux turned out not to support list-windows
+	// -F. It is guarded by refreshMu.
+	noFormat bool
 }
 
-func NewController(sessionName string) (*Controller, error) {
+// NewController returns a controller for the named session that logs to
+// logger, or to slog.Default() if it is nil.
+func NewController(sessionName string, logger *slog.Logger) (*Controller, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	c := &Controller{
 		sessionName: sessionName,
+		logger:      logger,
 		eventChan:   make(chan Event, 100),
 		closeChan:   make(chan struct{}),
 		minInterval: 300 * time.Millisecond,
@@ -29,6 +43,13 @@ func NewController(sessionName string) (*Controller, error) {
 	return c, nil
 }
 
+// OnCommand makes the controller call observe after every psmux command it
+// runs, with the subcommand, e.g. "list-panes", how long it took and the
+// error if it failed. It must be called before Start.
+func (c *Controller) OnCommand(observe func(command string, duration time.Duration, err error)) {
+	c.observe = observe
+}
+
 func (c *Controller) Start() error {
 	cmd := exec.Command("psmux", "has-session", "-t", c.sessionName)
 	if err := cmd.Run(); err != nil {
@@ -38,6 +59,10 @@ func (c *Controller) Start() error {
 		}
 	}
 
+	if out, err := c.runPsmux("-V"); err == nil {
+		c.version = ParseVersion(out)
+	}
+
 	if err := c.RefreshLayout(); err != nil {
 		return fmt.Errorf("failed to get initial layout: %w", err)
 	}
@@ -45,6 +70,69 @@ func (c *Controller) Start() error {
 	return nil
 }
 
+// listWindows lists the windows of the session, in WindowFormat if psmux
+// supports it.
+func (c *Controller) listWindows(layout *Layout) ([]Window, error) {
+	// rejected is set when psmux refused -F or ignored it and printed its
+	// default output. Other failures, such as a timeout, may be transient
+	// and leave -F to be tried again on the next refresh.
+	rejected := false
+	if !c.noFormat {
+		out, err := c.runPsmux("list-windows", "-t", c.sessionName, "-F", WindowFormat)
+		if err == nil {
+			windows, err := ParseFormattedWindows(out)
+			if len(windows) > 0 {
+				return windows, layout.tolerate(err)
+			}
+			rejected = true
+		} else {
+			rejected = isUsageError(err)
+		}
+	}
+
+	out, err := c.runPsmux("list-windows", "-t", c.sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list windows: %w", err)
+	}
+	windows, err := ParseWindows(out)
+	if err := layout.tolerate(err); err != nil {
+		return nil, fmt.Errorf("failed to parse windows: %w", err)
+	}
+	if rejected {
+		c.logger.Debug("psmux does not support list-windows -F, parsing its default output")
+		c.noFormat = true
+	}
+	return windows, nil
+}
+
+// isUsageError reports whether err is psmux exiting because it did not
+// understand its arguments.
+func isUsageError(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	stderr := strings.ToLower(string(exitErr.Stderr))
+	for _, s := range []string{"unknown option", "unknown flag", "invalid option", "usage"} {
+		if strings.Contains(stderr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ping checks that psmux responds.
+func (c *Controller) Ping() error {
+	_, err := c.runPsmux("-V")
+	return err
+}
+
+// HasSession checks that the session of the controller exists.
+func (c *Controller) HasSession() error {
+	_, err := c.runPsmux("has-session", "-t", c.sessionName)
+	return err
+}
+
 func (c *Controller) Stop() error {
 	close(c.closeChan)
 	return nil
@@ -60,11 +148,23 @@ func (c *Controller) GetLayout() *Layout {
 	return c.layoutCache
 }
 
+// RefreshLayout reads the layout from psmux, unless it was read less than
+// minInterval ago.
 func (c *Controller) RefreshLayout() error {
+	return c.refreshLayout(false)
+}
+
+// ForceRefreshLayout reads the layout from psmux regardless of when it was
+// last read, so that it reflects a change that was just made.
+func (c *Controller) ForceRefreshLayout() error {
+	return c.refreshLayout(true)
+}
+
+func (c *Controller) refreshLayout(force bool) error {
 	c.refreshMu.Lock()
 	defer c.refreshMu.Unlock()
 
-	if !c.lastRefresh.IsZero() && time.Since(c.lastRefresh) < c.minInterval {
+	if !force && !c.lastRefresh.IsZero() && time.Since(c.lastRefresh) < c.minInterval {
 		return nil
 	}
 
@@ -73,13 +173,14 @@ func (c *Controller) RefreshLayout() error {
 		return fmt.Errorf("failed to list sessions: %w", err)
 	}
 
-	sessions, err := ParseSessions(sessionsOut)
-	if err != nil {
-		return fmt.Errorf("failed to parse sessions: %w", err)
-	}
-
 	layout := &Layout{
 		SessionName: c.sessionName,
+		Version:     c.version,
+	}
+
+	sessions, err := ParseSessions(sessionsOut)
+	if err := layout.tolerate(err); err != nil {
+		return fmt.Errorf("failed to parse sessions: %w", err)
 	}
 
 	for i := range sessions {
@@ -90,14 +191,9 @@ func (c *Controller) RefreshLayout() error {
 	}
 	layout.Sessions = sessions
 
-	windowsOut, err := c.runPsmux("list-windows", "-t", c.sessionName)
+	windows, err := c.listWindows(layout)
 	if err != nil {
-		return fmt.Errorf("failed to list windows: %w", err)
-	}
-
-	windows, err := ParseWindows(windowsOut)
-	if err != nil {
-		return fmt.Errorf("failed to parse windows: %w", err)
+		return err
 	}
 
 	for i := range windows {
@@ -113,12 +209,16 @@ func (c *Controller) RefreshLayout() error {
 		}
 
 		panes, err := ParsePanes(panesOut)
-		if err != nil {
+		if err := layout.tolerate(err); err != nil {
 			continue
 		}
 
-		if win.Active && len(panes) > 0 {
-			layout.ActivePaneID = panes[0].ID
+		if win.Active {
+			for _, pane := range panes {
+				if pane.Active {
+					layout.ActivePaneID = pane.ID
+				}
+			}
 		}
 
 		win.Panes = panes
@@ -126,6 +226,10 @@ func (c *Controller) RefreshLayout() error {
 
 	layout.Windows = windows
 
+	if len(layout.Unparsed) > 0 {
+		c.logger.Debug("Skipped unexpected psmux output", "lines", layout.Unparsed)
+	}
+
 	c.layoutMu.Lock()
 	c.layoutCache = layout
 	c.layoutMu.Unlock()
@@ -134,6 +238,17 @@ func (c *Controller) RefreshLayout() error {
 	return nil
 }
 
+// tolerate records the lines a parser skipped on the layout, so a single
+// unexpected line does not fail the whole refresh. Other errors are returned.
+func (l *Layout) tolerate(err error) error {
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		l.Unparsed = append(l.Unparsed, perr.Lines...)
+		return nil
+	}
+	return err
+}
+
 func (c *Controller) SelectPane(paneID string) error {
 	_, err := c.runPsmux("select-pane", "-t", paneID)
 	if err != nil {
@@ -163,11 +278,17 @@ func (c *Controller) SwitchSession(sessionName string) error {
 }
 
 func (c *Controller) SplitPane(horizontal bool) error {
+	return c.SplitPaneAt(c.sessionName, horizontal)
+}
+
+// SplitPaneAt splits the pane identified by target, which may be a pane ID
+// or any other psmux target such as a session name.
+func (c *Controller) SplitPaneAt(target string, horizontal bool) error {
 	flag := "-v"
 	if horizontal {
 		flag = "-h"
 	}
-	_, err := c.runPsmux("split-window", "-t", c.sessionName, flag)
+	_, err := c.runPsmux("split-window", "-t", target, flag)
 	if err != nil {
 		return err
 	}
@@ -175,6 +296,31 @@ func (c *Controller) SplitPane(horizontal bool) error {
 	return nil
 }
 
+func (c *Controller) ZoomPane(paneID string) error {
+	_, err := c.runPsmux("resize-pane", "-Z", "-t", paneID)
+	if err != nil {
+		return err
+	}
+	c.RefreshLayout()
+	return nil
+}
+
+// SendKeys sends keys to a pane. With literal set, keys are typed as-is
+// instead of being looked up as key names such as "Enter" or "C-c".
+func (c *Controller) SendKeys(paneID string, literal bool, keys ...string) error {
+	args := []string{"send-keys", "-t", paneID}
+	if literal {
+		args = append(args, "-l")
+	}
+	_, err := c.runPsmux(append(args, keys...)...)
+	return err
+}
+
+// CapturePane returns the visible contents of a pane as plain text.
+func (c *Controller) CapturePane(paneID string) (string, error) {
+	return c.runPsmux("capture-pane", "-p", "-t", paneID)
+}
+
 func (c *Controller) ClosePane(paneID string) error {
 	_, err := c.runPsmux("kill-pane", "-t", paneID)
 	if err != nil {
@@ -185,7 +331,33 @@ func (c *Controller) ClosePane(paneID string) error {
 }
 
 func (c *Controller) NewWindow() error {
-	_, err := c.runPsmux("new-window", "-t", c.sessionName)
+	return c.NewNamedWindow("")
+}
+
+func (c *Controller) NewNamedWindow(name string) error {
+	args := []string{"new-window", "-t", c.sessionName}
+	if name != "" {
+		args = append(args, "-n", name)
+	}
+	_, err := c.runPsmux(args...)
+	if err != nil {
+		return err
+	}
+	c.RefreshLayout()
+	return nil
+}
+
+func (c *Controller) RenameWindow(windowID string, name string) error {
+	_, err := c.runPsmux("rename-window", "-t", windowID, name)
+	if err != nil {
+		return err
+	}
+	c.RefreshLayout()
+	return nil
+}
+
+func (c *Controller) KillWindow(windowID string) error {
+	_, err := c.runPsmux("kill-window", "-t", windowID)
 	if err != nil {
 		return err
 	}
@@ -195,7 +367,13 @@ func (c *Controller) NewWindow() error {
 
 func (c *Controller) runPsmux(args ...string) (string, error) {
 	cmd := exec.Command("psmux", args...)
+	started := time.Now()
 	output, err := cmd.Output()
+	duration := time.Since(started)
+	c.logger.Debug("Ran psmux", "args", args, "duration", duration, "error", err)
+	if c.observe != nil && len(args) > 0 {
+		c.observe(args[0], duration, err)
+	}
 	if err != nil {
 		return "", fmt.Errorf("psmux command failed (%s): %w", strings.Join(args, " "), err)
 	}
@@ -0,0 +1,113 @@
+package psmux
+
+// Event types produced by Diff.
+const (
+	EventSessionAdded    = "session-added"
+	EventSessionClosed   = "session-closed"
+	EventSessionSwitched = "session-switched"
+	EventWindowAdded     = "window-added"
+	EventWindowClosed    = "window-closed"
+	EventWindowRenamed   = "window-renamed"
+	EventWindowSelected  = "window-selected"
+	EventPaneAdded       = "pane-added"
+	EventPaneClosed      = "pane-closed"
+	EventPaneSelected    = "pane-selected"
+	EventBell            = "bell"
+	EventActivity        = "activity"
+)
+
+// Diff compares two layouts and returns the events that lead from old to
+// cur. A nil old layout yields no events. When the current session changed,
+// window and pane differences are not reported since the layouts describe
+// different sessions.
+func Diff(old, cur *Layout) []Event {
+	if old == nil || cur == nil {
+		return nil
+	}
+
+	var events []Event
+
+	oldSessions := make(map[string]bool, len(old.Sessions))
+	for _, s := range old.Sessions {
+		oldSessions[s.Name] = true
+	}
+	curSessions := make(map[string]bool, len(cur.Sessions))
+	for _, s := range cur.Sessions {
+		curSessions[s.Name] = true
+		if !oldSessions[s.Name] {
+			events = append(events, Event{Type: EventSessionAdded, Payload: s.Name})
+		}
+	}
+	for _, s := range old.Sessions {
+		if !curSessions[s.Name] {
+			events = append(events, Event{Type: EventSessionClosed, Payload: s.Name})
+		}
+	}
+
+	if old.SessionName != cur.SessionName {
+		return append(events, Event{Type: EventSessionSwitched, Payload: cur.SessionName})
+	}
+
+	oldWindows := make(map[string]*Window, len(old.Windows))
+	for i := range old.Windows {
+		oldWindows[old.Windows[i].ID] = &old.Windows[i]
+	}
+	curWindows := make(map[string]bool, len(cur.Windows))
+	for i := range cur.Windows {
+		win := &cur.Windows[i]
+		curWindows[win.ID] = true
+		prev, ok := oldWindows[win.ID]
+		if !ok {
+			events = append(events, Event{Type: EventWindowAdded, Payload: win.ID})
+			for _, pane := range win.Panes {
+				events = append(events, Event{Type: EventPaneAdded, Payload: pane.ID, Window: win.ID})
+			}
+			continue
+		}
+		if prev.Name != win.Name {
+			events = append(events, Event{Type: EventWindowRenamed, Payload: win.ID})
+		}
+		if win.Bell && !prev.Bell {
+			events = append(events, Event{Type: EventBell, Payload: win.ID})
+		}
+		if win.Activity && !prev.Activity {
+			events = append(events, Event{Type: EventActivity, Payload: win.ID})
+		}
+		events = append(events, diffPanes(prev, win)...)
+	}
+	for _, win := range old.Windows {
+		if !curWindows[win.ID] {
+			events = append(events, Event{Type: EventWindowClosed, Payload: win.ID})
+		}
+	}
+
+	if cur.ActiveWinID != old.ActiveWinID && cur.ActiveWinID != "" {
+		events = append(events, Event{Type: EventWindowSelected, Payload: cur.ActiveWinID})
+	}
+	if cur.ActivePaneID != old.ActivePaneID && cur.ActivePaneID != "" {
+		events = append(events, Event{Type: EventPaneSelected, Payload: cur.ActivePaneID, Window: cur.ActiveWinID})
+	}
+
+	return events
+}
+
+func diffPanes(old, cur *Window) []Event {
+	var events []Event
+	oldPanes := make(map[string]bool, len(old.Panes))
+	for _, pane := range old.Panes {
+		oldPanes[pane.ID] = true
+	}
+	curPanes := make(map[string]bool, len(cur.Panes))
+	for _, pane := range cur.Panes {
+		curPanes[pane.ID] = true
+		if !oldPanes[pane.ID] {
+			events = append(events, Event{Type: EventPaneAdded, Payload: pane.ID, Window: cur.ID})
+		}
+	}
+	for _, pane := range old.Panes {
+		if !curPanes[pane.ID] {
+			events = append(events, Event{Type: EventPaneClosed, Payload: pane.ID, Window: cur.ID})
+		}
+	}
+	return events
+}
@@ -0,0 +1,59 @@
+package psmux
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Layout{
+		SessionName:  "main",
+		Sessions:     []Session{{Name: "main"}, {Name: "build"}},
+		ActiveWinID:  "@0",
+		ActivePaneID: "%0",
+		Windows: []Window{
+			{ID: "@0", Name: "pwsh", Panes: []Pane{{ID: "%0"}, {ID: "%1"}}},
+			{ID: "@1", Name: "logs", Panes: []Pane{{ID: "%2"}}},
+		},
+	}
+	cur := &Layout{
+		SessionName:  "main",
+		Sessions:     []Session{{Name: "main"}, {Name: "ci"}},
+		ActiveWinID:  "@0",
+		ActivePaneID: "%3",
+		Windows: []Window{
+			{ID: "@0", Name: "pwsh", Bell: true, Panes: []Pane{{ID: "%0"}, {ID: "%3"}}},
+			{ID: "@2", Name: "vim", Panes: []Pane{{ID: "%4"}}},
+		},
+	}
+
+	expected := []Event{
+		{Type: EventSessionAdded, Payload: "ci"},
+		{Type: EventSessionClosed, Payload: "build"},
+		{Type: EventBell, Payload: "@0"},
+		{Type: EventPaneAdded, Payload: "%3", Window: "@0"},
+		{Type: EventPaneClosed, Payload: "%1", Window: "@0"},
+		{Type: EventWindowAdded, Payload: "@2"},
+		{Type: EventPaneAdded, Payload: "%4", Window: "@2"},
+		{Type: EventWindowClosed, Payload: "@1"},
+		{Type: EventPaneSelected, Payload: "%3", Window: "@0"},
+	}
+	if got := Diff(old, cur); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected events:\n got %+v\nwant %+v", got, expected)
+	}
+}
+
+func TestDiff_SessionSwitch(t *testing.T) {
+	old := &Layout{SessionName: "main", Sessions: []Session{{Name: "main"}, {Name: "ci"}},
+		Windows: []Window{{ID: "@0"}}}
+	cur := &Layout{SessionName: "ci", Sessions: []Session{{Name: "main"}, {Name: "ci"}},
+		Windows: []Window{{ID: "@5"}}}
+
+	expected := []Event{{Type: EventSessionSwitched, Payload: "ci"}}
+	if got := Diff(old, cur); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected events: %+v", got)
+	}
+	if got := Diff(nil, cur); got != nil {
+		t.Errorf("expected no events without a previous layout, got %+v", got)
+	}
+}
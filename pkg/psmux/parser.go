@@ -7,79 +7,204 @@ import (
 	"strings"
 )
 
+// The line formats below are deliberately loose. psmux has changed its
+// list output between releases (session groups, tmux-style window flags,
+// trailing layout strings and IDs), so each regex only anchors on the parts
+// every known version prints and the optional annotations are picked out of
+// the remainder separately. See testdata/ for recorded outputs.
 var (
-	sessionRegex = regexp.MustCompile(`^(\S+): (\d+) windows \(created [^)]+\) \[(\d+)x(\d+)\](?: \(attached\))?$`)
-	windowRegex  = regexp.MustCompile(`^(\d+): (\S+?)(\*)? \((\d+) panes?\) \[(\d+)x(\d+)\]$`)
-	paneRegex    = regexp.MustCompile(`^(%\d+): \[(\d+)x(\d+)\]`)
+	sessionRegex = regexp.MustCompile(`^(.+?): (\d+) windows? \(created [^)]*\)(.*)$`)
+	windowRegex  = regexp.MustCompile(`^(\d+): (.*) \((\d+) panes?\) \[(\d+)x(\d+)\](.*)$`)
+	paneRegex    = regexp.MustCompile(`^(%\d+|\d+): \[(\d+)x(\d+)\](.*)$`)
+
+	groupRegex    = regexp.MustCompile(`\(group ([^)]*)\)`)
+	windowIDRegex = regexp.MustCompile(`(?:^|\s)(@\d+)(?:\s|$)`)
+	paneIDRegex   = regexp.MustCompile(`(?:^|\s)(%\d+)(?:\s|$)`)
+	versionRegex  = regexp.MustCompile(`(\d+(?:\.\d+)+[0-9A-Za-z.+-]*)`)
+	// windowFlagsRegex matches the window flags tmux appends to the name,
+	// in the order tmux prints them.
+	windowFlagsRegex = regexp.MustCompile(`#?!?~?\*?-?M?Z?$`)
 )
 
+// WindowFormat is the list-windows -F format ParseFormattedWindows reads.
+// The name comes last, so that it may contain anything but a newline.
+const WindowFormat = "#{window_index}\t#{window_id}\t#{window_flags}\t#{window_name}"
+
+// ParseError reports lines of psmux output that did not match any known
+// format. Parsers return it together with everything they could parse, so
+// callers may keep the partial result.
+type ParseError struct {
+	Kind  string
+	Lines []string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse %d %s line(s): %s", len(e.Lines), e.Kind, strings.Join(e.Lines, " | "))
+}
+
+// ParseVersion extracts the version number from `psmux -V` output.
+func ParseVersion(output string) string {
+	return versionRegex.FindString(strings.TrimSpace(output))
+}
+
 func ParseSessions(output string) ([]Session, error) {
 	var sessions []Session
-	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	var unparsed []string
+	for _, line := range outputLines(output) {
 		matches := sessionRegex.FindStringSubmatch(line)
 		if matches == nil {
-			return nil, fmt.Errorf("failed to parse session line: %s", line)
+			unparsed = append(unparsed, line)
+			continue
 		}
 		winCount, _ := strconv.Atoi(matches[2])
-		attached := strings.Contains(line, "(attached)")
-		sessions = append(sessions, Session{
+		rest := matches[3]
+		session := Session{
 			ID:       matches[1],
 			Name:     matches[1],
 			Windows:  winCount,
-			Attached: attached,
-		})
+			Attached: strings.Contains(rest, "(attached)"),
+		}
+		if group := groupRegex.FindStringSubmatch(rest); group != nil {
+			// tmux 3.x prints "(group name: member,member)"
+			session.Group = strings.TrimSpace(strings.SplitN(group[1], ":", 2)[0])
+		}
+		sessions = append(sessions, session)
 	}
-	return sessions, nil
+	return sessions, parseError("session", unparsed)
 }
 
+// ParseWindows parses the default list-windows output. The flags are glued
+// to the window name there, so a name that ends in flag characters cannot
+// always be told apart from flags: trailing M and Z only count as flags
+// after another flag, and psmux releases that support -F are queried with
+// WindowFormat instead.
 func ParseWindows(output string) ([]Window, error) {
 	var windows []Window
-	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	var unparsed []string
+	for _, line := range outputLines(output) {
 		matches := windowRegex.FindStringSubmatch(line)
 		if matches == nil {
-			return nil, fmt.Errorf("failed to parse window line: %s", line)
+			unparsed = append(unparsed, line)
+			continue
 		}
 		idx, _ := strconv.Atoi(matches[1])
-		active := matches[3] == "*"
-		name := matches[2]
-		windows = append(windows, Window{
-			ID:     fmt.Sprintf("@%d", idx),
-			Name:   name,
-			Index:  idx,
-			Active: active,
-		})
+		name, flags := splitWindowFlags(matches[2])
+		rest := matches[6]
+		window := newWindow(idx, name, flags)
+		window.Active = window.Active || strings.Contains(rest, "(active)")
+		if id := windowIDRegex.FindStringSubmatch(rest); id != nil {
+			window.ID = id[1]
+		}
+		windows = append(windows, window)
 	}
-	return windows, nil
+	return windows, parseError("window", unparsed)
 }
 
-func ParsePanes(output string) ([]Pane, error) {
-	var panes []Pane
-	for i, line := range strings.Split(strings.TrimSpace(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
+// ParseFormattedWindows parses list-windows output in WindowFormat.
+func ParseFormattedWindows(output string) ([]Window, error) {
+	var windows []Window
+	var unparsed []string
+	for _, line := range outputLines(output) {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 || strings.Contains(line, "#{") {
+			unparsed = append(unparsed, line)
+			continue
+		}
+		idx, err := strconv.Atoi(fields[0])
+		if err != nil {
+			unparsed = append(unparsed, line)
 			continue
 		}
+		window := newWindow(idx, fields[3], fields[2])
+		if strings.HasPrefix(fields[1], "@") {
+			window.ID = fields[1]
+		}
+		windows = append(windows, window)
+	}
+	return windows, parseError("window", unparsed)
+}
+
+// splitWindowFlags splits the flags tmux appends off a window name.
+func splitWindowFlags(s string) (name, flags string) {
+	flags = windowFlagsRegex.FindString(s)
+	// tmux prints M and Z after the other flags. Without one of those
+	// before them they are taken to end the name, as "VIM" is more likely
+	// than a marked window "VI".
+	flags = strings.TrimLeft(flags, "MZ")
+	return s[:len(s)-len(flags)], flags
+}
+
+func newWindow(idx int, name, flags string) Window {
+	return Window{
+		ID:       fmt.Sprintf("@%d", idx),
+		Name:     name,
+		Index:    idx,
+		Active:   strings.Contains(flags, "*"),
+		Last:     strings.Contains(flags, "-"),
+		Zoomed:   strings.Contains(flags, "Z"),
+		Activity: strings.Contains(flags, "#"),
+		Bell:     strings.Contains(flags, "!"),
+	}
+}
+
+func ParsePanes(output string) ([]Pane, error) {
+	var panes []Pane
+	var unparsed []string
+	explicitActive := false
+	for _, line := range outputLines(output) {
 		matches := paneRegex.FindStringSubmatch(line)
 		if matches == nil {
-			return nil, fmt.Errorf("failed to parse pane line: %s", line)
+			unparsed = append(unparsed, line)
+			continue
 		}
 		width, _ := strconv.Atoi(matches[2])
 		height, _ := strconv.Atoi(matches[3])
-		panes = append(panes, Pane{
-			ID:     matches[1],
-			Index:  i,
-			Active: i == 0,
+		rest := matches[4]
+		pane := Pane{
+			Index:  len(panes),
 			Width:  width,
 			Height: height,
-		})
+		}
+		if strings.HasPrefix(matches[1], "%") {
+			// legacy format: "%2: [140x19] mouse=... alt=..."
+			pane.ID = matches[1]
+		} else {
+			// tmux format: "0: [140x19] [history ...] %2 (active)"
+			pane.Index, _ = strconv.Atoi(matches[1])
+			id := paneIDRegex.FindStringSubmatch(rest)
+			if id == nil {
+				unparsed = append(unparsed, line)
+				continue
+			}
+			pane.ID = id[1]
+		}
+		if strings.Contains(rest, "(active)") {
+			pane.Active = true
+			explicitActive = true
+		}
+		panes = append(panes, pane)
+	}
+	// Older releases do not mark the active pane; they list it first.
+	if !explicitActive && len(panes) > 0 {
+		panes[0].Active = true
+	}
+	return panes, parseError("pane", unparsed)
+}
+
+func outputLines(output string) []string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseError(kind string, unparsed []string) error {
+	if len(unparsed) == 0 {
+		return nil
 	}
-	return panes, nil
+	return &ParseError{Kind: kind, Lines: unparsed}
 }
@@ -1,9 +1,17 @@
 package psmux
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "rewrite testdata/*/expected.json from the parsers' output")
+
 func TestParseSessions_Single(t *testing.T) {
 	output := `default: 1 windows (created Sat Feb 14 11:06:12 2026) [140x20] (attached)`
 	sessions, err := ParseSessions(output)
@@ -89,6 +97,62 @@ func TestParseWindows_Multiple(t *testing.T) {
 	}
 }
 
+func TestParseWindows_NamesEndingInFlagCharacters(t *testing.T) {
+	output := `0: VIM (1 panes) [140x20]
+1: ZZ (1 panes) [140x20]
+2: pwsh*Z (2 panes) [140x20]
+3: MAKE-M (1 panes) [140x20]`
+	windows, err := ParseWindows(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Window{
+		{ID: "@0", Name: "VIM", Index: 0},
+		{ID: "@1", Name: "ZZ", Index: 1},
+		{ID: "@2", Name: "pwsh", Index: 2, Active: true, Zoomed: true},
+		{ID: "@3", Name: "MAKE", Index: 3, Last: true},
+	}
+	for i, w := range windows {
+		if w.ID != expected[i].ID || w.Name != expected[i].Name || w.Active != expected[i].Active ||
+			w.Last != expected[i].Last || w.Zoomed != expected[i].Zoomed {
+			t.Errorf("window %d: expected %+v, got %+v", i, expected[i], w)
+		}
+	}
+}
+
+func TestParseFormattedWindows(t *testing.T) {
+	output := "0\t@0\t\tVIM\n" +
+		"1\t@4\t*Z\tZZ\n" +
+		"2\t@5\t-\tbuild-\n" +
+		"3\t@6\t#\tnotes*\n" +
+		"4\t@7\t\tdeploy: prod\t(eu)"
+	windows, err := ParseFormattedWindows(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Window{
+		{ID: "@0", Name: "VIM", Index: 0},
+		{ID: "@4", Name: "ZZ", Index: 1, Active: true, Zoomed: true},
+		{ID: "@5", Name: "build-", Index: 2, Last: true},
+		{ID: "@6", Name: "notes*", Index: 3, Activity: true},
+		{ID: "@7", Name: "deploy: prod\t(eu)", Index: 4},
+	}
+	if len(windows) != len(expected) {
+		t.Fatalf("expected %d windows, got %d", len(expected), len(windows))
+	}
+	for i, w := range windows {
+		w.Panes = nil
+		if !reflect.DeepEqual(w, expected[i]) {
+			t.Errorf("window %d: expected %+v, got %+v", i, expected[i], w)
+		}
+	}
+
+	// psmux releases without -F print the format unexpanded.
+	if _, err := ParseFormattedWindows("#{window_index}\t#{window_id}\t#{window_flags}\t#{window_name}"); err == nil {
+		t.Error("expected an unexpanded format to be rejected")
+	}
+}
+
 func TestParsePanes_Single(t *testing.T) {
 	output := `%2: [140x19] mouse=None/Default alt=false`
 	panes, err := ParsePanes(output)
@@ -163,3 +227,218 @@ func TestParsePanes_InvalidLine(t *testing.T) {
 		t.Error("expected error for invalid input")
 	}
 }
+
+func TestParseWindows_NamesAndFlags(t *testing.T) {
+	output := `0: my build- (1 pane) [160x40]
+1: pwsh*Z (3 panes) [160x40]
+2: deploy: prod# (1 panes) [200x50] [layout b25f,200x50,0,0,2] @7 (active)`
+	windows, err := ParseWindows(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 windows, got %d", len(windows))
+	}
+	if windows[0].Name != "my build" || !windows[0].Last || windows[0].Active {
+		t.Errorf("unexpected first window: %+v", windows[0])
+	}
+	if windows[1].Name != "pwsh" || !windows[1].Active || !windows[1].Zoomed {
+		t.Errorf("unexpected second window: %+v", windows[1])
+	}
+	if windows[2].Name != "deploy: prod" || windows[2].ID != "@7" || !windows[2].Active || !windows[2].Activity {
+		t.Errorf("unexpected third window: %+v", windows[2])
+	}
+}
+
+func TestParseSessions_Group(t *testing.T) {
+	output := `main: 2 windows (created Tue Apr 14 08:00:00 2026) (group main: main,main-1) (attached)
+ci:nightly: 1 window (created Mon Mar  2 10:00:00 2026) [80x24]`
+	sessions, err := ParseSessions(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	if sessions[0].Group != "main" || !sessions[0].Attached {
+		t.Errorf("unexpected first session: %+v", sessions[0])
+	}
+	if sessions[1].Name != "ci:nightly" || sessions[1].Windows != 1 {
+		t.Errorf("unexpected second session: %+v", sessions[1])
+	}
+}
+
+func TestParsePanes_ActiveMarker(t *testing.T) {
+	output := `0: [100x50] [history 120/2000, 18432 bytes] %0
+1: [99x50] [history 0/2000, 0 bytes] %1 (active)`
+	panes, err := ParsePanes(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(panes) != 2 {
+		t.Fatalf("expected 2 panes, got %d", len(panes))
+	}
+	if panes[0].Active || !panes[1].Active {
+		t.Errorf("expected only the second pane active: %+v", panes)
+	}
+	if panes[1].ID != "%1" || panes[1].Index != 1 {
+		t.Errorf("unexpected second pane: %+v", panes[1])
+	}
+}
+
+func TestParseWindows_PartialResult(t *testing.T) {
+	output := `0: pwsh* (1 panes) [140x20]
+warning: something unexpected
+1: vim (2 panes) [140x20]`
+	windows, err := ParseWindows(output)
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected *ParseError, got %v", err)
+	}
+	if len(perr.Lines) != 1 || perr.Lines[0] != "warning: something unexpected" {
+		t.Errorf("unexpected unparsed lines: %q", perr.Lines)
+	}
+	if len(windows) != 2 {
+		t.Fatalf("expected 2 windows despite the bad line, got %d", len(windows))
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for output, expected := range map[string]string{
+		"psmux 0.1.4\n":         "0.1.4",
+		"psmux version 0.2.0":   "0.2.0",
+		"psmux 0.3.2-rc1":       "0.3.2-rc1",
+		"psmux (unknown build)": "",
+	} {
+		if got := ParseVersion(output); got != expected {
+			t.Errorf("ParseVersion(%q) = %q, expected %q", output, got, expected)
+		}
+	}
+}
+
+// recording is the parsed form of one testdata/<version> directory.
+type recording struct {
+	Version  string    `json:"version"`
+	Sessions []Session `json:"sessions"`
+	Windows  []Window  `json:"windows"`
+	Panes    []Pane    `json:"panes"`
+	Unparsed []string  `json:"unparsed"`
+}
+
+// TestRecordedOutputs parses list output captured from several psmux
+// releases and compares it with expected.json. Run with -update after
+// adding a new recording.
+func TestRecordedOutputs(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "psmux-*"))
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("no recordings found: %v", err)
+	}
+
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			read := func(name string) string {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				return string(data)
+			}
+
+			layout := &Layout{}
+			rec := recording{Version: ParseVersion(read("version.txt"))}
+			rec.Sessions, err = ParseSessions(read("ls.txt"))
+			if err := layout.tolerate(err); err != nil {
+				t.Fatal(err)
+			}
+			rec.Windows, err = ParseWindows(read("list-windows.txt"))
+			if err := layout.tolerate(err); err != nil {
+				t.Fatal(err)
+			}
+			rec.Panes, err = ParsePanes(read("list-panes.txt"))
+			if err := layout.tolerate(err); err != nil {
+				t.Fatal(err)
+			}
+			rec.Unparsed = layout.Unparsed
+
+			got, _ := json.MarshalIndent(rec, "", "  ")
+			golden := filepath.Join(dir, "expected.json")
+			if *update {
+				if err := os.WriteFile(golden, append(got, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var want recording
+			data := read("expected.json")
+			if err := json.Unmarshal([]byte(data), &want); err != nil {
+				t.Fatalf("failed to decode expected.json: %v", err)
+			}
+			var have recording
+			json.Unmarshal(got, &have)
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("parsed output differs from expected.json:\n%s", got)
+			}
+		})
+	}
+}
+
+func FuzzParseSessions(f *testing.F) {
+	addRecordings(f, "ls.txt")
+	f.Fuzz(func(t *testing.T, output string) {
+		sessions, err := ParseSessions(output)
+		checkAccounting(t, output, len(sessions), err)
+	})
+}
+
+func FuzzParseWindows(f *testing.F) {
+	addRecordings(f, "list-windows.txt")
+	f.Fuzz(func(t *testing.T, output string) {
+		windows, err := ParseWindows(output)
+		checkAccounting(t, output, len(windows), err)
+	})
+}
+
+func FuzzParsePanes(f *testing.F) {
+	addRecordings(f, "list-panes.txt")
+	f.Fuzz(func(t *testing.T, output string) {
+		panes, err := ParsePanes(output)
+		checkAccounting(t, output, len(panes), err)
+		active := 0
+		for _, p := range panes {
+			if p.Active {
+				active++
+			}
+		}
+		if len(panes) > 0 && active == 0 {
+			t.Errorf("no active pane in %q", output)
+		}
+	})
+}
+
+func addRecordings(f *testing.F, name string) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "psmux-*", name))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(data))
+	}
+}
+
+// checkAccounting verifies that every non-blank line ends up either parsed
+// or reported in the ParseError, and that no other error type escapes.
+func checkAccounting(t *testing.T, output string, parsed int, err error) {
+	unparsed := 0
+	if err != nil {
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("unexpected error type %T: %v", err, err)
+		}
+		unparsed = len(perr.Lines)
+	}
+	if lines := len(outputLines(output)); parsed+unparsed != lines {
+		t.Errorf("%d parsed + %d unparsed != %d lines for %q", parsed, unparsed, lines, output)
+	}
+}
@@ -6,6 +6,7 @@ type Session struct {
 	Windows  int    `json:"windows"`
 	Attached bool   `json:"attached"`
 	Active   bool   `json:"active"`
+	Group    string `json:"group,omitempty"`
 }
 
 type Layout struct {
@@ -15,14 +16,53 @@ type Layout struct {
 	Windows      []Window  `json:"windows"`
 	ActiveWinID  string    `json:"activeWindowId"`
 	ActivePaneID string    `json:"activePaneId"`
+	Version      string    `json:"version,omitempty"`
+	// Unparsed holds psmux output lines the parsers did not recognise.
+	Unparsed []string `json:"unparsed,omitempty"`
+}
+
+// FindSession returns the session with the given name, or nil.
+func (l *Layout) FindSession(name string) *Session {
+	for i := range l.Sessions {
+		if l.Sessions[i].Name == name {
+			return &l.Sessions[i]
+		}
+	}
+	return nil
+}
+
+// FindWindow returns the window with the given ID, or nil.
+func (l *Layout) FindWindow(id string) *Window {
+	for i := range l.Windows {
+		if l.Windows[i].ID == id {
+			return &l.Windows[i]
+		}
+	}
+	return nil
+}
+
+// FindPane returns the pane with the given ID in any window, or nil.
+func (l *Layout) FindPane(id string) *Pane {
+	for i := range l.Windows {
+		for j := range l.Windows[i].Panes {
+			if l.Windows[i].Panes[j].ID == id {
+				return &l.Windows[i].Panes[j]
+			}
+		}
+	}
+	return nil
 }
 
 type Window struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Index  int    `json:"index"`
-	Active bool   `json:"active"`
-	Panes  []Pane `json:"panes"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Index    int    `json:"index"`
+	Active   bool   `json:"active"`
+	Last     bool   `json:"last"`
+	Zoomed   bool   `json:"zoomed"`
+	Activity bool   `json:"activity"`
+	Bell     bool   `json:"bell"`
+	Panes    []Pane `json:"panes"`
 }
 
 type Pane struct {
@@ -43,6 +83,10 @@ type ModeState struct {
 }
 
 type Event struct {
-	Type    string
-	Payload string
+	Type string `json:"type"`
+	// Payload identifies the affected object: a session name,
+	// window ID or pane ID depending on Type.
+	Payload string `json:"payload"`
+	// Window is the window a pane event belongs to.
+	Window string `json:"window,omitempty"`
 }
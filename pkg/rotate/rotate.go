@@ -0,0 +1,141 @@
+// Package rotate provides files that are moved aside once they reach a
+// size or age limit, for logs that grow without bound otherwise.
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// suffix is appended to the path of rotated files. It sorts in the order
+// the files were written.
+const suffix = "20060102T150405.000000000"
+
+// File appends to a file and moves it aside, to the path followed by the
+// time of rotation, once it reaches its size or age limit. It is safe for
+// concurrent use.
+type File struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+}
+
+// Open opens the file at path for appending, creating it and its directory
+// if needed. The file is rotated before a write that would take it beyond
+// maxSize bytes, or once maxAge passed since its first write; zero disables
+// either limit. started is when an existing file was first written to; if
+// zero, its modification time is taken instead.
+func Open(path string, maxSize int64, maxAge time.Duration, started time.Time) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f := &File{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	if f.size > 0 {
+		if started.IsZero() {
+			info, err := f.file.Stat()
+			if err != nil {
+				f.file.Close()
+				return nil, err
+			}
+			started = info.ModTime()
+		}
+		f.started = started
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would not fit. A single write is
+// never split across files.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.size > 0 {
+		full := f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize
+		old := f.maxAge > 0 && now.Sub(f.started) >= f.maxAge
+		if full || old {
+			if err := f.rotate(now); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if f.size == 0 {
+		f.started = now
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, rotatedPath(f.path, now)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// MoveAside moves the file at path aside as if it was rotated now, and
+// returns where to.
+func MoveAside(path string) (string, error) {
+	rotated := rotatedPath(path, time.Now())
+	return rotated, os.Rename(path, rotated)
+}
+
+func rotatedPath(path string, now time.Time) string {
+	return path + "." + now.UTC().Format(suffix)
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// Files returns the rotated files of path, oldest first, followed by path
+// itself if it exists.
+func Files(path string) ([]string, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, file := range rotated {
+		if _, err := time.Parse(suffix, file[len(path)+1:]); err == nil {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
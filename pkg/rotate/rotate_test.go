@@ -0,0 +1,136 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contents returns the contents of the files of path, oldest first.
+func contents(t *testing.T, path string) []string {
+	t.Helper()
+	files, err := Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []string{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, string(content))
+	}
+	return data
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "app.log")
+	f, err := Open(path, 10, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "a line longer than the limit\n", "dd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := strings.Join(contents(t, path), "|")
+	if expected := "aaaa\nbbbb\n|cccc\n|a line longer than the limit\n|dd\n"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := Open(path, 0, 50*time.Millisecond, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("old\n"))
+	f.Write([]byte("still young\n"))
+	time.Sleep(60 * time.Millisecond)
+	f.Write([]byte("new\n"))
+
+	got := strings.Join(contents(t, path), "|")
+	if expected := "old\nstill young\n|new\n"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestFilesOrder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	now := time.Now()
+	for i, name := range []string{
+		rotatedPath(path, now.Add(-time.Hour)),
+		rotatedPath(path, now.Add(-2*time.Hour)),
+		rotatedPath(path, now.Add(-time.Minute)),
+		path,
+		path + ".bak",
+		filepath.Join(dir, "other.log"),
+	} {
+		os.WriteFile(name, []byte{byte('0' + i)}, 0600)
+	}
+
+	files, err := Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		rotatedPath(path, now.Add(-2*time.Hour)),
+		rotatedPath(path, now.Add(-time.Hour)),
+		rotatedPath(path, now.Add(-time.Minute)),
+		path,
+	}
+	if strings.Join(files, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+
+	os.Remove(path)
+	if files, _ := Files(path); len(files) != 3 {
+		t.Errorf("expected only the rotated files without the current one, got %v", files)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := Open(path, 10, time.Hour, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("aaaa\n"))
+	f.Close()
+
+	// After a restart, the size of the existing file counts towards the
+	// limit and new writes are appended to it.
+	f, err = Open(path, 10, time.Hour, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("bbbb\n"))
+	f.Write([]byte("cccc\n"))
+	f.Close()
+	got := strings.Join(contents(t, path), "|")
+	if expected := "aaaa\nbbbb\n|cccc\n"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// The age of the existing file counts as well, from started if given.
+	f, err = Open(path, 0, time.Hour, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("dddd\n"))
+	got = strings.Join(contents(t, path), "|")
+	if expected := "aaaa\nbbbb\n|cccc\n|dddd\n"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
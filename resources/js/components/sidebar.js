@@ -216,6 +216,22 @@ class WebpsmuxSidebar extends LitElement {
       opacity: 0.7;
       margin-left: 4px;
     }
+
+    .logout-btn {
+      margin-top: 12px;
+      background: none;
+      border: 1px solid #0f3460;
+      border-radius: 4px;
+      color: #888;
+      padding: 4px 8px;
+      font-size: 11px;
+      cursor: pointer;
+    }
+
+    .logout-btn:hover {
+      border-color: #e94560;
+      color: #fff;
+    }
   `;
 
   constructor() {
@@ -359,6 +375,12 @@ class WebpsmuxSidebar extends LitElement {
         Session: ${this.layout.sessionName}<br>
         ${this.layout.windows?.length || 0} windows, ${activeWindow?.panes?.length || 0} panes
       </div>
+      ${window.gotty_logout_url ? html`
+        <form method="post" action=${window.gotty_logout_url}>
+          <input type="hidden" name="csrf_token" .value=${window.gotty_csrf_token}>
+          <button type="submit" class="logout-btn">Log out</button>
+        </form>
+      ` : ''}
       </div>
     `;
   }
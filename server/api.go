@@ -0,0 +1,446 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/psmux"
+	"webpsmux/webtty"
+)
+
+// psmuxController is the set of psmux operations the server uses.
+// It is satisfied by *psmux.Controller.
+type psmuxController interface {
+	webtty.PsmuxController
+	SplitPaneAt(target string, horizontal bool) error
+	ZoomPane(paneID string) error
+	SendKeys(paneID string, literal bool, keys ...string) error
+	CapturePane(paneID string) (string, error)
+	NewNamedWindow(name string) error
+	RenameWindow(windowID string, name string) error
+	KillWindow(windowID string) error
+	ForceRefreshLayout() error
+	Ping() error
+	HasSession() error
+	Stop() error
+}
+
+// apiRoute maps a method and a path pattern below the API root to a handler.
+// Pattern segments written as "{}" match any single segment and are passed
+// to the handler in order. Requests need the role, and API tokens the scope
+// as well.
+type apiRoute struct {
+	method  string
+	pattern string
+	role    auth.Role
+	scope   auth.Scope
+	handle  func(w http.ResponseWriter, r *http.Request, args []string)
+}
+
+// maxAPIBodySize limits JSON request bodies of the API.
+const maxAPIBodySize = 1 << 20
+
+func (server *Server) apiRoutes() []apiRoute {
+	routes := []apiRoute{
+		{"GET", "layout", auth.RoleViewer, auth.ScopeLayoutRead, server.apiGetLayout},
+		{"GET", "sessions", auth.RoleViewer, auth.ScopeLayoutRead, server.apiListSessions},
+		{"POST", "sessions/{}/switch", auth.RoleAdmin, auth.ScopeAdmin, server.apiSwitchSession},
+		{"GET", "windows", auth.RoleViewer, auth.ScopeLayoutRead, server.apiListWindows},
+		{"POST", "windows", auth.RoleOperator, auth.ScopePanesWrite, server.apiNewWindow},
+		{"DELETE", "windows/{}", auth.RoleOperator, auth.ScopePanesWrite, server.apiKillWindow},
+		{"POST", "windows/{}/select", auth.RoleOperator, auth.ScopePanesWrite, server.apiSelectWindow},
+		{"POST", "windows/{}/rename", auth.RoleOperator, auth.ScopePanesWrite, server.apiRenameWindow},
+		{"GET", "panes", auth.RoleViewer, auth.ScopeLayoutRead, server.apiListPanes},
+		{"DELETE", "panes/{}", auth.RoleOperator, auth.ScopePanesWrite, server.apiClosePane},
+		{"POST", "panes/{}/select", auth.RoleOperator, auth.ScopePanesWrite, server.apiSelectPane},
+		{"POST", "panes/{}/split", auth.RoleOperator, auth.ScopePanesWrite, server.apiSplitPane},
+		{"POST", "panes/{}/zoom", auth.RoleOperator, auth.ScopePanesWrite, server.apiZoomPane},
+		{"POST", "panes/{}/keys", auth.RoleOperator, auth.ScopeInputSend, server.apiSendKeys},
+		{"GET", "panes/{}/capture", auth.RoleViewer, auth.ScopeLayoutRead, server.apiCapturePane},
+	}
+	for i := range routes {
+		routes[i].handle = server.requirePsmux(routes[i].handle)
+	}
+
+	return append(routes,
+		apiRoute{"GET", "status", auth.RoleViewer, auth.ScopeLayoutRead, server.apiStatus},
+		apiRoute{"GET", "connections", auth.RoleAdmin, auth.ScopeAdmin, server.apiListConnections},
+		apiRoute{"POST", "connections/{}/disconnect", auth.RoleAdmin, auth.ScopeAdmin, server.apiDisconnect},
+		apiRoute{"POST", "connections/{}/read-only", auth.RoleAdmin, auth.ScopeAdmin, server.apiReadOnly},
+		apiRoute{"GET", "lockouts", auth.RoleAdmin, auth.ScopeAdmin, server.apiListLockouts},
+		apiRoute{"DELETE", "lockouts", auth.RoleAdmin, auth.ScopeAdmin, server.apiClearLockouts},
+		apiRoute{"DELETE", "lockouts/{}/{}", auth.RoleAdmin, auth.ScopeAdmin, server.apiClearLockouts},
+		apiRoute{"GET", "tokens", auth.RoleViewer, auth.ScopeAdmin, server.requireTokens(server.apiListTokens)},
+		apiRoute{"POST", "tokens", auth.RoleViewer, auth.ScopeAdmin, server.requireTokens(server.apiCreateToken)},
+		apiRoute{"DELETE", "tokens/{}", auth.RoleViewer, auth.ScopeAdmin, server.requireTokens(server.apiRevokeToken)},
+		apiRoute{"GET", "shares", auth.RoleAdmin, auth.ScopeAdmin, server.requireShares(server.apiListShares)},
+		apiRoute{"POST", "shares", auth.RoleAdmin, auth.ScopeAdmin, server.requireShares(server.requirePsmux(server.apiCreateShare))},
+		apiRoute{"DELETE", "shares/{}", auth.RoleAdmin, auth.ScopeAdmin, server.requireShares(server.apiRevokeShare)},
+	)
+}
+
+// requirePsmux answers 503 instead of calling handle while no psmux
+// controller is running.
+func (server *Server) requirePsmux(handle func(http.ResponseWriter, *http.Request, []string)) func(http.ResponseWriter, *http.Request, []string) {
+	return func(w http.ResponseWriter, r *http.Request, args []string) {
+		if server.psmuxCtrl == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "psmux controller is not running")
+			return
+		}
+		handle(w, r, args)
+	}
+}
+
+// apiHandler serves the JSON control API. It expects the API root to be
+// stripped from the request path already.
+func (server *Server) apiHandler() http.Handler {
+	routes := server.apiRoutes()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !server.checkAPIRequest(w, r) {
+			return
+		}
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+		var allowed []string
+		for _, route := range routes {
+			args, ok := matchAPIPattern(route.pattern, segments)
+			if !ok {
+				continue
+			}
+			if route.method != r.Method {
+				allowed = append(allowed, route.method)
+				continue
+			}
+			identity := auth.FromContext(r.Context())
+			if isShareViewer(identity) {
+				writeAPIError(w, http.StatusForbidden, "share links do not grant API access")
+				return
+			}
+			if !identity.Allows(route.role) {
+				writeAPIError(w, http.StatusForbidden, "role %s may not %s %s", identity.Role, r.Method, r.URL.Path)
+				return
+			}
+			if !identity.HasScope(route.scope) {
+				writeAPIError(w, http.StatusForbidden, "token lacks scope %s to %s %s", route.scope, r.Method, r.URL.Path)
+				return
+			}
+			route.handle(w, r, args)
+			return
+		}
+
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, "no such endpoint: %s", r.URL.Path)
+	})
+}
+
+// checkAPIRequest rejects requests that change something if a browser sent
+// them on behalf of another site, along with any Basic Auth credentials or
+// client certificate it holds, whatever the authentication method. Bodies
+// must be JSON, which plain HTML forms cannot send.
+func (server *Server) checkAPIRequest(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if server.crossSite(r) {
+		server.logger.Warn("Rejected cross-site API request", "method", r.Method, "path", r.URL.Path,
+			"origin", r.Header.Get("Origin"), "site", r.Header.Get("Sec-Fetch-Site"), "ip", server.clientIP(r))
+		writeAPIError(w, http.StatusForbidden, "cross-site API requests are not allowed")
+		return false
+	}
+	if r.ContentLength != 0 {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			writeAPIError(w, http.StatusUnsupportedMediaType, "request bodies must be application/json")
+			return false
+		}
+	}
+	return true
+}
+
+// crossSite reports whether a browser sent r on behalf of another site,
+// going by its Origin or, without one, its Sec-Fetch-Site header.
+func (server *Server) crossSite(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		_, allowed := server.originAllowed(r, origin)
+		return !allowed
+	}
+	site := r.Header.Get("Sec-Fetch-Site")
+	return site != "" && site != "same-origin" && site != "none"
+}
+
+func matchAPIPattern(pattern string, segments []string) ([]string, bool) {
+	parts := strings.Split(pattern, "/")
+	if len(parts) != len(segments) {
+		return nil, false
+	}
+	var args []string
+	for i, part := range parts {
+		if part == "{}" {
+			if segments[i] == "" {
+				return nil, false
+			}
+			args = append(args, segments[i])
+			continue
+		}
+		if part != segments[i] {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+func (server *Server) apiGetLayout(w http.ResponseWriter, r *http.Request, args []string) {
+	writeJSON(w, http.StatusOK, server.currentLayout())
+}
+
+func (server *Server) apiListSessions(w http.ResponseWriter, r *http.Request, args []string) {
+	writeJSON(w, http.StatusOK, server.currentLayout().Sessions)
+}
+
+func (server *Server) apiListWindows(w http.ResponseWriter, r *http.Request, args []string) {
+	writeJSON(w, http.StatusOK, server.currentLayout().Windows)
+}
+
+func (server *Server) apiListPanes(w http.ResponseWriter, r *http.Request, args []string) {
+	panes := []psmux.Pane{}
+	for _, win := range server.currentLayout().Windows {
+		panes = append(panes, win.Panes...)
+	}
+	writeJSON(w, http.StatusOK, panes)
+}
+
+func (server *Server) apiSwitchSession(w http.ResponseWriter, r *http.Request, args []string) {
+	name := args[0]
+	if server.currentLayout().FindSession(name) == nil {
+		writeAPIError(w, http.StatusNotFound, "session %s not found", name)
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).SwitchSession(name))
+}
+
+func (server *Server) apiNewWindow(w http.ResponseWriter, r *http.Request, args []string) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	server.apiAction(w, http.StatusCreated, server.controller(r).NewNamedWindow(req.Name))
+}
+
+func (server *Server) apiKillWindow(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupWindow(w, args[0])
+	if !ok {
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).KillWindow(id))
+}
+
+func (server *Server) apiSelectWindow(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupWindow(w, args[0])
+	if !ok {
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).SelectWindow(id))
+}
+
+func (server *Server) apiRenameWindow(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupWindow(w, args[0])
+	if !ok {
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).RenameWindow(id, req.Name))
+}
+
+func (server *Server) apiClosePane(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupPane(w, args[0])
+	if !ok {
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).ClosePane(id))
+}
+
+func (server *Server) apiSelectPane(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupPane(w, args[0])
+	if !ok {
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).SelectPane(id))
+}
+
+func (server *Server) apiSplitPane(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupPane(w, args[0])
+	if !ok {
+		return
+	}
+	var req struct {
+		Horizontal bool `json:"horizontal"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	server.apiAction(w, http.StatusCreated, server.controller(r).SplitPaneAt(id, req.Horizontal))
+}
+
+func (server *Server) apiZoomPane(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupPane(w, args[0])
+	if !ok {
+		return
+	}
+	server.apiAction(w, http.StatusOK, server.controller(r).ZoomPane(id))
+}
+
+func (server *Server) apiSendKeys(w http.ResponseWriter, r *http.Request, args []string) {
+	if !server.options.PermitWrite {
+		writeAPIError(w, http.StatusForbidden, "writing to panes is not permitted")
+		return
+	}
+	id, ok := server.lookupPane(w, args[0])
+	if !ok {
+		return
+	}
+	var req struct {
+		Keys    []string `json:"keys"`
+		Literal bool     `json:"literal"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if len(req.Keys) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "keys are required")
+		return
+	}
+	if err := server.controller(r).SendKeys(id, req.Literal, req.Keys...); err != nil {
+		writeAPIError(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) apiCapturePane(w http.ResponseWriter, r *http.Request, args []string) {
+	id, ok := server.lookupPane(w, args[0])
+	if !ok {
+		return
+	}
+	content, err := server.psmuxCtrl.CapturePane(id)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "content": content})
+}
+
+func (server *Server) apiListLockouts(w http.ResponseWriter, r *http.Request, args []string) {
+	writeJSON(w, http.StatusOK, server.limiter.lockouts())
+}
+
+// apiClearLockouts clears the lockout named by kind and key in the URL, or
+// all of them without arguments.
+func (server *Server) apiClearLockouts(w http.ResponseWriter, r *http.Request, args []string) {
+	var kind, key string
+	if len(args) == 2 {
+		kind, key = args[0], args[1]
+		if !server.limiter.clear(kind, key) {
+			writeAPIError(w, http.StatusNotFound, "no lockout for %s %s", kind, key)
+			return
+		}
+		server.logger.Info("Lockout cleared", "kind", kind, "key", key, "ip", server.clientIP(r))
+	} else {
+		server.limiter.clear("", "")
+		server.logger.Info("All lockouts cleared", "ip", server.clientIP(r))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiAction finishes a mutating request: psmux failures become 502 errors,
+// success returns the layout read after the change. The lookup before the
+// change has just refreshed the layout, so the refresh has to bypass the
+// controller's throttling.
+func (server *Server) apiAction(w http.ResponseWriter, status int, err error) {
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	server.psmuxCtrl.ForceRefreshLayout()
+	layout := server.psmuxCtrl.GetLayout()
+	if layout == nil {
+		layout = &psmux.Layout{}
+	}
+	writeJSON(w, status, layout)
+}
+
+// currentLayout returns the latest layout, never nil.
+func (server *Server) currentLayout() *psmux.Layout {
+	server.psmuxCtrl.RefreshLayout()
+	if layout := server.psmuxCtrl.GetLayout(); layout != nil {
+		return layout
+	}
+	return &psmux.Layout{}
+}
+
+// lookupPane resolves a pane ID from the URL. The leading "%" may be
+// omitted so scripts do not have to escape it.
+func (server *Server) lookupPane(w http.ResponseWriter, id string) (string, bool) {
+	if !strings.HasPrefix(id, "%") {
+		id = "%" + id
+	}
+	if server.currentLayout().FindPane(id) == nil {
+		writeAPIError(w, http.StatusNotFound, "pane %s not found", id)
+		return "", false
+	}
+	return id, true
+}
+
+// lookupWindow resolves a window ID from the URL, with an optional "@".
+func (server *Server) lookupWindow(w http.ResponseWriter, id string) (string, bool) {
+	if !strings.HasPrefix(id, "@") {
+		id = "@" + id
+	}
+	if server.currentLayout().FindWindow(id) == nil {
+		writeAPIError(w, http.StatusNotFound, "window %s not found", id)
+		return "", false
+	}
+	return id, true
+}
+
+// decodeJSONBody decodes an optional JSON request body into v.
+// It writes a 400 response and returns false if the body is malformed.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBodySize)).Decode(v)
+	if err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, "malformed request body: %s", err)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/psmux"
+)
+
+// fakeController records psmux calls and serves a fixed layout.
+type fakeController struct {
+	mu     sync.Mutex
+	layout *psmux.Layout
+	calls  []string
+	err    error
+}
+
+func newFakeController() *fakeController {
+	return &fakeController{
+		layout: &psmux.Layout{
+			SessionName: "main",
+			Sessions:    []psmux.Session{{ID: "main", Name: "main", Active: true}},
+			Windows: []psmux.Window{
+				{ID: "@0", Name: "pwsh", Active: true, Panes: []psmux.Pane{
+					{ID: "%0", Active: true},
+					{ID: "%1"},
+				}},
+			},
+		},
+	}
+}
+
+func (fc *fakeController) record(call string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.calls = append(fc.calls, call)
+	return fc.err
+}
+
+func (fc *fakeController) lastCall() string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.calls) == 0 {
+		return ""
+	}
+	return fc.calls[len(fc.calls)-1]
+}
+
+func (fc *fakeController) GetLayout() *psmux.Layout {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.layout
+}
+
+func (fc *fakeController) RefreshLayout() error             { return nil }
+func (fc *fakeController) ForceRefreshLayout() error        { return nil }
+func (fc *fakeController) Ping() error                      { return nil }
+func (fc *fakeController) HasSession() error                { return fc.record("has-session") }
+func (fc *fakeController) Stop() error                      { return nil }
+func (fc *fakeController) Events() <-chan psmux.Event       { return nil }
+func (fc *fakeController) SelectPane(id string) error       { return fc.record("select-pane " + id) }
+func (fc *fakeController) SelectWindow(id string) error     { return fc.record("select-window " + id) }
+func (fc *fakeController) SwitchSession(name string) error  { return fc.record("switch-client " + name) }
+func (fc *fakeController) SplitPane(horizontal bool) error  { return fc.SplitPaneAt("main", horizontal) }
+func (fc *fakeController) ClosePane(id string) error        { return fc.record("kill-pane " + id) }
+func (fc *fakeController) NewWindow() error                 { return fc.NewNamedWindow("") }
+func (fc *fakeController) NewNamedWindow(name string) error { return fc.record("new-window " + name) }
+func (fc *fakeController) KillWindow(id string) error       { return fc.record("kill-window " + id) }
+func (fc *fakeController) ZoomPane(id string) error         { return fc.record("zoom " + id) }
+func (fc *fakeController) RenameWindow(id, name string) error {
+	return fc.record("rename " + id + " " + name)
+}
+
+func (fc *fakeController) SplitPaneAt(target string, horizontal bool) error {
+	if horizontal {
+		return fc.record("split-window -h " + target)
+	}
+	return fc.record("split-window -v " + target)
+}
+
+func (fc *fakeController) SendKeys(id string, literal bool, keys ...string) error {
+	return fc.record("send-keys " + id + " " + strings.Join(keys, " "))
+}
+
+func (fc *fakeController) CapturePane(id string) (string, error) {
+	return "captured " + id, fc.record("capture-pane " + id)
+}
+
+// throttledController applies changes to a live layout that GetLayout only
+// returns after a refresh, and like psmux.Controller ignores refreshes that
+// come too soon after the previous one.
+type throttledController struct {
+	*fakeController
+	live        []psmux.Window
+	lastRefresh time.Time
+}
+
+func (tc *throttledController) KillWindow(id string) error {
+	var windows []psmux.Window
+	for _, win := range tc.live {
+		if win.ID != id {
+			windows = append(windows, win)
+		}
+	}
+	tc.live = windows
+	return tc.record("kill-window " + id)
+}
+
+func (tc *throttledController) RefreshLayout() error {
+	if time.Since(tc.lastRefresh) < time.Minute {
+		return nil
+	}
+	return tc.ForceRefreshLayout()
+}
+
+func (tc *throttledController) ForceRefreshLayout() error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	layout := *tc.layout
+	layout.Windows = tc.live
+	tc.layout = &layout
+	tc.lastRefresh = time.Now()
+	return nil
+}
+
+// testLogger discards the log records of servers under test.
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newAPITestServer(ctrl *fakeController, options *Options) http.Handler {
+	server := &Server{logger: testLogger, options: options}
+	if ctrl != nil {
+		server.psmuxCtrl = ctrl
+	}
+	return http.StripPrefix("/api", server.apiHandler())
+}
+
+func TestAPI(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		lastCall string
+	}{
+		{name: "layout", method: "GET", path: "/api/layout", status: 200},
+		{name: "select pane", method: "POST", path: "/api/panes/%251/select", status: 200, lastCall: "select-pane %1"},
+		{name: "select pane without percent", method: "POST", path: "/api/panes/1/select", status: 200, lastCall: "select-pane %1"},
+		{name: "unknown pane", method: "POST", path: "/api/panes/9/select", status: 404},
+		{name: "new window", method: "POST", path: "/api/windows", body: `{"name":"logs"}`, status: 201, lastCall: "new-window logs"},
+		{name: "new window without body", method: "POST", path: "/api/windows", status: 201, lastCall: "new-window "},
+		{name: "malformed body", method: "POST", path: "/api/windows", body: `{`, status: 400},
+		{name: "rename window", method: "POST", path: "/api/windows/0/rename", body: `{"name":"build"}`, status: 200, lastCall: "rename @0 build"},
+		{name: "rename without name", method: "POST", path: "/api/windows/@0/rename", body: `{}`, status: 400},
+		{name: "split pane", method: "POST", path: "/api/panes/0/split", body: `{"horizontal":true}`, status: 201, lastCall: "split-window -h %0"},
+		{name: "close pane", method: "DELETE", path: "/api/panes/0", status: 200, lastCall: "kill-pane %0"},
+		{name: "send keys", method: "POST", path: "/api/panes/0/keys", body: `{"keys":["make","Enter"]}`, status: 204, lastCall: "send-keys %0 make Enter"},
+		{name: "switch unknown session", method: "POST", path: "/api/sessions/other/switch", status: 404},
+		{name: "wrong method", method: "GET", path: "/api/windows/0/select", status: 405},
+		{name: "unknown endpoint", method: "GET", path: "/api/nope", status: 404},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := newFakeController()
+			handler := newAPITestServer(ctrl, &Options{PermitWrite: true})
+
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if tc.status >= 400 {
+				var body map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+					t.Errorf("expected a JSON error body, got %q", w.Body.String())
+				}
+			}
+			if tc.lastCall != "" && ctrl.lastCall() != tc.lastCall {
+				t.Errorf("expected call %q, got %q", tc.lastCall, ctrl.lastCall())
+			}
+		})
+	}
+}
+
+func TestAPIReturnsLayoutAfterChange(t *testing.T) {
+	ctrl := &throttledController{fakeController: newFakeController()}
+	ctrl.live = []psmux.Window{{ID: "@0", Name: "pwsh", Active: true}, {ID: "@1", Name: "logs"}}
+	ctrl.ForceRefreshLayout()
+	ctrl.lastRefresh = time.Time{}
+	server := &Server{logger: testLogger, options: &Options{}, psmuxCtrl: ctrl}
+	handler := http.StripPrefix("/api", server.apiHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/windows/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var layout psmux.Layout
+	if err := json.Unmarshal(w.Body.Bytes(), &layout); err != nil {
+		t.Fatal(err)
+	}
+	if layout.FindWindow("@1") != nil || layout.FindWindow("@0") == nil {
+		t.Errorf("expected the layout without the killed window, got %+v", layout.Windows)
+	}
+}
+
+func TestAPIRejectsCrossSiteRequests(t *testing.T) {
+	ctrl := newFakeController()
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{PermitWrite: true},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+		psmuxCtrl:     ctrl,
+	}
+	handler := http.StripPrefix("/api", server.wrapAuth(server.apiHandler()))
+	post := func(contentType string, headers map[string]string) int {
+		// What <form enctype="text/plain"> on another site sends, along with
+		// the Basic Auth credentials the browser cached.
+		r := httptest.NewRequest("POST", "http://term.example.com/api/panes/0/keys", strings.NewReader(`{"keys":["rm -rf ~","Enter"],"x":"="}`))
+		r.SetBasicAuth("admin", "secret")
+		r.Header.Set("Content-Type", contentType)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post("text/plain", map[string]string{"Origin": "https://evil.example"}); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a cross-origin form, got %d", code)
+	}
+	if code := post("application/json", map[string]string{"Sec-Fetch-Site": "cross-site"}); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a cross-site request, got %d", code)
+	}
+	if code := post("text/plain", map[string]string{"Origin": "http://term.example.com"}); code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for a body other than JSON, got %d", code)
+	}
+	if ctrl.lastCall() != "" {
+		t.Fatalf("expected no psmux call, got %q", ctrl.lastCall())
+	}
+	if code := post("application/json; charset=utf-8", map[string]string{"Origin": "http://term.example.com", "Sec-Fetch-Site": "same-origin"}); code != http.StatusNoContent {
+		t.Errorf("expected a same-origin JSON request to pass, got %d", code)
+	}
+	if code := post("application/json", nil); code != http.StatusNoContent {
+		t.Errorf("expected a script without Origin to pass, got %d", code)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	t.Run("no controller", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		newAPITestServer(nil, &Options{}).ServeHTTP(w, httptest.NewRequest("GET", "/api/layout", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503, got %d", w.Code)
+		}
+	})
+
+	t.Run("psmux failure", func(t *testing.T) {
+		ctrl := newFakeController()
+		ctrl.err = errors.New("psmux command failed")
+		w := httptest.NewRecorder()
+		newAPITestServer(ctrl, &Options{}).ServeHTTP(w, httptest.NewRequest("POST", "/api/panes/0/select", nil))
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("expected 502, got %d", w.Code)
+		}
+	})
+
+	t.Run("viewer role", func(t *testing.T) {
+		ctrl := newFakeController()
+		viewer := &auth.Identity{User: "bob", Role: auth.RoleViewer}
+		handler := newAPITestServer(ctrl, &Options{PermitWrite: true})
+
+		r := httptest.NewRequest("GET", "/api/layout", nil)
+		r = r.WithContext(auth.NewContext(r.Context(), viewer))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected viewer to read the layout, got %d", w.Code)
+		}
+
+		r = httptest.NewRequest("DELETE", "/api/panes/0", nil)
+		r = r.WithContext(auth.NewContext(r.Context(), viewer))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 for a viewer closing a pane, got %d", w.Code)
+		}
+		if ctrl.lastCall() != "" {
+			t.Errorf("expected no psmux call, got %q", ctrl.lastCall())
+		}
+	})
+
+	t.Run("keys without permit write", func(t *testing.T) {
+		ctrl := newFakeController()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/panes/0/keys", strings.NewReader(`{"keys":["ls"]}`))
+		r.Header.Set("Content-Type", "application/json")
+		newAPITestServer(ctrl, &Options{}).ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", w.Code)
+		}
+		if ctrl.lastCall() != "" {
+			t.Errorf("expected no psmux call, got %q", ctrl.lastCall())
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	ctrl := newFakeController()
+	server := &Server{logger: testLogger, options: &Options{}, psmuxCtrl: ctrl}
+	server.layouts = newLayoutHub(ctrl, time.Hour, slog.Default(), nil)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.handleEvents))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	nextEvent := func() string {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read stream: %v", err)
+			}
+			if strings.HasPrefix(line, "event: ") {
+				return strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			}
+		}
+	}
+
+	if ev := nextEvent(); ev != "layout" {
+		t.Fatalf("expected initial layout event, got %q", ev)
+	}
+
+	// The initial layout is the hub's baseline, so polling it again sends
+	// nothing and the next event is the added window.
+	server.layouts.poll()
+	ctrl.mu.Lock()
+	ctrl.layout = &psmux.Layout{
+		SessionName: "main",
+		Sessions:    ctrl.layout.Sessions,
+		Windows:     append(append([]psmux.Window{}, ctrl.layout.Windows...), psmux.Window{ID: "@1"}),
+	}
+	ctrl.mu.Unlock()
+	server.layouts.poll()
+
+	if ev := nextEvent(); ev != psmux.EventWindowAdded {
+		t.Fatalf("expected %s event, got %q", psmux.EventWindowAdded, ev)
+	}
+	if ev := nextEvent(); ev != "layout" {
+		t.Fatalf("expected layout event after window-added, got %q", ev)
+	}
+}
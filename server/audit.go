@@ -0,0 +1,187 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/audit"
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/homedir"
+)
+
+// newAuditLogger opens the audit log configured in options, if any.
+func newAuditLogger(options *Options) (*audit.Logger, error) {
+	if options.AuditLog == "" {
+		return nil, nil
+	}
+	path := homedir.Expand(options.AuditLog)
+	logger, err := audit.Open(
+		path,
+		int64(options.AuditLogMaxSize)*1024*1024,
+		time.Duration(options.AuditLogMaxAge)*time.Second,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log `%s`", path)
+	}
+	options.logger().Info("Writing audit log", "path", path)
+	return logger, nil
+}
+
+// auditEntry returns an entry of event by identity from ip.
+func auditEntry(event string, identity *auth.Identity, ip string) audit.Entry {
+	entry := audit.Entry{Event: event, IP: ip}
+	if identity != nil {
+		entry.User = identity.User
+		entry.Role = identity.Role.String()
+		entry.Method = identity.Method
+	}
+	return entry
+}
+
+// recordAudit appends entry to the audit log, if enabled.
+func (server *Server) recordAudit(entry audit.Entry) {
+	if server.audit == nil {
+		return
+	}
+	if err := server.audit.Log(entry); err != nil {
+		server.logger.Error("Failed to write audit log", "error", err)
+	}
+}
+
+// loginSucceeded records a login through method in the audit log and the
+// metrics.
+func (server *Server) loginSucceeded(method string, identity *auth.Identity, ip string) {
+	server.metrics.login(method, nil)
+	server.recordAudit(auditEntry(audit.EventLogin, identity, ip))
+}
+
+// loginFailed records a failed login of user through method in the audit
+// log and the metrics.
+func (server *Server) loginFailed(method, user, ip string, err error) {
+	server.metrics.login(method, err)
+	entry := auditEntry(audit.EventLoginFailed, &auth.Identity{User: user, Method: method}, ip)
+	entry.Role = ""
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	server.recordAudit(entry)
+}
+
+// auditDisconnect records the end of conn, which transferred the bytes
+// counted by wsw.
+func (server *Server) auditDisconnect(conn *connection, wsw *wsWrapper, err error) {
+	entry := auditEntry(audit.EventDisconnect, conn.identity, conn.ip)
+	entry.Conn = conn.id
+	entry.Duration = time.Since(conn.started).Seconds()
+	entry.BytesIn = atomic.LoadInt64(&wsw.bytesIn)
+	entry.BytesOut = atomic.LoadInt64(&wsw.bytesOut)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	server.recordAudit(entry)
+}
+
+// controller returns the psmux controller for the API request r, which
+// records the actions of the client when auditing.
+func (server *Server) controller(r *http.Request) psmuxController {
+	return server.auditedController(auditEntry(audit.EventAction, auth.FromContext(r.Context()), server.clientIP(r)))
+}
+
+// auditedController returns the psmux controller for the client of entry.
+func (server *Server) auditedController(entry audit.Entry) psmuxController {
+	if server.audit == nil {
+		return server.psmuxCtrl
+	}
+	return &auditController{psmuxController: server.psmuxCtrl, server: server, entry: entry}
+}
+
+// auditController records the psmux actions of one client.
+type auditController struct {
+	psmuxController
+	server *Server
+	entry  audit.Entry
+}
+
+func (ac *auditController) record(action, target, input string, err error) error {
+	entry := ac.entry
+	entry.Event = audit.EventAction
+	entry.Action = action
+	entry.Target = target
+	entry.Input = input
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	ac.server.recordAudit(entry)
+	return err
+}
+
+func (ac *auditController) SelectPane(paneID string) error {
+	return ac.record("SelectPane", paneID, "", ac.psmuxController.SelectPane(paneID))
+}
+
+func (ac *auditController) SelectWindow(windowID string) error {
+	return ac.record("SelectWindow", windowID, "", ac.psmuxController.SelectWindow(windowID))
+}
+
+func (ac *auditController) SwitchSession(sessionName string) error {
+	return ac.record("SwitchSession", sessionName, "", ac.psmuxController.SwitchSession(sessionName))
+}
+
+func (ac *auditController) SplitPane(horizontal bool) error {
+	return ac.record("SplitPane", "", "", ac.psmuxController.SplitPane(horizontal))
+}
+
+func (ac *auditController) SplitPaneAt(target string, horizontal bool) error {
+	return ac.record("SplitPane", target, "", ac.psmuxController.SplitPaneAt(target, horizontal))
+}
+
+func (ac *auditController) ClosePane(paneID string) error {
+	return ac.record("ClosePane", paneID, "", ac.psmuxController.ClosePane(paneID))
+}
+
+func (ac *auditController) ZoomPane(paneID string) error {
+	return ac.record("ZoomPane", paneID, "", ac.psmuxController.ZoomPane(paneID))
+}
+
+func (ac *auditController) NewWindow() error {
+	return ac.record("NewWindow", "", "", ac.psmuxController.NewWindow())
+}
+
+func (ac *auditController) NewNamedWindow(name string) error {
+	return ac.record("NewWindow", name, "", ac.psmuxController.NewNamedWindow(name))
+}
+
+func (ac *auditController) RenameWindow(windowID string, name string) error {
+	return ac.record("RenameWindow", windowID, "", ac.psmuxController.RenameWindow(windowID, name))
+}
+
+func (ac *auditController) KillWindow(windowID string) error {
+	return ac.record("KillWindow", windowID, "", ac.psmuxController.KillWindow(windowID))
+}
+
+func (ac *auditController) SendKeys(paneID string, literal bool, keys ...string) error {
+	input := ""
+	if ac.server.options.AuditInput {
+		input = strings.Join(keys, " ")
+	}
+	return ac.record("SendKeys", paneID, input, ac.psmuxController.SendKeys(paneID, literal, keys...))
+}
+
+// auditSlave records the input a connection sends to the slave.
+type auditSlave struct {
+	Slave
+	server *Server
+	entry  audit.Entry
+}
+
+func (slave *auditSlave) Write(p []byte) (int, error) {
+	entry := slave.entry
+	entry.Event = audit.EventInput
+	entry.Input = string(p)
+	slave.server.recordAudit(entry)
+	return slave.Slave.Write(p)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"webpsmux/pkg/audit"
+	"webpsmux/pkg/auth"
+)
+
+func TestAuditAPIActions(t *testing.T) {
+	var buf bytes.Buffer
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{PermitWrite: true, AuditInput: true},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+		psmuxCtrl:     newFakeController(),
+		audit:         audit.NewLogger(&buf, 0, ""),
+	}
+	handler := server.wrapAuth(http.StripPrefix("/api", server.apiHandler()))
+
+	for _, req := range []struct {
+		path, body, password string
+	}{
+		{"/api/panes/1", "", "wrong"},
+		{"/api/panes/1", "", "secret"},
+		{"/api/panes/0/keys", `{"keys":["make","Enter"]}`, "secret"},
+	} {
+		method := "DELETE"
+		if req.body != "" {
+			method = "POST"
+		}
+		r := httptest.NewRequest(method, req.path, strings.NewReader(req.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.SetBasicAuth("admin", req.password)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry audit.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected three entries, got %s", buf.String())
+	}
+	if entries[0].Event != audit.EventLoginFailed || entries[0].User != "admin" || entries[0].IP != "192.0.2.1" {
+		t.Errorf("expected the failed login, got %+v", entries[0])
+	}
+	if e := entries[1]; e.Event != audit.EventAction || e.Action != "ClosePane" || e.Target != "%1" || e.User != "admin" || e.Method != "basic" {
+		t.Errorf("expected the closed pane, got %+v", e)
+	}
+	if e := entries[2]; e.Action != "SendKeys" || e.Target != "%0" || e.Input != "make Enter" {
+		t.Errorf("expected the sent keys, got %+v", e)
+	}
+	if _, _, err := audit.Verify(&buf, 0, ""); err != nil {
+		t.Errorf("expected the entries to verify, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/homedir"
+)
+
+// newCertMapper loads the client certificate mapping configured in options,
+// if any.
+func newCertMapper(options *Options) (*auth.CertMapper, error) {
+	if options.TLSClientMapFile == "" {
+		return nil, nil
+	}
+	path := homedir.Expand(options.TLSClientMapFile)
+	mapper, err := auth.LoadCertMapper(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load client certificate mapping `%s`", path)
+	}
+	options.logger().Info("Mapping client certificates to users", "path", path)
+	return mapper, nil
+}
+
+// certIdentity returns the user the verified client certificate of r maps
+// to, or nil.
+func (server *Server) certIdentity(r *http.Request) *auth.Identity {
+	if server.certMapper == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return server.certMapper.Identity(r.TLS.VerifiedChains[0][0])
+}
+
+// requireCertUser rejects requests whose authenticated user is not the one
+// their client certificate maps to.
+func (server *Server) requireCertUser(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert := server.certIdentity(r)
+		identity := auth.FromContext(r.Context())
+		if cert == nil || identity == nil || identity.User != cert.User {
+			server.logger.Warn("Rejected client certificate that does not belong to the user", "ip", server.clientIP(r))
+			http.Error(w, "Client certificate does not belong to the user", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// verifyNotRevoked returns a tls.Config.VerifyConnection function that
+// rejects client certificates on the configured deny list or CRL. Unlike
+// VerifyPeerCertificate, it also runs when a session is resumed.
+func verifyNotRevoked(options *Options, caCerts []*x509.Certificate) (func(tls.ConnectionState) error, error) {
+	path := homedir.Expand(options.TLSClientDenyFile)
+	list, err := auth.LoadRevocationList(path, caCerts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load client certificate deny list `%s`", path)
+	}
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		cert := state.PeerCertificates[0]
+		if list.Revoked(cert) {
+			options.logger().Warn("Rejected revoked client certificate", "subject", cert.Subject.String(), "issuer", cert.Issuer.String(), "serial", cert.SerialNumber.Text(16), "resumed", state.DidResume)
+			return errors.Errorf("client certificate %s is revoked", cert.Subject)
+		}
+		return nil
+	}, nil
+}
+
+// parseCertificates returns the certificates in PEM data.
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth"
+)
+
+func newTestClientCert(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestClientCertAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certs.hcl")
+	os.WriteFile(path, []byte(`cn "alice" { role = "operator" }`), 0600)
+	options := &Options{EnableTLSClientAuth: true, TLSClientMapFile: path}
+	mapper, err := newCertMapper(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(server *Server, cn, user, password string) (int, *auth.Identity) {
+		var got *auth.Identity
+		handler := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = auth.FromContext(r.Context())
+		}))
+		r := httptest.NewRequest("GET", "https://example.com/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{newTestClientCert(t, cn)}}}
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, got
+	}
+
+	server := &Server{
+		logger:        testLogger,
+		options:       options,
+		certMapper:    mapper,
+		authenticator: &auth.StaticCredential{User: "bob", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+	}
+	if code, id := request(server, "alice", "", ""); code != http.StatusOK || id.User != "alice" || id.Role != auth.RoleOperator {
+		t.Errorf("expected a mapped certificate to log in without a password, got %d %+v", code, id)
+	}
+	if code, _ := request(server, "mallory", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected an unmapped certificate to need a password, got %d", code)
+	}
+	if code, id := request(server, "mallory", "bob", "secret"); code != http.StatusOK || id.User != "bob" {
+		t.Errorf("expected an unmapped certificate with a password to log in, got %d %+v", code, id)
+	}
+
+	options.TLSCertAndPassword = true
+	server.authenticator = &auth.StaticCredential{User: "alice", Password: "secret"}
+	if code, _ := request(server, "alice", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected a password to be required, got %d", code)
+	}
+	if code, id := request(server, "alice", "alice", "secret"); code != http.StatusOK || id.User != "alice" {
+		t.Errorf("expected certificate and password of the same user to log in, got %d %+v", code, id)
+	}
+	if code, _ := request(server, "mallory", "alice", "secret"); code != http.StatusForbidden {
+		t.Errorf("expected the certificate of another user to be rejected, got %d", code)
+	}
+}
+
+func TestVerifyNotRevoked(t *testing.T) {
+	cert := newTestClientCert(t, "alice")
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(path, []byte(cert.SerialNumber.Text(16)+"\n"), 0600)
+
+	verify, err := verifyNotRevoked(&Options{TLSClientDenyFile: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err == nil {
+		t.Error("expected the revoked certificate to be rejected")
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{newTestClientCert(t, "bob")}}); err != nil {
+		t.Errorf("expected the handshake to proceed, got %v", err)
+	}
+}
+
+func TestRevokedCertificateCannotResume(t *testing.T) {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+
+	issue := func(serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "alice"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	denyFile := filepath.Join(dir, "deny.txt")
+	os.WriteFile(denyFile, nil, 0600)
+	server := &Server{logger: testLogger, options: &Options{TLSClientDenyFile: denyFile}}
+	config, err := server.tlsConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificates = []tls.Certificate{issue(2, nil, nil, x509.ExtKeyUsageServerAuth)}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	client := &tls.Config{
+		Certificates:       []tls.Certificate{issue(3, ca, caKey, x509.ExtKeyUsageClientAuth)},
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	connect := func() (bool, error) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+		if err != nil {
+			return false, err
+		}
+		defer conn.Close()
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		return conn.ConnectionState().DidResume, err
+	}
+
+	if _, err := connect(); err != nil {
+		t.Fatal(err)
+	}
+	if resumed, err := connect(); err != nil || !resumed {
+		t.Fatalf("expected the session to be resumed, got %v, %v", resumed, err)
+	}
+
+	os.WriteFile(denyFile, []byte("3\n"), 0600)
+	os.Chtimes(denyFile, time.Now(), time.Now().Add(time.Second))
+	if _, err := connect(); err == nil {
+		t.Error("expected a revoked certificate not to resume its session")
+	}
+}
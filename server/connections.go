@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"webpsmux/pkg/audit"
+	"webpsmux/pkg/auth"
+	"webpsmux/webtty"
+)
+
+// closeTerminated is the websocket close code of connections terminated by
+// an admin. The client shows the reason and does not reconnect.
+const closeTerminated = 4000
+
+// connection is an open websocket connection.
+type connection struct {
+	id        int64
+	identity  *auth.Identity
+	remote    string
+	ip        string
+	userAgent string
+	session   string
+	started   time.Time
+	cancel    context.CancelFunc
+
+	// conn and wsw are the websocket and its byte counts, tty is set once
+	// the terminal runs.
+	conn *websocket.Conn
+	wsw  *wsWrapper
+	tty  atomic.Pointer[webtty.WebTTY]
+}
+
+// connectionInfo describes an open connection for the admin API.
+type connectionInfo struct {
+	ID          int64     `json:"id"`
+	User        string    `json:"user,omitempty"`
+	Role        string    `json:"role,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Session     string    `json:"session,omitempty"`
+	Started     time.Time `json:"started"`
+	Idle        float64   `json:"idle"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	PermitWrite bool      `json:"permit_write"`
+}
+
+// info describes conn at now. Idle is the time since the client last sent
+// a message, in seconds.
+func (conn *connection) info(now time.Time) connectionInfo {
+	info := connectionInfo{
+		ID:        conn.id,
+		IP:        conn.ip,
+		UserAgent: conn.userAgent,
+		Session:   conn.session,
+		Started:   conn.started,
+	}
+	if conn.identity != nil {
+		info.User = conn.identity.User
+		info.Role = conn.identity.Role.String()
+		info.Method = conn.identity.Method
+	}
+	lastRead := conn.started
+	if conn.wsw != nil {
+		info.BytesIn = atomic.LoadInt64(&conn.wsw.bytesIn)
+		info.BytesOut = atomic.LoadInt64(&conn.wsw.bytesOut)
+		if nanos := atomic.LoadInt64(&conn.wsw.lastRead); nanos != 0 {
+			lastRead = time.Unix(0, nanos)
+		}
+	}
+	info.Idle = now.Sub(lastRead).Seconds()
+	if tty := conn.tty.Load(); tty != nil {
+		info.PermitWrite = tty.PermitWrite()
+	}
+	return info
+}
+
+// terminate closes conn, telling the client reason.
+func (conn *connection) terminate(reason string) {
+	if conn.conn != nil {
+		// Control frames carry at most 125 bytes, 2 of them the code.
+		if len(reason) > 123 {
+			reason = strings.ToValidUTF8(reason[:123], "")
+		}
+		message := websocket.FormatCloseMessage(closeTerminated, reason)
+		conn.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	}
+	conn.cancel()
+}
+
+// connectionRegistry keeps track of open websocket connections so that
+// they can be listed by admins and closed when their user logs out.
+type connectionRegistry struct {
+	mu     sync.Mutex
+	nextID int64
+	conns  map[int64]*connection
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{conns: make(map[int64]*connection)}
+}
+
+// newID reserves a connection ID.
+func (registry *connectionRegistry) newID() int64 {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.nextID++
+	return registry.nextID
+}
+
+// add registers conn, giving it an ID unless it has one from newID, and
+// returns a function removing it again.
+func (registry *connectionRegistry) add(conn *connection) func() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if conn.id == 0 {
+		registry.nextID++
+		conn.id = registry.nextID
+	}
+	conn.started = time.Now()
+	registry.conns[conn.id] = conn
+
+	return func() {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		delete(registry.conns, conn.id)
+	}
+}
+
+// count returns the number of open connections.
+func (registry *connectionRegistry) count() int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return len(registry.conns)
+}
+
+// list describes all open connections, ordered by ID.
+func (registry *connectionRegistry) list() []connectionInfo {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	now := time.Now()
+	list := make([]connectionInfo, 0, len(registry.conns))
+	for _, conn := range registry.conns {
+		list = append(list, conn.info(now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// get returns the open connection with id, nil if there is none.
+func (registry *connectionRegistry) get(id int64) *connection {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return registry.conns[id]
+}
+
+// closeUser closes all connections of the named user and returns how many
+// were closed.
+func (registry *connectionRegistry) closeUser(user string) int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	closed := 0
+	for _, conn := range registry.conns {
+		if conn.identity != nil && conn.identity.User == user {
+			conn.cancel()
+			closed++
+		}
+	}
+	return closed
+}
+
+// lookupConnection returns the open connection with the ID in the URL, or
+// answers 404.
+func (server *Server) lookupConnection(w http.ResponseWriter, arg string) (*connection, bool) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	var conn *connection
+	if err == nil {
+		conn = server.connections.get(id)
+	}
+	if conn == nil {
+		writeAPIError(w, http.StatusNotFound, "connection %s not found", arg)
+		return nil, false
+	}
+	return conn, true
+}
+
+// auditConnectionAction records an admin action on conn.
+func (server *Server) auditConnectionAction(r *http.Request, action string, conn *connection) {
+	entry := auditEntry(audit.EventAction, auth.FromContext(r.Context()), server.clientIP(r))
+	entry.Action = action
+	entry.Target = strconv.FormatInt(conn.id, 10)
+	server.recordAudit(entry)
+}
+
+func (server *Server) apiListConnections(w http.ResponseWriter, r *http.Request, args []string) {
+	writeJSON(w, http.StatusOK, server.connections.list())
+}
+
+// apiDisconnect closes a connection. The optional reason is shown to the
+// client.
+func (server *Server) apiDisconnect(w http.ResponseWriter, r *http.Request, args []string) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	conn, ok := server.lookupConnection(w, args[0])
+	if !ok {
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "Disconnected by an administrator"
+	}
+	conn.terminate(req.Reason)
+	server.auditConnectionAction(r, "Disconnect", conn)
+	server.logger.Info("Connection terminated", "conn", conn.id, "reason", req.Reason, "ip", server.clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiReadOnly revokes the write permission of a connection.
+func (server *Server) apiReadOnly(w http.ResponseWriter, r *http.Request, args []string) {
+	conn, ok := server.lookupConnection(w, args[0])
+	if !ok {
+		return
+	}
+	tty := conn.tty.Load()
+	if tty == nil {
+		writeAPIError(w, http.StatusConflict, "connection %s is not running yet", args[0])
+		return
+	}
+	tty.SetPermitWrite(false)
+	server.auditConnectionAction(r, "ReadOnly", conn)
+	server.logger.Info("Connection made read-only", "conn", conn.id, "ip", server.clientIP(r))
+	writeJSON(w, http.StatusOK, conn.info(time.Now()))
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/webtty"
+)
+
+func TestConnectionsAPI(t *testing.T) {
+	server := &Server{logger: testLogger, options: &Options{}, connections: newConnectionRegistry()}
+	api := http.StripPrefix("/api", server.apiHandler())
+
+	// A websocket registered the way processWSConn does.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upgrader := websocket.Upgrader{}
+	registered := make(chan *connection)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		client := &connection{
+			identity:  &auth.Identity{User: "alice", Role: auth.RoleOperator},
+			ip:        "192.0.2.7",
+			userAgent: r.UserAgent(),
+			cancel:    cancel,
+			conn:      conn,
+			wsw:       &wsWrapper{Conn: conn},
+		}
+		tty, _ := webtty.New(client.wsw, nil, webtty.WithPermitWrite())
+		client.tty.Store(tty)
+		defer server.connections.add(client)()
+		registered <- client
+		<-ctx.Done()
+	}))
+	defer ts.Close()
+
+	header := http.Header{"User-Agent": []string{"test-browser"}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	client := <-registered
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/api/connections", nil))
+	var list []connectionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].User != "alice" || list[0].UserAgent != "test-browser" || !list[0].PermitWrite {
+		t.Fatalf("unexpected connections %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/api/connections/1/read-only", nil))
+	if w.Code != http.StatusOK || client.tty.Load().PermitWrite() {
+		t.Errorf("expected the connection to become read-only, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/api/connections/2/disconnect", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown connection, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/connections/1/disconnect", strings.NewReader(`{"reason":"maintenance"}`))
+	r.Header.Set("Content-Type", "application/json")
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, closeTerminated) || !strings.Contains(err.Error(), "maintenance") {
+		t.Errorf("expected the client to be told the reason, got %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Error("expected the connection to be canceled")
+	}
+}
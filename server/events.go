@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/psmux"
+)
+
+// eventsKeepAlive is the interval of comment lines sent to keep idle
+// event streams from being closed by proxies.
+const eventsKeepAlive = 30 * time.Second
+
+// handleEvents streams layout changes and psmux events as Server-Sent Events.
+// Every change produces a "layout" event carrying the full layout, preceded
+// by one event per change named after psmux.Event.Type (e.g. "window-added").
+func (server *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	identity := auth.FromContext(r.Context())
+	if isShareViewer(identity) {
+		writeAPIError(w, http.StatusForbidden, "share links do not grant API access")
+		return
+	}
+	if !identity.HasScope(auth.ScopeLayoutRead) {
+		writeAPIError(w, http.StatusForbidden, "token lacks scope %s", auth.ScopeLayoutRead)
+		return
+	}
+	if server.layouts == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "psmux controller is not running")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	updates, layout, unsubscribe := server.layouts.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if layout == nil {
+		layout = &psmux.Layout{}
+	}
+	if err := writeSSE(w, "layout", layout); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case update := <-updates:
+			for _, event := range update.Events {
+				if err := writeSSE(w, event.Type, event); err != nil {
+					return
+				}
+			}
+			if err := writeSSE(w, "layout", update.Layout); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
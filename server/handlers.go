@@ -5,7 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
@@ -15,6 +15,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 
+	"webpsmux/pkg/audit"
+	"webpsmux/pkg/auth"
 	"webpsmux/webtty"
 )
 
@@ -41,11 +43,29 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 		num := counter.add(1)
 		closeReason := "unknown reason"
 
+		identity := auth.FromContext(r.Context())
+		peer := wsPeer{
+			id:        server.connections.newID(),
+			identity:  identity,
+			origin:    server.requestOrigin(r),
+			ip:        server.clientIP(r),
+			userAgent: r.UserAgent(),
+			tokenOnly: initTokenRequired(r.Context()),
+		}
+		peer.logger = server.logger.With("conn", peer.id, "ip", peer.ip)
+		if identity != nil {
+			peer.logger = peer.logger.With("user", identity.User)
+		}
+		if server.psmuxSession != "" {
+			peer.logger = peer.logger.With("session", server.psmuxSession)
+		}
+
 		defer func() {
 			num := counter.done()
-			log.Printf(
-				"Connection closed by %s: %s, connections: %d/%d",
-				closeReason, r.RemoteAddr, num, server.options.MaxConnection,
+			peer.logger.Info("Connection closed",
+				"reason", closeReason,
+				"connections", num,
+				"max_connections", server.options.MaxConnection,
 			)
 
 			if server.options.Once {
@@ -60,7 +80,7 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 			}
 		}
 
-		log.Printf("New client connected: %s, connections: %d/%d", r.RemoteAddr, num, server.options.MaxConnection)
+		peer.logger.Info("New client connected", "connections", num, "max_connections", server.options.MaxConnection)
 
 		if r.Method != "GET" {
 			http.Error(w, "Method not allowed", 405)
@@ -75,9 +95,9 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 		defer conn.Close()
 
 		if server.options.PassHeaders {
-			err = server.processWSConn(ctx, conn, r.Header)
+			err = server.processWSConn(ctx, conn, r.Header, peer)
 		} else {
-			err = server.processWSConn(ctx, conn, nil)
+			err = server.processWSConn(ctx, conn, nil, peer)
 		}
 
 		switch err {
@@ -93,7 +113,22 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 	}
 }
 
-func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, headers map[string][]string) error {
+// wsPeer is what the upgrade request told about the client of a websocket.
+type wsPeer struct {
+	// id is the connection ID, and logger has it and the client among its
+	// fields.
+	id        int64
+	logger    *slog.Logger
+	identity  *auth.Identity
+	origin    string
+	ip        string
+	userAgent string
+	// tokenOnly is set when the upgrade carried no credentials, so the init
+	// message must carry an API token.
+	tokenOnly bool
+}
+
+func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, headers map[string][]string, peer wsPeer) (err error) {
 	typ, initLine, err := conn.ReadMessage()
 	if err != nil {
 		return errors.Wrapf(err, "failed to authenticate websocket connection")
@@ -107,9 +142,44 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, h
 	if err != nil {
 		return errors.Wrapf(err, "failed to authenticate websocket connection")
 	}
-	if init.AuthToken != server.options.Credential {
-		return errors.New("failed to authenticate websocket connection")
+	identity, err := server.authenticateInit(&init, peer)
+	if err == nil && !identity.HasScope(auth.ScopeLayoutRead) {
+		err = errors.Errorf("token lacks scope %s", auth.ScopeLayoutRead)
+	}
+	if err != nil {
+		user := ""
+		if peer.identity != nil {
+			user = peer.identity.User
+		}
+		server.loginFailed("websocket", user, peer.ip, err)
+		return errors.Wrapf(err, "failed to authenticate websocket connection")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wsw := &wsWrapper{Conn: conn, metrics: server.metrics}
+	logger := peer.logger
+	if peer.identity == nil && identity != nil {
+		logger = logger.With("user", identity.User)
+	}
+	client := &connection{
+		id:        peer.id,
+		identity:  identity,
+		remote:    conn.RemoteAddr().String(),
+		ip:        peer.ip,
+		userAgent: peer.userAgent,
+		session:   server.psmuxSession,
+		cancel:    cancel,
+		conn:      conn,
+		wsw:       wsw,
 	}
+	defer server.connections.add(client)()
+	connected := auditEntry(audit.EventConnect, identity, peer.ip)
+	connected.Conn = client.id
+	server.recordAudit(connected)
+	defer func() { server.auditDisconnect(client, wsw, err) }()
+	server.metrics.connected()
+	defer func() { server.metrics.disconnected(time.Since(client.started)) }()
 
 	queryPath := "?"
 	if server.options.PermitArguments && init.Arguments != "" {
@@ -121,12 +191,20 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, h
 		return errors.Wrapf(err, "failed to parse arguments")
 	}
 	params := query.Query()
+	share := isShareViewer(identity)
 	var slave Slave
-	slave, err = server.factory.New(params, headers)
+	if share {
+		slave, err = server.newShareSlave(identity)
+	} else {
+		slave, err = server.factory.New(params, headers)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "failed to create backend")
 	}
 	defer slave.Close()
+	if server.options.AuditInput {
+		slave = &auditSlave{Slave: slave, server: server, entry: connected}
+	}
 
 	titleVars := server.titleVariables(
 		[]string{"server", "master", "slave"},
@@ -148,9 +226,12 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, h
 	opts := []webtty.Option{
 		webtty.WithWindowTitle(titleBuf.Bytes()),
 	}
-	if server.options.PermitWrite {
+	if server.options.PermitWrite && !share {
 		opts = append(opts, webtty.WithPermitWrite())
 	}
+	if identity != nil {
+		opts = append(opts, webtty.WithIdentity(identity))
+	}
 	if server.options.EnableReconnect {
 		opts = append(opts, webtty.WithReconnect(server.options.ReconnectTime))
 	}
@@ -160,17 +241,21 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, h
 	if server.options.Height > 0 {
 		opts = append(opts, webtty.WithFixedRows(server.options.Height))
 	}
-	tty, err := webtty.New(&wsWrapper{conn}, slave, opts...)
+	opts = append(opts, webtty.WithLogger(logger))
+	tty, err := webtty.New(wsw, slave, opts...)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create webtty")
 	}
+	client.tty.Store(tty)
 
-	// Set up psmux controller if available
-	if server.psmuxCtrl != nil {
-		tty.SetPsmuxController(server.psmuxCtrl)
+	// Set up psmux controller if available. Share viewers only see their
+	// target, not the layout around it.
+	if server.psmuxCtrl != nil && !share {
+		tty.SetPsmuxController(server.auditedController(connected))
 
-		// Start goroutine to listen for psmux events and broadcast layout updates
-		go server.handlePsmuxEvents(ctx, tty)
+		if server.layouts != nil {
+			go server.handlePsmuxEvents(ctx, tty, logger)
+		}
 	}
 
 	err = tty.Run(ctx)
@@ -178,37 +263,57 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, h
 	return err
 }
 
-// handlePsmuxEvents polls for psmux layout changes and sends updates to the client
-func (server *Server) handlePsmuxEvents(ctx context.Context, tty *webtty.WebTTY) {
-	if server.psmuxCtrl == nil {
-		return
+// authenticateInit checks the credential of the init message and returns
+// the identity of the connection. An API token stands on its own. Otherwise,
+// besides the upgrade request itself, the page must prove with a ticket from
+// ws_ticket that it was loaded by the same user from the same origin.
+func (server *Server) authenticateInit(init *InitMessage, peer wsPeer) (*auth.Identity, error) {
+	if server.tokens != nil && auth.IsToken(init.AuthToken) {
+		if locked, _, _ := server.limiter.checkLocked(peer.ip, ""); locked {
+			return nil, errors.New("too many failed login attempts")
+		}
+		identity, err := server.tokenIdentity(init.AuthToken)
+		if err != nil {
+			server.limiter.recordFailure(peer.ip, "")
+			return nil, err
+		}
+		if peer.identity != nil && peer.identity.User != identity.User {
+			return nil, errors.New("token belongs to another user")
+		}
+		// Other websockets were counted when their upgrade authenticated.
+		server.metrics.login("websocket", nil)
+		return identity, nil
+	}
+	if peer.tokenOnly {
+		return nil, errors.New("an API token is required")
+	}
+	if peer.identity == nil {
+		return nil, nil
+	}
+
+	ticketIdentity, err := server.tickets.Redeem(init.AuthToken, peer.origin)
+	if err != nil {
+		return nil, err
 	}
+	if ticketIdentity.User != peer.identity.User {
+		return nil, errors.New("ticket was issued to another user")
+	}
+	return ticketIdentity, nil
+}
 
-	// Poll for layout changes every 500ms
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+// handlePsmuxEvents sends layout updates from the layout hub to the client
+// until ctx is canceled.
+func (server *Server) handlePsmuxEvents(ctx context.Context, tty *webtty.WebTTY, logger *slog.Logger) {
+	updates, _, unsubscribe := server.layouts.subscribe()
+	defer unsubscribe()
 
-	var lastLayout string
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			// Refresh and check if layout changed
-			server.psmuxCtrl.RefreshLayout()
-			layout := server.psmuxCtrl.GetLayout()
-			if layout == nil {
-				continue
-			}
-
-			// Simple change detection using JSON
-			data, _ := json.Marshal(layout)
-			currentLayout := string(data)
-			if currentLayout != lastLayout {
-				lastLayout = currentLayout
-				if err := tty.SendPsmuxLayout(); err != nil {
-					log.Printf("Failed to send psmux layout: %v", err)
-				}
+		case <-updates:
+			if err := tty.SendPsmuxLayout(); err != nil {
+				logger.Warn("Failed to send psmux layout", "error", err)
 			}
 		}
 	}
@@ -267,14 +372,30 @@ func (server *Server) indexVariables(r *http.Request) (map[string]interface{}, e
 
 	indexVars := map[string]interface{}{
 		"title": titleBuf.String(),
+		"nonce": cspNonce(r),
 	}
 	return indexVars, err
 }
 
-func (server *Server) handleAuthToken(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/javascript")
-	// @TODO hashing?
-	w.Write([]byte("var gotty_auth_token = '" + server.options.Credential + "';"))
+// handleWSTicket issues the ticket the page sends in the first websocket
+// message. Tickets expire within seconds and can be used only once.
+func (server *Server) handleWSTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	ticket := ""
+	if identity := auth.FromContext(r.Context()); identity != nil {
+		var err error
+		ticket, err = server.tickets.Issue(identity, server.requestOrigin(r))
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "failed to issue ticket")
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"ticket": ticket})
 }
 
 func (server *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
@@ -283,6 +404,13 @@ func (server *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 		"var gotty_term = 'xterm';",
 		"var gotty_ws_query_args = '" + server.options.WSQueryArgs + "';",
 	}
+	if session := server.currentSession(r); session != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		lines = append(lines,
+			"var gotty_csrf_token = '"+server.sessions.CSRFToken(session)+"';",
+			"var gotty_logout_url = '"+server.pathPrefix+"auth/logout';",
+		)
+	}
 
 	w.Write([]byte(strings.Join(lines, "\n")))
 }
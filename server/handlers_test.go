@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth"
+)
+
+func TestHandleWSTicket(t *testing.T) {
+	server := &Server{logger: testLogger, options: &Options{}, tickets: auth.NewTicketIssuer(time.Minute)}
+	alice := &auth.Identity{User: "alice", Role: auth.RoleOperator, Method: "basic"}
+
+	r := httptest.NewRequest("GET", "http://term.example.com:8080/ws_ticket", nil)
+	r = r.WithContext(auth.NewContext(r.Context(), alice))
+	w := httptest.NewRecorder()
+	server.handleWSTicket(w, r)
+	if w.Code != 200 || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	// The page's websocket is opened from the origin the page came from.
+	id, err := server.tickets.Redeem(body.Ticket, "http://term.example.com:8080")
+	if err != nil {
+		t.Fatalf("expected the ticket to be redeemable from the page origin: %v", err)
+	}
+	if id.User != "alice" {
+		t.Errorf("expected the ticket to carry alice, got %+v", id)
+	}
+
+	// Without authentication there is nobody to issue a ticket to.
+	w = httptest.NewRecorder()
+	server.handleWSTicket(w, httptest.NewRequest("GET", "http://term.example.com/ws_ticket", nil))
+	if w.Code != 200 || w.Body.String() != "{\"ticket\":\"\"}\n" {
+		t.Errorf("expected an empty ticket, got %d %s", w.Code, w.Body)
+	}
+}
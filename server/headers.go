@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCSP allows the embedded pages and the CDNs they load Tailwind,
+// xterm.js and Lit from. Tailwind and xterm.js inject style elements, so
+// inline styles are allowed; inline scripts need the nonce of the request,
+// which replaces {nonce}.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}' https://cdn.tailwindcss.com https://cdn.jsdelivr.net; " +
+	"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+	"img-src 'self' data:; font-src 'self' data: https://cdn.jsdelivr.net; " +
+	"connect-src 'self'; manifest-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+// maxCSPReportSize limits the violation reports read.
+const maxCSPReportSize = 64 * 1024
+
+type cspNonceKey struct{}
+
+// cspNonce returns the nonce inline scripts of the response to r need.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// contentSecurityPolicy returns the policy of the server, {nonce} left to
+// be replaced per response.
+func (server *Server) contentSecurityPolicy() string {
+	policy := server.options.CSP
+	if policy == "" {
+		policy = defaultCSP
+		if server.options.FrameAncestors != "" {
+			policy += "; frame-ancestors " + server.options.FrameAncestors
+		}
+	}
+	if !strings.Contains(policy, "report-uri") {
+		policy += "; report-uri " + server.pathPrefix + "csp-report"
+	}
+	return policy
+}
+
+// setSecurityHeaders sets the security headers of the response to r and
+// returns r with the nonce of the policy in its context.
+func (server *Server) setSecurityHeaders(w http.ResponseWriter, r *http.Request) *http.Request {
+	header := w.Header()
+	nonce := randomToken()
+	policy := strings.ReplaceAll(server.contentSecurityPolicy(), "{nonce}", nonce)
+	if server.options.CSPReportOnly {
+		header.Set("Content-Security-Policy-Report-Only", policy)
+	} else {
+		header.Set("Content-Security-Policy", policy)
+	}
+	// For browsers without frame-ancestors.
+	switch server.options.FrameAncestors {
+	case "'none'":
+		header.Set("X-Frame-Options", "DENY")
+	case "'self'":
+		header.Set("X-Frame-Options", "SAMEORIGIN")
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	if server.options.ReferrerPolicy != "" {
+		header.Set("Referrer-Policy", server.options.ReferrerPolicy)
+	}
+	if server.options.HSTSMaxAge > 0 && server.requestScheme(r) == "https" {
+		header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(server.options.HSTSMaxAge))
+	}
+	return r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+}
+
+// handleCSPReport logs the policy violations browsers report.
+func (server *Server) handleCSPReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	server.logger.Warn("Content-Security-Policy violation", "ip", server.clientIP(r), "report", string(report))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	trusted, _ := parseTrustedProxies("10.0.0.1")
+	server := &Server{
+		logger: testLogger,
+		options: &Options{
+			SecurityHeaders: true,
+			FrameAncestors:  "'none'",
+			HSTSMaxAge:      600,
+			ReferrerPolicy:  "no-referrer",
+		},
+		trustedProxies: trusted,
+		pathPrefix:     "/",
+	}
+	var nonce string
+	handler := server.wrapHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = cspNonce(r)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	csp := w.Header().Get("Content-Security-Policy")
+	if nonce == "" || !strings.Contains(csp, "'nonce-"+nonce+"'") {
+		t.Errorf("expected the nonce %q in the policy %q", nonce, csp)
+	}
+	if !strings.Contains(csp, "frame-ancestors 'none'") || !strings.Contains(csp, "report-uri /csp-report") {
+		t.Errorf("unexpected policy %q", csp)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("expected no HSTS over HTTP, got %q", hsts)
+	}
+
+	// HTTPS terminated by a trusted proxy.
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "max-age=600" {
+		t.Errorf("expected HSTS behind a TLS proxy, got %q", hsts)
+	}
+
+	server.options.CSPReportOnly = true
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Header().Get("Content-Security-Policy") != "" || w.Header().Get("Content-Security-Policy-Report-Only") == "" {
+		t.Errorf("expected a report-only policy, got %v", w.Header())
+	}
+}
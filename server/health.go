@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// healthCheck is the result of one readiness check.
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// serverStatus is the detailed status served to authenticated clients.
+type serverStatus struct {
+	Ready       bool          `json:"ready"`
+	Checks      []healthCheck `json:"checks"`
+	Started     time.Time     `json:"started"`
+	Uptime      float64       `json:"uptime"`
+	Addresses   []string      `json:"addresses,omitempty"`
+	Session     string        `json:"session,omitempty"`
+	Connections int           `json:"connections"`
+	TLSExpires  *time.Time    `json:"tls_expires,omitempty"`
+}
+
+// psmuxHealthTTL is how long the results of the psmux checks are reused.
+// Readiness needs no credentials, so without it every request would start
+// psmux processes.
+const psmuxHealthTTL = 5 * time.Second
+
+// psmuxHealth caches the results of the checks that run psmux. Requests
+// arriving while they run wait for their results.
+type psmuxHealth struct {
+	mu         sync.Mutex
+	checked    time.Time
+	ping       error
+	hasSession error
+}
+
+// psmuxChecks returns whether psmux responds and the session exists, as
+// checked at most psmuxHealthTTL ago.
+func (server *Server) psmuxChecks() (ping, hasSession error) {
+	health := &server.psmuxHealth
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.checked.IsZero() || time.Since(health.checked) >= psmuxHealthTTL {
+		health.ping = server.psmuxCtrl.Ping()
+		health.hasSession = server.psmuxCtrl.HasSession()
+		health.checked = time.Now()
+	}
+	return health.ping, health.hasSession
+}
+
+// readinessChecks checks that the server accepts connections with a valid
+// certificate, unless an application embedding it does, and, when serving
+// psmux, that psmux responds, the session exists and the last layout
+// refresh succeeded.
+func (server *Server) readinessChecks() []healthCheck {
+	var checks []healthCheck
+	check := func(name string, err error) {
+		result := healthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		checks = append(checks, result)
+	}
+
+	if server.ownsListeners {
+		var err error
+		if !server.listening.Load() {
+			err = errors.New("not accepting connections")
+		}
+		check("listener", err)
+	}
+	if server.servesTLS() {
+		err := certificateError(nil, time.Now())
+		for _, certificate := range server.certificates {
+			if err = certificateError(certificate, time.Now()); err != nil {
+				break
+			}
+		}
+		check("tls", err)
+	}
+	if server.psmuxSession == "" {
+		return checks
+	}
+	if server.psmuxCtrl == nil {
+		check("psmux", errors.New("psmux controller is not running"))
+		return checks
+	}
+	ping, hasSession := server.psmuxChecks()
+	check("psmux", ping)
+	check("session", hasSession)
+	if server.layouts != nil {
+		_, err := server.layouts.lastRefresh()
+		check("layout", err)
+	}
+	return checks
+}
+
+// servesTLS reports whether a listener the server serves TLS on is bound.
+// An application embedding the server owns its listeners and their
+// certificates.
+func (server *Server) servesTLS() bool {
+	if !server.ownsListeners {
+		return false
+	}
+	for _, config := range server.bound {
+		if config.tls {
+			return true
+		}
+	}
+	return false
+}
+
+func ready(checks []healthCheck) bool {
+	for _, check := range checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// handleHealthz answers as long as the process serves requests.
+func (server *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers 503 if any readiness check fails. It needs no
+// credentials, so it names the checks without their errors.
+func (server *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := server.readinessChecks()
+	results := make(map[string]bool, len(checks))
+	for _, check := range checks {
+		results[check.Name] = check.OK
+	}
+	status := http.StatusOK
+	if !ready(checks) {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, map[string]interface{}{"ready": status == http.StatusOK, "checks": results})
+}
+
+// apiStatus returns the readiness checks with their errors and what the
+// server is serving.
+func (server *Server) apiStatus(w http.ResponseWriter, r *http.Request, args []string) {
+	checks := server.readinessChecks()
+	status := serverStatus{
+		Ready:       ready(checks),
+		Checks:      checks,
+		Started:     server.started,
+		Uptime:      time.Since(server.started).Seconds(),
+		Addresses:   server.addresses,
+		Session:     server.psmuxSession,
+		Connections: server.connections.count(),
+	}
+	for _, certificate := range server.certificates {
+		if status.TLSExpires == nil || certificate.NotAfter.Before(*status.TLSExpires) {
+			expires := certificate.NotAfter
+			status.TLSExpires = &expires
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// loadCertificate loads the key pair served with TLS and returns its leaf
+// certificate.
+func loadCertificate(crtFile, keyFile string) (*x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load TLS certificate `%s`", crtFile)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse TLS certificate `%s`", crtFile)
+	}
+	return leaf, nil
+}
+
+// certificateError returns why cert is not valid at now, if it is not.
+func certificateError(cert *x509.Certificate, now time.Time) error {
+	switch {
+	case cert == nil:
+		return errors.New("no TLS certificate loaded")
+	case now.Before(cert.NotBefore):
+		return errors.Errorf("TLS certificate is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return errors.Errorf("TLS certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
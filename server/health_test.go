@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	ctrl := newFakeController()
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{EnableTLS: true},
+		psmuxSession:  "main",
+		psmuxCtrl:     ctrl,
+		connections:   newConnectionRegistry(),
+		started:       time.Now(),
+		ownsListeners: true,
+		bound:         []*listenerConfig{{address: "127.0.0.1:8443", tls: true}},
+		certificates:  []*x509.Certificate{newTestClientCert(t, "webpsmux.example.com")},
+	}
+	readyz := func() (int, map[string]bool) {
+		w := httptest.NewRecorder()
+		server.handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		var body struct {
+			Checks map[string]bool `json:"checks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, body.Checks
+	}
+
+	if code, checks := readyz(); code != http.StatusServiceUnavailable || checks["listener"] {
+		t.Errorf("expected 503 before listening, got %d %v", code, checks)
+	}
+
+	server.listening.Store(true)
+	if code, checks := readyz(); code != http.StatusOK || !checks["tls"] || !checks["session"] {
+		t.Errorf("expected 200, got %d %v", code, checks)
+	}
+
+	// The psmux checks are reused for a while, however often they are asked for.
+	ctrl.err = errors.New("can't find session main")
+	for i := 0; i < 3; i++ {
+		if code, _ := readyz(); code != http.StatusOK {
+			t.Fatalf("expected the cached checks to pass, got %d", code)
+		}
+	}
+	calls := 0
+	for _, call := range ctrl.calls {
+		if call == "has-session" {
+			calls++
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected psmux to be checked once, got %d times", calls)
+	}
+
+	server.psmuxHealth.checked = time.Time{}
+	code, checks := readyz()
+	if code != http.StatusServiceUnavailable || checks["session"] || !checks["psmux"] {
+		t.Errorf("expected 503 for a missing session, got %d %v", code, checks)
+	}
+
+	// The details are only in the authenticated status.
+	w := httptest.NewRecorder()
+	server.apiStatus(w, httptest.NewRequest("GET", "/api/status", nil), nil)
+	var status serverStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Ready || status.Session != "main" || status.TLSExpires == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+	for _, check := range status.Checks {
+		if check.Name == "session" && check.Error != "can't find session main" {
+			t.Errorf("expected the session error in the status, got %+v", check)
+		}
+	}
+}
+
+func TestReadyzTLSListeners(t *testing.T) {
+	configured := []*listenerConfig{{address: "127.0.0.1:8443", tls: true}}
+	hasTLSCheck := func(server *Server) bool {
+		for _, check := range server.readinessChecks() {
+			if check.Name == "tls" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// An application embedding the server serves it on its own listeners.
+	embedded := &Server{options: &Options{EnableTLS: true}, listeners: configured}
+	if hasTLSCheck(embedded) {
+		t.Error("expected no TLS check without own listeners")
+	}
+
+	// Sockets passed by systemd replace the configured listeners.
+	activated := &Server{
+		options:       &Options{EnableTLS: true},
+		ownsListeners: true,
+		listeners:     configured,
+		bound:         []*listenerConfig{{address: "127.0.0.1:8080"}},
+	}
+	activated.listening.Store(true)
+	if hasTLSCheck(activated) || !ready(activated.readinessChecks()) {
+		t.Errorf("expected only the bound plain listener to be checked, got %+v", activated.readinessChecks())
+	}
+
+	activated.bound = configured
+	if checks := activated.readinessChecks(); ready(checks) {
+		t.Errorf("expected a TLS listener without certificate to fail, got %+v", checks)
+	}
+}
+
+func TestCertificateError(t *testing.T) {
+	cert := newTestClientCert(t, "webpsmux.example.com")
+	if err := certificateError(cert, time.Now()); err != nil {
+		t.Errorf("expected a valid certificate, got %v", err)
+	}
+	if err := certificateError(cert, time.Now().Add(2*time.Hour)); err == nil {
+		t.Error("expected an expired certificate to fail")
+	}
+	if err := certificateError(cert, time.Now().Add(-2*time.Hour)); err == nil {
+		t.Error("expected a certificate that is not valid yet to fail")
+	}
+}
@@ -2,5 +2,6 @@ package server
 
 type InitMessage struct {
 	Arguments string `json:"Arguments,omitempty"`
+	// AuthToken carries the ticket issued by ws_ticket.
 	AuthToken string `json:"AuthToken,omitempty"`
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"webpsmux/pkg/psmux"
+)
+
+// layoutPollInterval is how often psmux is polled while anyone listens.
+const layoutPollInterval = 500 * time.Millisecond
+
+// layoutUpdate is delivered to hub subscribers whenever the layout changes.
+type layoutUpdate struct {
+	Layout *psmux.Layout
+	Events []psmux.Event
+}
+
+// layoutHub polls psmux on behalf of all websocket and event stream clients,
+// so change detection runs once per interval no matter how many are
+// connected.
+type layoutHub struct {
+	ctrl     psmuxController
+	interval time.Duration
+	logger   *slog.Logger
+	metrics  *serverMetrics
+
+	mu     sync.Mutex
+	subs   map[chan layoutUpdate]struct{}
+	layout *psmux.Layout
+	data   []byte
+	// refreshed is the time of the last refresh and refreshErr its error.
+	refreshed  time.Time
+	refreshErr error
+}
+
+func newLayoutHub(ctrl psmuxController, interval time.Duration, logger *slog.Logger, metrics *serverMetrics) *layoutHub {
+	return &layoutHub{
+		ctrl:     ctrl,
+		interval: interval,
+		logger:   logger,
+		metrics:  metrics,
+		subs:     make(map[chan layoutUpdate]struct{}),
+	}
+}
+
+// run polls until ctx is canceled. Polling is skipped while nobody is
+// subscribed.
+func (hub *layoutHub) run(ctx context.Context) {
+	ticker := time.NewTicker(hub.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hub.poll()
+		}
+	}
+}
+
+// poll refreshes the layout and notifies subscribers if it changed.
+func (hub *layoutHub) poll() {
+	hub.mu.Lock()
+	idle := len(hub.subs) == 0
+	hub.mu.Unlock()
+	if idle {
+		return
+	}
+
+	err := hub.ctrl.RefreshLayout()
+	if err != nil {
+		hub.logger.Debug("Failed to refresh psmux layout", "error", err)
+	}
+	hub.metrics.layoutRefreshed(err)
+	hub.mu.Lock()
+	hub.refreshed, hub.refreshErr = time.Now(), err
+	hub.mu.Unlock()
+	layout := hub.ctrl.GetLayout()
+	if layout == nil {
+		return
+	}
+	data, err := json.Marshal(layout)
+	if err != nil {
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if bytes.Equal(data, hub.data) {
+		return
+	}
+	update := layoutUpdate{
+		Layout: layout,
+		Events: psmux.Diff(hub.layout, layout),
+	}
+	hub.layout = layout
+	hub.data = data
+
+	for sub := range hub.subs {
+		select {
+		case sub <- update:
+		default:
+			hub.logger.Warn("Dropping layout update for a slow subscriber")
+		}
+	}
+}
+
+// lastRefresh returns the time and error of the last refresh, a zero time
+// if there was none yet.
+func (hub *layoutHub) lastRefresh() (time.Time, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return hub.refreshed, hub.refreshErr
+}
+
+// subscribe registers for layout updates and returns the layout they
+// follow, which subscribers start from; nil if psmux has not reported one
+// yet. The returned function must be called to unsubscribe.
+func (hub *layoutHub) subscribe() (<-chan layoutUpdate, *psmux.Layout, func()) {
+	sub := make(chan layoutUpdate, 16)
+
+	hub.ctrl.RefreshLayout()
+	layout := hub.ctrl.GetLayout()
+
+	hub.mu.Lock()
+	if hub.data == nil && layout != nil {
+		// The first subscriber sets the baseline, so that the next poll
+		// does not report the layout it starts from as a change.
+		if data, err := json.Marshal(layout); err == nil {
+			hub.layout, hub.data = layout, data
+		}
+	}
+	baseline := hub.layout
+	hub.subs[sub] = struct{}{}
+	hub.mu.Unlock()
+
+	return sub, baseline, func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		delete(hub.subs, sub)
+		if len(hub.subs) == 0 {
+			// Start from a fresh baseline next time rather than reporting
+			// everything that happened while nobody was listening.
+			hub.layout = nil
+			hub.data = nil
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/homedir"
+)
+
+// newLDAPAuthenticator returns the directory login configured in options.
+func newLDAPAuthenticator(options *Options) (*auth.LDAPAuthenticator, error) {
+	roles, err := auth.ParseRoleMap(options.LDAPRoles)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse LDAP roles")
+	}
+
+	// ldaps:// connections take the server name from the URL, but StartTLS
+	// needs to be told.
+	u, err := url.Parse(options.LDAPURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid LDAP URL `%s`", options.LDAPURL)
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname()}
+	if options.LDAPCAFile != "" {
+		path := homedir.Expand(options.LDAPCAFile)
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read LDAP CA file `%s`", path)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in LDAP CA file `%s`", path)
+		}
+	}
+
+	authenticator, err := auth.NewLDAPAuthenticator(auth.LDAPConfig{
+		URL:            options.LDAPURL,
+		StartTLS:       options.LDAPStartTLS,
+		TLSConfig:      tlsConfig,
+		BindDN:         options.LDAPBindDN,
+		BindPassword:   options.LDAPBindPassword,
+		BaseDN:         options.LDAPBaseDN,
+		UserFilter:     options.LDAPUserFilter,
+		GroupAttribute: options.LDAPGroupAttribute,
+		Roles:          roles,
+		CacheTTL:       time.Duration(options.LDAPCacheTTL) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	options.logger().Info("Using LDAP authentication", "url", options.LDAPURL)
+	return authenticator, nil
+}
+
+// isCredentialError reports whether an Authenticator rejected the user,
+// as opposed to failing to check the credentials.
+func isCredentialError(err error) bool {
+	return errors.Is(err, auth.ErrInvalidCredentials) || errors.Is(err, auth.ErrSecondFactorRequired)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/auth/ldaptest"
+)
+
+func TestLDAPStartTLS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "directory"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	directory := ldaptest.NewServer(ldaptest.Entry{
+		DN:         "CN=Alice,DC=corp,DC=example,DC=com",
+		Password:   "secret",
+		Attributes: map[string][]string{"sAMAccountName": {"alice"}},
+	})
+	defer directory.Close()
+	directory.EnableStartTLS(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+
+	authenticator, err := newLDAPAuthenticator(&Options{
+		LDAPURL:          directory.URL,
+		LDAPStartTLS:     true,
+		LDAPCAFile:       caFile,
+		LDAPBindDN:       "CN=Alice,DC=corp,DC=example,DC=com",
+		LDAPBindPassword: "secret",
+		LDAPBaseDN:       "DC=corp,DC=example,DC=com",
+		LDAPRoles:        "*=viewer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := authenticator.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatalf("expected alice to log in over StartTLS, got %v", err)
+	}
+	if identity.Role != auth.RoleViewer {
+		t.Errorf("expected viewer role, got %s", identity.Role)
+	}
+}
@@ -15,11 +15,16 @@ func listAddresses() (addresses []string) {
 	for _, iface := range ifaces {
 		ifAddrs, _ := iface.Addrs()
 		for _, ifAddr := range ifAddrs {
+			var ip net.IP
 			switch v := ifAddr.(type) {
 			case *net.IPNet:
-				addresses = append(addresses, v.IP.String())
+				ip = v.IP
 			case *net.IPAddr:
-				addresses = append(addresses, v.IP.String())
+				ip = v.IP
+			}
+			// Link-local addresses need a zone, which URLs cannot carry.
+			if ip != nil && !ip.IsLinkLocalUnicast() {
+				addresses = append(addresses, ip.String())
 			}
 		}
 	}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/homedir"
+)
+
+// unixAddressPrefix marks addresses that are paths of unix sockets.
+const unixAddressPrefix = "unix:"
+
+// listenerConfig is an address the server listens at, with its own TLS
+// and authentication settings.
+type listenerConfig struct {
+	// address is host:port, or unix:/path for a unix socket.
+	address string
+	tls     bool
+	crtFile string
+	keyFile string
+	// caFile, if set, requires client certificates signed by its CAs.
+	caFile string
+	// noAuth serves the listener without authentication.
+	noAuth bool
+}
+
+type listenerKey struct{}
+
+// requestListener returns the settings of the listener r came in on, nil
+// for requests an embedding application handed over.
+func requestListener(r *http.Request) *listenerConfig {
+	config, _ := r.Context().Value(listenerKey{}).(*listenerConfig)
+	return config
+}
+
+// unauthenticated reports whether r came in on a listener without
+// authentication.
+func unauthenticated(r *http.Request) bool {
+	config := requestListener(r)
+	return config != nil && config.noAuth
+}
+
+// url returns the URL of the listener for host:port, which is the address
+// unless that is a wildcard.
+func (config *listenerConfig) url(hostPort, path string) string {
+	scheme := "http"
+	if config.tls {
+		scheme = "https"
+	}
+	return scheme + "://" + hostPort + path
+}
+
+// defaultListenerConfig returns the listener of --address and --port with
+// the TLS settings of the server, which systemd sockets are served with as
+// well.
+func defaultListenerConfig(options *Options) *listenerConfig {
+	config := &listenerConfig{
+		address: options.Address,
+		tls:     options.EnableTLS,
+		crtFile: homedir.Expand(options.TLSCrtFile),
+		keyFile: homedir.Expand(options.TLSKeyFile),
+	}
+	if !strings.HasPrefix(config.address, unixAddressPrefix) {
+		config.address = net.JoinHostPort(options.Address, options.Port)
+	}
+	if options.EnableTLSClientAuth {
+		config.caFile = homedir.Expand(options.TLSCACrtFile)
+	}
+	return config
+}
+
+// listenerConfigs returns the listeners of --listen, or the one of
+// --address and --port if it is not set.
+func listenerConfigs(options *Options) ([]*listenerConfig, error) {
+	defaults := defaultListenerConfig(options)
+	if options.Listen == "" {
+		return []*listenerConfig{defaults}, nil
+	}
+	var configs []*listenerConfig
+	for _, spec := range strings.Split(options.Listen, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		config, err := parseListener(spec, defaults)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid listener `%s`", spec)
+		}
+		configs = append(configs, config)
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no listener given")
+	}
+	return configs, nil
+}
+
+// parseListener parses http://host:port, https://host:port or unix:/path
+// with the optional parameters crt, key and ca, which default to those of
+// the server, and auth=none.
+func parseListener(spec string, defaults *listenerConfig) (*listenerConfig, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	config := &listenerConfig{crtFile: defaults.crtFile, keyFile: defaults.keyFile, caFile: defaults.caFile}
+	switch u.Scheme {
+	case "http", "https":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, errors.New("the port is missing")
+		}
+		if u.Path != "" {
+			return nil, errors.New("listeners take no path, see --path")
+		}
+		config.address = u.Host
+		config.tls = u.Scheme == "https"
+	case "unix":
+		path := u.Opaque
+		if path == "" {
+			path = u.Path
+		}
+		if path == "" {
+			return nil, errors.New("the socket path is missing")
+		}
+		config.address = unixAddressPrefix + path
+	default:
+		return nil, errors.Errorf("unsupported scheme `%s`", u.Scheme)
+	}
+
+	query := u.Query()
+	if crt := query.Get("crt"); crt != "" {
+		config.crtFile = homedir.Expand(crt)
+	}
+	if key := query.Get("key"); key != "" {
+		config.keyFile = homedir.Expand(key)
+	}
+	if ca := query.Get("ca"); ca != "" {
+		config.caFile = homedir.Expand(ca)
+	}
+	if !config.tls {
+		config.caFile = ""
+	}
+	switch query.Get("auth") {
+	case "":
+	case "none":
+		config.noAuth = true
+	default:
+		return nil, errors.Errorf("unsupported auth `%s`, only none is", query.Get("auth"))
+	}
+	return config, nil
+}
+
+// boundListener is a listener with the settings it is served with.
+type boundListener struct {
+	net.Listener
+	config *listenerConfig
+}
+
+// listen opens the listeners of the server: the sockets systemd passed by
+// socket activation, or those configured.
+func (server *Server) listen() ([]boundListener, error) {
+	passed, err := systemdListeners()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to use the sockets passed by systemd")
+	}
+	var listeners []boundListener
+	if len(passed) > 0 {
+		config := defaultListenerConfig(server.options)
+		for _, listener := range passed {
+			server.logger.Info("Using the socket passed by systemd", "address", listener.Addr().String())
+			listeners = append(listeners, boundListener{listener, config})
+		}
+		return listeners, nil
+	}
+
+	for _, config := range server.listeners {
+		listener, err := server.listenAt(config.address)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, boundListener{listener, config})
+	}
+	return listeners, nil
+}
+
+// listenAt listens at a unix socket for addresses of the form unix:/path,
+// at a TCP port otherwise. Wildcard hosts listen on IPv6 as well as IPv4
+// where the system allows it.
+func (server *Server) listenAt(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, unixAddressPrefix); ok {
+		return listenUnix(path, server.options.SocketMode, server.options.SocketOwner)
+	}
+
+	if _, port, _ := net.SplitHostPort(address); port == "0" {
+		server.logger.Info("Port number configured to `0`, choosing a random port", "address", address)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen at `%s`", address)
+	}
+	return listener, nil
+}
+
+// listenUnix listens at a unix socket with the given octal file mode and
+// user[:group] owner. A socket left behind by a process that is gone is
+// replaced.
+func listenUnix(path, mode, owner string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return nil, errors.Errorf("invalid socket mode `%s`", mode)
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("socket `%s` is in use", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen at `%s`", path)
+	}
+	// Until then the umask applies, which usually denies others the write
+	// permission connecting needs.
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "failed to set the mode of socket `%s`", path)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, errors.Wrapf(err, "failed to set the owner of socket `%s`", path)
+		}
+	}
+	return listener, nil
+}
+
+// lookupOwner returns the IDs of a user[:group] or :group owner, -1 for
+// those not given.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	userName, groupName, _ := strings.Cut(owner, ":")
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid socket owner")
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, errors.Errorf("socket owner `%s` has no numeric ID", userName)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid socket group")
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, errors.Errorf("socket group `%s` has no numeric ID", groupName)
+		}
+	}
+	return uid, gid, nil
+}
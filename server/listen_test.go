@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"webpsmux/pkg/auth"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket modes and owners are not supported on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "webpsmux.sock")
+	owner := ""
+	if current, err := user.Current(); err == nil {
+		owner = current.Username
+	}
+
+	listener, err := listenUnix(path, "0600", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	if _, err := listenUnix(path, "0600", ""); err == nil {
+		t.Error("expected a socket in use to be refused")
+	}
+
+	// Peers on the socket are trusted proxies if configured so.
+	server := &Server{logger: testLogger, options: &Options{}, trustUnixPeers: trustsUnixPeers("127.0.0.1, unix")}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, server.clientIP(r))
+	})}
+	go srv.Serve(listener)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	r, _ := http.NewRequest("GET", "http://webpsmux/", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "198.51.100.7" {
+		t.Errorf("expected the forwarded client address, got %q", body)
+	}
+	client.CloseIdleConnections()
+	srv.Close()
+
+	// A socket left behind is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = listenUnix(path, "0660", "")
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced: %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenUnixInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webpsmux.sock")
+	if _, err := listenUnix(path, "rw-rw----", ""); err == nil {
+		t.Error("expected an invalid mode to be refused")
+	}
+	if _, err := listenUnix(path, "0660", "no-such-user-webpsmux"); err == nil {
+		t.Error("expected an unknown owner to be refused")
+	}
+}
+
+func TestListenerConfigs(t *testing.T) {
+	options := &Options{
+		Address:      "0.0.0.0",
+		Port:         "8080",
+		TLSCrtFile:   "/etc/webpsmux/server.crt",
+		TLSKeyFile:   "/etc/webpsmux/server.key",
+		TLSCACrtFile: "/etc/webpsmux/ca.crt",
+		Listen:       "http://127.0.0.1:8080?auth=none, https://192.168.1.10:8443?ca=/etc/webpsmux/lan-ca.crt,https://[::1]:8443,unix:/run/webpsmux.sock",
+	}
+	configs, err := listenerConfigs(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []listenerConfig{
+		{address: "127.0.0.1:8080", crtFile: "/etc/webpsmux/server.crt", keyFile: "/etc/webpsmux/server.key", noAuth: true},
+		{address: "192.168.1.10:8443", tls: true, crtFile: "/etc/webpsmux/server.crt", keyFile: "/etc/webpsmux/server.key", caFile: "/etc/webpsmux/lan-ca.crt"},
+		{address: "[::1]:8443", tls: true, crtFile: "/etc/webpsmux/server.crt", keyFile: "/etc/webpsmux/server.key"},
+		{address: "unix:/run/webpsmux.sock", crtFile: "/etc/webpsmux/server.crt", keyFile: "/etc/webpsmux/server.key"},
+	}
+	if len(configs) != len(expected) {
+		t.Fatalf("expected %d listeners, got %d", len(expected), len(configs))
+	}
+	for i := range expected {
+		if *configs[i] != expected[i] {
+			t.Errorf("listener %d: expected %+v, got %+v", i, expected[i], *configs[i])
+		}
+	}
+
+	// Without --listen, --address and --port.
+	options.Listen = ""
+	options.EnableTLS = true
+	options.EnableTLSClientAuth = true
+	configs, err = listenerConfigs(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 || configs[0].address != "0.0.0.0:8080" || !configs[0].tls || configs[0].caFile != "/etc/webpsmux/ca.crt" {
+		t.Errorf("unexpected default listener %+v", configs)
+	}
+
+	for _, listen := range []string{"127.0.0.1:8080", "http://127.0.0.1", "https://[::]:8443/terminal", "http://127.0.0.1:8080?auth=basic", "unix:", " , "} {
+		options.Listen = listen
+		if _, err := listenerConfigs(options); err == nil {
+			t.Errorf("expected %q to be refused", listen)
+		}
+	}
+}
+
+func TestUnauthenticatedListener(t *testing.T) {
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+	}
+	handler := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(config *listenerConfig) int {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), listenerKey{}, config))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := serve(&listenerConfig{address: "192.168.1.10:8080"}); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 on a listener with authentication, got %d", code)
+	}
+	if code := serve(&listenerConfig{address: "127.0.0.1:8080", noAuth: true}); code != http.StatusOK {
+		t.Errorf("expected 200 on a listener without authentication, got %d", code)
+	}
+}
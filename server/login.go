@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// loginEnabled reports whether users log in on a page, either the login
+// form or that of an OIDC provider.
+func (server *Server) loginEnabled() bool {
+	return server.oidc != nil || server.options.LoginForm
+}
+
+// loginRedirect sends browsers without a session to the login page and
+// rejects any other request.
+func (server *Server) loginRedirect(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		login := server.pathPrefix + "auth/login?return=" + url.QueryEscape(r.URL.RequestURI())
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// handleLogin serves the login form, or hands over to the OIDC provider.
+func (server *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if server.oidc != nil {
+		server.handleOIDCLogin(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		server.renderLogin(w, r, http.StatusOK, "", "", r.URL.Query().Get("return"))
+	case "POST":
+		server.handleLoginForm(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLoginForm checks the submitted credentials, with the same lockouts
+// as Basic Authentication, and starts a session.
+func (server *Server) handleLoginForm(w http.ResponseWriter, r *http.Request) {
+	ip := server.clientIP(r)
+	// Another site could otherwise log the browser in to an account of
+	// the attacker's and see what the victim types into it.
+	if server.crossSite(r) {
+		server.logger.Warn("Rejected cross-site login", "origin", r.Header.Get("Origin"), "site", r.Header.Get("Sec-Fetch-Site"), "ip", ip)
+		http.Error(w, "Cross-site login is not allowed", http.StatusForbidden)
+		return
+	}
+	user := r.PostFormValue("user")
+	if server.rejectLockedOut(w, ip, user) {
+		return
+	}
+
+	returnPath := r.PostFormValue("return")
+	// Users with two-factor authentication append the code to the
+	// password, as with Basic Authentication.
+	code := strings.ReplaceAll(r.PostFormValue("code"), " ", "")
+	identity, err := server.authenticator.Authenticate(user, r.PostFormValue("password")+code)
+	if err != nil && !isCredentialError(err) {
+		server.logger.Error("Login failed", "user", user, "ip", ip, "error", err)
+		server.renderLogin(w, r, http.StatusServiceUnavailable, "Login is unavailable, try again later", user, returnPath)
+		return
+	}
+	if err != nil {
+		server.limiter.recordFailure(ip, user)
+		server.loginFailed("form", user, ip, err)
+		// A missing code gets the same answer as a wrong password, which
+		// would otherwise confirm the password to whoever lacks the code.
+		server.renderLogin(w, r, http.StatusUnauthorized, "Invalid user name, password or code", user, returnPath)
+		return
+	}
+	server.limiter.recordSuccess(ip, user)
+
+	identity.Method = "form"
+	if err := server.startSession(w, r, identity); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	server.logger.Info("Login succeeded", "user", identity.User, "role", identity.Role.String(), "ip", ip)
+	server.loginSucceeded("form", identity, ip)
+	http.Redirect(w, r, server.safeReturnPath(returnPath), http.StatusSeeOther)
+}
+
+func (server *Server) renderLogin(w http.ResponseWriter, r *http.Request, status int, message, user, returnPath string) {
+	indexVars, err := server.indexVariables(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	indexVars["base"] = server.pathPrefix
+	indexVars["error"] = message
+	indexVars["user"] = user
+	indexVars["return"] = server.safeReturnPath(returnPath)
+
+	buf := new(bytes.Buffer)
+	if err := server.loginTemplate.Execute(buf, indexVars); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	noesctmpl "text/template"
+	"time"
+
+	"webpsmux/bindata"
+	"webpsmux/pkg/auth"
+)
+
+func newLoginTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	loginData, err := bindata.Fs.ReadFile("static/login.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &Options{
+		LoginForm:          true,
+		SessionLifetime:    3600,
+		SessionIdleTimeout: 600,
+	}
+	sessions, _ := newSessionCodec(options)
+	server := &Server{
+		logger:        testLogger,
+		options:       options,
+		authenticator: &auth.StaticCredential{User: "alice", Password: "secret"},
+		sessions:      sessions,
+		pathPrefix:    "/",
+		loginTemplate: template.Must(template.New("login").Parse(string(loginData))),
+		titleTemplate: noesctmpl.Must(noesctmpl.New("title").Parse("test")),
+		connections:   newConnectionRegistry(),
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+	}
+
+	protected := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, auth.FromContext(r.Context()).User)
+	}))
+	mux := http.NewServeMux()
+	mux.Handle("/", protected)
+	mux.HandleFunc("/auth/login", server.handleLogin)
+	mux.HandleFunc("/auth/logout", server.handleLogout)
+	return server, httptest.NewServer(mux)
+}
+
+func newCookieClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+func login(t *testing.T, client *http.Client, ts *httptest.Server, password string) *http.Response {
+	t.Helper()
+	resp, err := client.PostForm(ts.URL+"/auth/login", url.Values{
+		"user":     {"alice"},
+		"password": {password},
+		"return":   {"/?arg=1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestLoginForm(t *testing.T) {
+	_, ts := newLoginTestServer(t)
+	defer ts.Close()
+	client := newCookieClient()
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", ts.URL+"/", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/auth/login" || !strings.Contains(string(body), `name="password"`) {
+		t.Fatalf("expected to be shown the login form, got %s", resp.Request.URL)
+	}
+
+	if resp := login(t, client, ts, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong password, got %d", resp.StatusCode)
+	}
+
+	resp = login(t, client, ts, "secret")
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.RequestURI() != "/?arg=1" {
+		t.Fatalf("expected to return to the page after login, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+}
+
+func TestLoginFormTOTP(t *testing.T) {
+	server, ts := newLoginTestServer(t)
+	defer ts.Close()
+	store := auth.NewUserStore(filepath.Join(t.TempDir(), "users.hcl"))
+	store.SetPassword("alice", "secret")
+	secret, _, err := store.EnableTOTP("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.authenticator = store
+	client := newCookieClient()
+
+	resp, err := client.PostForm(ts.URL+"/auth/login", url.Values{"user": {"alice"}, "password": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// Without the code, a right password looks like a wrong one.
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), "Invalid user name, password or code") {
+		t.Fatalf("expected the generic error without a code, got %d %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), `name="code"`) {
+		t.Error("expected the form to ask for a code")
+	}
+
+	code, _ := auth.TOTPCode(secret, time.Now())
+	resp, err = client.PostForm(ts.URL+"/auth/login", url.Values{
+		"user":     {"alice"},
+		"password": {"secret"},
+		"code":     {code[:3] + " " + code[3:]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("expected password and code to log in, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+}
+
+func TestLoginFormRejectsCrossSite(t *testing.T) {
+	_, ts := newLoginTestServer(t)
+	defer ts.Close()
+
+	post := func(headers map[string]string) int {
+		form := url.Values{"user": {"alice"}, "password": {"secret"}}
+		req, _ := http.NewRequest("POST", ts.URL+"/auth/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := newCookieClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(map[string]string{"Origin": "https://evil.example"}); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a login from another origin, got %d", code)
+	}
+	if code := post(map[string]string{"Sec-Fetch-Site": "cross-site"}); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a cross-site login, got %d", code)
+	}
+	if code := post(map[string]string{"Origin": ts.URL, "Sec-Fetch-Site": "same-origin"}); code != http.StatusOK {
+		t.Errorf("expected a login from the login page to pass, got %d", code)
+	}
+}
+
+func TestSessionCSRF(t *testing.T) {
+	server, ts := newLoginTestServer(t)
+	defer ts.Close()
+	client := newCookieClient()
+	login(t, client, ts, "secret")
+
+	resp, err := client.Post(ts.URL+"/api/windows", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without a CSRF token, got %d", resp.StatusCode)
+	}
+
+	cookies := client.Jar.Cookies(mustParseURL(ts.URL))
+	session, err := server.sessions.Decode(cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/api/windows", strings.NewReader("{}"))
+	req.Header.Set(csrfHeader, server.sessions.CSRFToken(session))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the request with a CSRF token to pass, got %d", resp.StatusCode)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	server, ts := newLoginTestServer(t)
+	defer ts.Close()
+
+	session := auth.NewSession(&auth.Identity{User: "alice", Role: auth.RoleAdmin}, time.Hour)
+	session.LastSeen = time.Now().Add(-11 * time.Minute).Unix()
+	value, _ := server.sessions.Encode(session)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an idle session to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	server, ts := newLoginTestServer(t)
+	defer ts.Close()
+	client := newCookieClient()
+	login(t, client, ts, "secret")
+
+	cookies := client.Jar.Cookies(mustParseURL(ts.URL))
+	oldCookie := cookies[0]
+	session, _ := server.sessions.Decode(oldCookie.Value)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	remove := server.connections.add(&connection{
+		identity: session.Identity(),
+		cancel:   cancel,
+	})
+	defer remove()
+
+	resp, err := client.PostForm(ts.URL+"/auth/logout", url.Values{csrfField: {server.sessions.CSRFToken(session)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ctx.Err() == nil {
+		t.Error("expected the websocket of the user to be closed")
+	}
+	if len(client.Jar.Cookies(mustParseURL(ts.URL))) != 0 {
+		t.Error("expected the session cookie to be cleared")
+	}
+
+	// The old cookie must not work anymore, even if the browser kept it.
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req.AddCookie(oldCookie)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the logged out session to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/metrics"
+	"webpsmux/webtty"
+)
+
+// serverMetrics are the Prometheus metrics of the server. Its methods do
+// nothing on a nil receiver, so that callers need not check whether
+// metrics are enabled.
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	connections        *metrics.Counter
+	connectionDuration *metrics.Histogram
+	websocketBytes     *metrics.Counter
+	websocketMessages  *metrics.Counter
+	psmuxCommands      *metrics.Histogram
+	psmuxFailures      *metrics.Counter
+	layoutRefreshes    *metrics.Counter
+	logins             *metrics.Counter
+	lockouts           *metrics.Counter
+}
+
+// newServerMetrics returns the metrics of a server if options enable them.
+// active reports the number of open websocket connections.
+func newServerMetrics(options *Options, active func() int) *serverMetrics {
+	if !options.EnableMetrics && options.MetricsAddress == "" {
+		return nil
+	}
+	registry := metrics.NewRegistry()
+	registry.GaugeFunc("webpsmux_connections_active", "Open websocket connections.",
+		func() float64 { return float64(active()) })
+	return &serverMetrics{
+		registry: registry,
+		connections: registry.Counter("webpsmux_connections_total",
+			"Websocket connections opened."),
+		connectionDuration: registry.Histogram("webpsmux_connection_duration_seconds",
+			"Duration of closed websocket connections.",
+			[]float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600}),
+		websocketBytes: registry.Counter("webpsmux_websocket_bytes_total",
+			"Bytes of websocket messages by direction (in or out).", "direction"),
+		websocketMessages: registry.Counter("webpsmux_websocket_messages_total",
+			"Websocket messages by direction (in or out) and message type.", "direction", "type"),
+		psmuxCommands: registry.Histogram("webpsmux_psmux_command_duration_seconds",
+			"Latency of psmux commands by subcommand.", metrics.DurationBuckets, "command"),
+		psmuxFailures: registry.Counter("webpsmux_psmux_command_failures_total",
+			"Failed psmux commands by subcommand.", "command"),
+		layoutRefreshes: registry.Counter("webpsmux_layout_refreshes_total",
+			"Layout refreshes by result (success or failure).", "result"),
+		logins: registry.Counter("webpsmux_auth_attempts_total",
+			"Authentication attempts by method and result (success or failure).", "method", "result"),
+		lockouts: registry.Counter("webpsmux_lockouts_total",
+			"Lockouts imposed after failed logins by kind (ip, user or global).", "kind"),
+	}
+}
+
+// connected counts a new websocket connection.
+func (m *serverMetrics) connected() {
+	if m == nil {
+		return
+	}
+	m.connections.Inc()
+}
+
+// disconnected records a websocket connection that was open for duration.
+func (m *serverMetrics) disconnected(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.connectionDuration.Observe(duration.Seconds())
+}
+
+// websocketMessage counts a message received ("in") or sent ("out").
+func (m *serverMetrics) websocketMessage(direction string, message []byte) {
+	if m == nil || len(message) == 0 {
+		return
+	}
+	name := webtty.OutputName(message[0])
+	if direction == "in" {
+		name = webtty.InputName(message[0])
+	}
+	m.websocketMessages.Inc(direction, name)
+	m.websocketBytes.Add(float64(len(message)), direction)
+}
+
+// psmuxCommand records a psmux command run by the controller.
+func (m *serverMetrics) psmuxCommand(command string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.psmuxCommands.Observe(duration.Seconds(), command)
+	if err != nil {
+		m.psmuxFailures.Inc(command)
+	}
+}
+
+// layoutRefreshed counts a layout refresh that failed with err, if not nil.
+func (m *serverMetrics) layoutRefreshed(err error) {
+	if m == nil {
+		return
+	}
+	m.layoutRefreshes.Inc(outcome(err))
+}
+
+// login counts an authentication attempt through method that failed with
+// err, if not nil.
+func (m *serverMetrics) login(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.logins.Inc(method, outcome(err))
+}
+
+// lockedOut counts a lockout of kind "ip", "user" or "global".
+func (m *serverMetrics) lockedOut(kind string) {
+	if m == nil {
+		return
+	}
+	m.lockouts.Inc(kind)
+}
+
+// outcome is the result label of an attempt that failed with err, if not nil.
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// handleMetrics serves the metrics to admins on the main listener.
+func (server *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	identity := auth.FromContext(r.Context())
+	if isShareViewer(identity) || !identity.Allows(auth.RoleAdmin) || !identity.HasScope(auth.ScopeAdmin) {
+		http.Error(w, "Metrics are only available to admins", http.StatusForbidden)
+		return
+	}
+	server.metrics.registry.ServeHTTP(w, r)
+}
+
+// listenMetrics serves the metrics without authentication on the metrics
+// address until the returned server is closed.
+func (server *Server) listenMetrics() (*http.Server, error) {
+	listener, err := net.Listen("tcp", server.options.MetricsAddress)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen for metrics at `%s`", server.options.MetricsAddress)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.metrics.registry)
+	srv := &http.Server{Handler: mux}
+	server.logger.Info("Serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			server.logger.Error("Metrics server failed", "error", err)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+func TestMetrics(t *testing.T) {
+	connections := newConnectionRegistry()
+	metrics := newServerMetrics(&Options{EnableMetrics: true}, connections.count)
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{ipRules: []lockoutRule{{2, time.Minute}}, metrics: metrics}),
+		connections:   connections,
+		metrics:       metrics,
+	}
+	defer connections.add(&connection{})()
+	metrics.websocketMessage("in", []byte("1ls\r"))
+	metrics.websocketMessage("out", []byte("1output"))
+	metrics.psmuxCommand("list-panes", 20*time.Millisecond, nil)
+	metrics.psmuxCommand("kill-window", time.Millisecond, errors.New("window not found"))
+
+	handler := server.wrapBasicAuth(http.HandlerFunc(server.handleMetrics))
+	for _, password := range []string{"secret", "wrong", "wrong"} {
+		r := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+		r.RemoteAddr = "192.0.2.10:1234"
+		r.SetBasicAuth("admin", password)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	server.limiter.clear("", "")
+
+	r := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	for _, line := range []string{
+		`webpsmux_connections_active 1`,
+		`webpsmux_websocket_messages_total{direction="in",type="input"} 1`,
+		`webpsmux_websocket_bytes_total{direction="out"} 7`,
+		`webpsmux_psmux_command_duration_seconds_count{command="list-panes"} 1`,
+		`webpsmux_psmux_command_failures_total{command="kill-window"} 1`,
+		`webpsmux_auth_attempts_total{method="basic",result="failure"} 2`,
+		`webpsmux_auth_attempts_total{method="basic",result="success"} 2`,
+		`webpsmux_lockouts_total{kind="ip"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("expected %q in the metrics:\n%s", line, w.Body.String())
+		}
+	}
+
+	r = httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{User: "bob", Role: auth.RoleOperator}))
+	w = httptest.NewRecorder()
+	server.handleMetrics(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for operators, got %d", w.Code)
+	}
+}
+
+func TestMetricsWebsocketLogins(t *testing.T) {
+	tokens, err := auth.LoadTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &auth.Identity{User: "alice", Role: auth.RoleOperator, Method: "basic"}
+	token, _, err := tokens.Create(alice, "ci", auth.ScopeLayoutRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := newServerMetrics(&Options{EnableMetrics: true}, func() int { return 0 })
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{},
+		authenticator: &auth.StaticCredential{User: "alice", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+		tokens:        tokens,
+		tickets:       auth.NewTicketIssuer(time.Minute),
+		metrics:       metrics,
+	}
+
+	// The page's websocket redeems a ticket; its login was counted when
+	// the page authenticated.
+	ticket, err := server.tickets.Issue(alice, "http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.authenticateInit(&InitMessage{AuthToken: ticket}, wsPeer{identity: alice, origin: "http://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.authenticateInit(&InitMessage{AuthToken: token}, wsPeer{tokenOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Identity{User: "admin", Role: auth.RoleAdmin}))
+	w := httptest.NewRecorder()
+	server.handleMetrics(w, r)
+	if line := `webpsmux_auth_attempts_total{method="websocket",result="success"} 1`; !strings.Contains(w.Body.String(), line+"\n") {
+		t.Errorf("expected %q in the metrics:\n%s", line, w.Body.String())
+	}
+}
@@ -3,216 +3,115 @@ package server
 import (
 	"encoding/base64"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
-)
-
-// rateLimiter provides brute force protection for authentication
-type rateLimiter struct {
-	// Per-IP tracking
-	attempts map[string]*attemptInfo
-
-	// Global tracking (sliding window)
-	globalFailures    []time.Time
-	globalLockedUntil time.Time
-
-	mu sync.RWMutex
-}
-
-type attemptInfo struct {
-	failCount   int
-	lockedUntil time.Time
-}
-
-// Per-IP lockout thresholds
-var ipLockoutRules = []struct {
-	attempts int
-	duration time.Duration
-}{
-	{5, 1 * time.Minute},
-	{10, 5 * time.Minute},
-	{20, 15 * time.Minute},
-}
-
-// Global lockout thresholds (higher initial threshold)
-var globalLockoutRules = []struct {
-	failures int
-	duration time.Duration
-}{
-	{100, 2 * time.Minute},
-	{200, 10 * time.Minute},
-	{500, 30 * time.Minute},
-}
-
-const globalWindowDuration = 5 * time.Minute
-
-func newRateLimiter() *rateLimiter {
-	rl := &rateLimiter{
-		attempts:       make(map[string]*attemptInfo),
-		globalFailures: make([]time.Time, 0),
-	}
-
-	// Start cleanup goroutine
-	go rl.cleanupLoop()
-
-	return rl
-}
-
-// cleanupLoop periodically removes old entries
-func (rl *rateLimiter) cleanupLoop() {
-	ticker := time.NewTicker(5 * time.Minute)
-	for range ticker.C {
-		rl.cleanup()
-	}
-}
-
-// cleanup removes expired entries
-func (rl *rateLimiter) cleanup() {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	now := time.Now()
-	cutoff := now.Add(-30 * time.Minute)
-
-	// Clean up per-IP entries
-	for ip, info := range rl.attempts {
-		if info.lockedUntil.Before(cutoff) && info.failCount == 0 {
-			delete(rl.attempts, ip)
-		}
-	}
-
-	// Clean up global failures outside window
-	rl.pruneGlobalFailures(now)
-}
-
-// pruneGlobalFailures removes failures outside the sliding window
-func (rl *rateLimiter) pruneGlobalFailures(now time.Time) {
-	cutoff := now.Add(-globalWindowDuration)
-	newFailures := make([]time.Time, 0, len(rl.globalFailures))
-	for _, t := range rl.globalFailures {
-		if t.After(cutoff) {
-			newFailures = append(newFailures, t)
-		}
-	}
-	rl.globalFailures = newFailures
-}
-
-// checkLocked returns lockout duration if IP or global is locked
-func (rl *rateLimiter) checkLocked(ip string) (bool, time.Duration, string) {
-	rl.mu.RLock()
-	defer rl.mu.RUnlock()
-
-	now := time.Now()
-
-	// Check global lockout first
-	if now.Before(rl.globalLockedUntil) {
-		remaining := rl.globalLockedUntil.Sub(now)
-		return true, remaining, "global"
-	}
-
-	// Check per-IP lockout
-	if info, exists := rl.attempts[ip]; exists {
-		if now.Before(info.lockedUntil) {
-			remaining := info.lockedUntil.Sub(now)
-			return true, remaining, "ip"
-		}
-	}
-
-	return false, 0, ""
-}
-
-// recordFailure records a failed login attempt
-func (rl *rateLimiter) recordFailure(ip string) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	now := time.Now()
-
-	// Record per-IP failure
-	info, exists := rl.attempts[ip]
-	if !exists {
-		info = &attemptInfo{}
-		rl.attempts[ip] = info
-	}
-
-	// Reset if lockout expired
-	if now.After(info.lockedUntil) && info.failCount > 0 {
-		// Keep some history but allow attempts
-	}
-
-	info.failCount++
-
-	// Apply per-IP lockout
-	for _, rule := range ipLockoutRules {
-		if info.failCount >= rule.attempts {
-			info.lockedUntil = now.Add(rule.duration)
-		}
-	}
-
-	// Record global failure
-	rl.globalFailures = append(rl.globalFailures, now)
-	rl.pruneGlobalFailures(now)
-
-	// Check global lockout
-	failureCount := len(rl.globalFailures)
-	for _, rule := range globalLockoutRules {
-		if failureCount >= rule.failures {
-			rl.globalLockedUntil = now.Add(rule.duration)
-		}
-	}
-
-	log.Printf("Auth failure from %s (IP attempts: %d, global failures: %d)", ip, info.failCount, failureCount)
-}
 
-// recordSuccess resets the per-IP counter on successful login
-func (rl *rateLimiter) recordSuccess(ip string) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	if info, exists := rl.attempts[ip]; exists {
-		info.failCount = 0
-		info.lockedUntil = time.Time{}
-	}
-}
-
-// Global rate limiter instance
-var authRateLimiter = newRateLimiter()
+	"webpsmux/pkg/auth"
+)
 
 func (server *Server) wrapLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rw := &logResponseWriter{w, 200}
+		started := time.Now()
 		handler.ServeHTTP(rw, r)
-		log.Printf("%s %d %s %s", r.RemoteAddr, rw.status, r.Method, r.URL.Path)
+		server.logger.Info("HTTP request",
+			"ip", server.clientIP(r),
+			"status", rw.status,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"duration", time.Since(started),
+		)
 	})
 }
 
 func (server *Server) wrapHeaders(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Server", "WebPsmux")
+		if server.options.SecurityHeaders {
+			r = server.setSecurityHeaders(w, r)
+		}
 		handler.ServeHTTP(w, r)
 	})
 }
 
-func (server *Server) wrapBasicAuth(handler http.Handler, credential string) http.Handler {
+// wrapAuth authenticates requests by, in order, Options.Authenticate, an
+// API token, a mapped client certificate, the user header of a trusted
+// proxy, a session cookie, a share link cookie and Basic Authentication. With a login page or OIDC
+// enabled, browsers without credentials are sent to the login instead.
+// Requests made with a session cookie must carry its CSRF token unless they
+// are safe. If client certificates require a password, they only have to
+// match the user. Listeners with auth=none skip all of this.
+func (server *Server) wrapAuth(handler http.Handler) http.Handler {
+	unchecked := handler
+	requirePassword := server.options.TLSCertAndPassword
+	if requirePassword {
+		handler = server.requireCertUser(handler)
+	}
+	var basic http.Handler
+	if server.authenticator != nil {
+		basic = server.wrapBasicAuth(handler)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := extractClientIP(r)
-
-		// Check if locked out
-		if locked, remaining, lockType := authRateLimiter.checkLocked(ip); locked {
-			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
-			if lockType == "global" {
-				log.Printf("Global lockout active, rejected %s (retry in %v)", ip, remaining)
-				http.Error(w, "Too many failed login attempts. Service temporarily locked.", http.StatusTooManyRequests)
-			} else {
-				log.Printf("IP %s locked out (retry in %v)", ip, remaining)
-				http.Error(w, "Too many failed login attempts. Try again later.", http.StatusTooManyRequests)
+		if unauthenticated(r) {
+			unchecked.ServeHTTP(w, r)
+			return
+		}
+		if identity := server.embedderIdentity(r); identity != nil {
+			handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
+			return
+		}
+		if token, ok := bearerToken(r); ok && server.tokens != nil {
+			if identity, ok := server.authenticateBearer(w, r, token); ok {
+				handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
 			}
 			return
 		}
+		if identity := server.certIdentity(r); identity != nil && !requirePassword {
+			handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
+			return
+		}
+		if identity := server.proxyIdentity(r); identity != nil {
+			handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
+			return
+		}
+		if session := server.currentSession(r); session != nil {
+			if !server.checkCSRF(r, session) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			server.touchSession(w, r, session)
+			handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), session.Identity())))
+			return
+		}
+		if identity := server.shareIdentity(r); identity != nil {
+			handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
+			return
+		}
+
+		switch {
+		case server.loginEnabled() && (basic == nil || r.Header.Get("Authorization") == ""):
+			server.loginRedirect(w, r)
+		case basic != nil:
+			basic.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+	})
+}
+
+// embedderIdentity returns the identity Options.Authenticate gives r.
+func (server *Server) embedderIdentity(r *http.Request) *auth.Identity {
+	if server.options.Authenticate == nil {
+		return nil
+	}
+	return server.options.Authenticate(r)
+}
+
+func (server *Server) wrapBasicAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := server.clientIP(r)
 
 		token := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 
@@ -227,29 +126,76 @@ func (server *Server) wrapBasicAuth(handler http.Handler, credential string) htt
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		user, password, _ := strings.Cut(string(payload), ":")
+
+		if server.rejectLockedOut(w, ip, user) {
+			return
+		}
 
-		if credential != string(payload) {
-			authRateLimiter.recordFailure(ip)
+		identity, err := server.authenticator.Authenticate(user, password)
+		if err != nil && !isCredentialError(err) {
+			server.logger.Error("Basic Authentication failed", "user", user, "ip", ip, "error", err)
+			http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			server.limiter.recordFailure(ip, user)
+			server.loginFailed("basic", user, ip, err)
 			w.Header().Set("WWW-Authenticate", `Basic realm="WebPsmux"`)
 			http.Error(w, "Authorization failed", http.StatusUnauthorized)
 			return
 		}
 
 		// Success - reset IP counter
-		authRateLimiter.recordSuccess(ip)
-		log.Printf("Basic Authentication Succeeded: %s", r.RemoteAddr)
-		handler.ServeHTTP(w, r)
+		server.limiter.recordSuccess(ip, user)
+		server.metrics.login("basic", nil)
+		server.logger.Debug("Basic Authentication succeeded", "user", identity.User, "role", identity.Role.String(), "ip", ip)
+		handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
 	})
 }
 
-func extractClientIP(r *http.Request) string {
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		first := strings.TrimSpace(strings.Split(forwarded, ",")[0])
-		if first != "" {
-			if host, _, err := net.SplitHostPort(first); err == nil {
-				return strings.Trim(host, "[]")
+// rejectLockedOut answers 429 and returns true if ip or user may not try
+// to log in at the moment.
+func (server *Server) rejectLockedOut(w http.ResponseWriter, ip, user string) bool {
+	locked, remaining, lockType := server.limiter.checkLocked(ip, user)
+	if !locked {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+	switch lockType {
+	case "global":
+		server.logger.Warn("Global lockout active, rejected login", "ip", ip, "retry_in", remaining)
+		http.Error(w, "Too many failed login attempts. Service temporarily locked.", http.StatusTooManyRequests)
+	case "user":
+		server.logger.Warn("User locked out, rejected login", "user", user, "ip", ip, "retry_in", remaining)
+		http.Error(w, "Too many failed login attempts. Try again later.", http.StatusTooManyRequests)
+	default:
+		server.logger.Warn("IP locked out, rejected login", "ip", ip, "retry_in", remaining)
+		http.Error(w, "Too many failed login attempts. Try again later.", http.StatusTooManyRequests)
+	}
+	return true
+}
+
+// clientIP returns the address of the client. X-Forwarded-For and X-Real-IP
+// are only honoured when the peer is a trusted proxy; X-Forwarded-For is read
+// from the right, skipping further trusted proxies, so a client cannot
+// prepend addresses of its choosing.
+func (server *Server) clientIP(r *http.Request) string {
+	peer := remoteIP(r.RemoteAddr)
+	if !server.isTrustedProxy(peer) {
+		return peer
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := remoteIP(strings.TrimSpace(hops[i]))
+			if hop == "" {
+				continue
+			}
+			if i == 0 || !server.isTrustedProxy(hop) {
+				return hop
 			}
-			return strings.Trim(first, "[]")
 		}
 	}
 
@@ -257,10 +203,13 @@ func extractClientIP(r *http.Request) string {
 		return strings.Trim(realIP, "[]")
 	}
 
-	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
-	if err == nil {
+	return peer
+}
+
+// remoteIP strips the port and brackets from an address.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
 		return strings.Trim(host, "[]")
 	}
-
-	return strings.Trim(strings.TrimSpace(r.RemoteAddr), "[]")
+	return strings.Trim(addr, "[]")
 }
@@ -1,11 +1,22 @@
 package server
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/auth/ldaptest"
 )
 
-func TestExtractClientIP(t *testing.T) {
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{logger: testLogger, options: &Options{}, trustedProxies: trusted}
+
 	tests := []struct {
 		name       string
 		remoteAddr string
@@ -17,7 +28,11 @@ func TestExtractClientIP(t *testing.T) {
 		{name: "remote ipv6", remoteAddr: "[2001:db8::1]:1234", expected: "2001:db8::1"},
 		{name: "xff takes priority", remoteAddr: "10.0.0.1:1234", xff: "192.168.1.2, 10.0.0.1", expected: "192.168.1.2"},
 		{name: "xff with port", remoteAddr: "10.0.0.1:1234", xff: "[2001:db8::2]:4567", expected: "2001:db8::2"},
+		{name: "xff spoofed by client", remoteAddr: "[::1]:1234", xff: "1.1.1.1, 192.168.1.2", expected: "192.168.1.2"},
+		{name: "xff only trusted hops", remoteAddr: "10.0.0.1:1234", xff: "10.0.0.3, 10.0.0.2", expected: "10.0.0.3"},
 		{name: "x-real-ip fallback", remoteAddr: "10.0.0.1:1234", xri: "172.16.1.3", expected: "172.16.1.3"},
+		{name: "xff from untrusted peer", remoteAddr: "192.0.2.7:1234", xff: "1.1.1.1", expected: "192.0.2.7"},
+		{name: "x-real-ip from untrusted peer", remoteAddr: "192.0.2.7:1234", xri: "1.1.1.1", expected: "192.0.2.7"},
 	}
 
 	for _, tc := range tests {
@@ -31,9 +46,140 @@ func TestExtractClientIP(t *testing.T) {
 				r.Header.Set("X-Real-IP", tc.xri)
 			}
 
-			if got := extractClientIP(r); got != tc.expected {
+			if got := server.clientIP(r); got != tc.expected {
 				t.Fatalf("expected %q, got %q", tc.expected, got)
 			}
 		})
 	}
 }
+
+func TestProxyUserHeader(t *testing.T) {
+	trusted, _ := parseTrustedProxies("127.0.0.1")
+	server := &Server{
+		logger:         testLogger,
+		options:        &Options{ProxyUserHeader: "X-Forwarded-User", ProxyUserRole: "operator"},
+		trustedProxies: trusted,
+		authenticator:  &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:        newRateLimiter(rateLimiterConfig{}),
+	}
+	var got *auth.Identity
+	handler := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-User", "alice")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got == nil || got.User != "alice" || got.Role != auth.RoleOperator {
+		t.Fatalf("expected alice as operator, got %d %+v", w.Code, got)
+	}
+
+	got = nil
+	r.RemoteAddr = "192.0.2.10:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || got != nil {
+		t.Fatalf("expected the header to be ignored from an untrusted peer, got %d %+v", w.Code, got)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+	if _, err := parseTrustedProxies("localhost"); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+	nets, err := parseTrustedProxies("127.0.0.1, ::1, 192.168.0.0/16,")
+	if err != nil || len(nets) != 3 {
+		t.Errorf("expected three networks, got %v, %v", nets, err)
+	}
+}
+
+func TestWrapBasicAuth(t *testing.T) {
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+	}
+	var got *auth.Identity
+	handler := server.wrapBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+	r.RemoteAddr = "192.0.2.10:1234"
+	r.SetBasicAuth("admin", "wrong")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong password, got %d", w.Code)
+	}
+
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got == nil || got.User != "admin" || got.Role != auth.RoleAdmin {
+		t.Errorf("expected admin identity in the request context, got %+v", got)
+	}
+}
+
+func TestWrapBasicAuthLDAP(t *testing.T) {
+	directory := ldaptest.NewServer(ldaptest.Entry{
+		DN:       "CN=Alice,DC=corp,DC=example,DC=com",
+		Password: "secret",
+		Attributes: map[string][]string{
+			"userPrincipalName": {"alice@corp.example.com"},
+			"memberOf":          {"CN=Terminal Operators,DC=corp,DC=example,DC=com"},
+		},
+	})
+	defer directory.Close()
+
+	options := &Options{
+		LDAPURL:        directory.URL,
+		LDAPBaseDN:     "DC=corp,DC=example,DC=com",
+		LDAPUserFilter: "(userPrincipalName=%s)",
+		LDAPRoles:      "Terminal Operators=operator",
+	}
+	authenticator, err := newAuthenticator(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		logger:        testLogger,
+		options:       options,
+		authenticator: authenticator,
+		limiter:       newRateLimiter(rateLimiterConfig{userRules: []lockoutRule{{1, time.Minute}}}),
+	}
+	var got *auth.Identity
+	handler := server.wrapBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+	r.SetBasicAuth("alice@corp.example.com", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got == nil || got.Role != auth.RoleOperator || got.Method != "ldap" {
+		t.Fatalf("expected alice to log in as operator, got %d %+v", w.Code, got)
+	}
+
+	// An unreachable directory is not the user's fault and must not lock
+	// the account.
+	directory.Close()
+	server.authenticator, _ = auth.NewLDAPAuthenticator(auth.LDAPConfig{URL: directory.URL, BaseDN: "DC=corp"})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the directory is down, got %d", w.Code)
+	}
+	if locked, _, _ := server.limiter.checkLocked("192.0.2.1", "alice@corp.example.com"); locked {
+		t.Error("expected the outage not to count as a failed login")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+const (
+	oidcStateCookieName = "webpsmux_oidc"
+
+	// oidcStateLifetime bounds the time a user may spend at the provider.
+	oidcStateLifetime = 10 * time.Minute
+	// oidcDiscoveryTimeout bounds fetching the provider metadata at startup.
+	oidcDiscoveryTimeout = 30 * time.Second
+)
+
+// oidcState is kept in a signed cookie between the login redirect and the
+// callback.
+type oidcState struct {
+	State   string `json:"s"`
+	Nonce   string `json:"n"`
+	Return  string `json:"r"`
+	Expires int64  `json:"e"`
+}
+
+// newOIDCProvider discovers the provider configured in options.
+func newOIDCProvider(options *Options) (*auth.OIDCProvider, error) {
+	roles, err := auth.ParseRoleMap(options.OIDCRoles)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse OIDC roles")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcDiscoveryTimeout)
+	defer cancel()
+	provider, err := auth.NewOIDCProvider(ctx, auth.OIDCConfig{
+		Issuer:       options.OIDCIssuer,
+		ClientID:     options.OIDCClientID,
+		ClientSecret: options.OIDCClientSecret,
+		Scopes:       strings.Fields(options.OIDCScopes),
+		RoleClaim:    options.OIDCRoleClaim,
+		Roles:        roles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	options.logger().Info("Using OpenID Connect login", "issuer", options.OIDCIssuer)
+	return provider, nil
+}
+
+// handleOIDCLogin sends the user to the OIDC provider.
+func (server *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	state := oidcState{
+		State:   randomToken(),
+		Nonce:   randomToken(),
+		Return:  server.safeReturnPath(r.URL.Query().Get("return")),
+		Expires: time.Now().Add(oidcStateLifetime).Unix(),
+	}
+	value, err := server.sessions.Seal(state)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	server.setCookie(w, r, oidcStateCookieName, value, time.Unix(state.Expires, 0))
+	http.Redirect(w, r, server.oidc.AuthCodeURL(server.oidcRedirectURL(r), state.State, state.Nonce), http.StatusFound)
+}
+
+// handleCallback completes the login when the provider redirects back.
+func (server *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		server.logger.Warn("OIDC login failed", "ip", server.clientIP(r), "error", errCode, "description", query.Get("error_description"))
+		server.loginFailed("oidc", "", server.clientIP(r), errors.New(errCode))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err == nil {
+		err = server.sessions.Open(cookie.Value, &state)
+	}
+	if err != nil || time.Now().After(time.Unix(state.Expires, 0)) ||
+		subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	server.setCookie(w, r, oidcStateCookieName, "", time.Unix(0, 0))
+
+	identity, err := server.oidc.Exchange(r.Context(), query.Get("code"), server.oidcRedirectURL(r), state.Nonce)
+	if err != nil {
+		server.logger.Warn("OIDC login failed", "ip", server.clientIP(r), "error", err)
+		server.loginFailed("oidc", "", server.clientIP(r), err)
+		if err == auth.ErrInvalidCredentials {
+			http.Error(w, "You are not permitted to use this terminal", http.StatusForbidden)
+		} else {
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	if err := server.startSession(w, r, identity); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	server.logger.Info("OIDC login succeeded", "user", identity.User, "role", identity.Role.String(), "ip", server.clientIP(r))
+	server.loginSucceeded("oidc", identity, server.clientIP(r))
+	http.Redirect(w, r, state.Return, http.StatusFound)
+}
+
+// oidcRedirectURL is the callback URL registered with the provider.
+// Unless configured it is derived from the request, taking the headers of
+// trusted proxies into account.
+func (server *Server) oidcRedirectURL(r *http.Request) string {
+	if server.options.OIDCRedirectURL != "" {
+		return server.options.OIDCRedirectURL
+	}
+	return server.requestScheme(r) + "://" + server.requestHost(r) + server.pathPrefix + "auth/callback"
+}
+
+// safeReturnPath only lets the login return to a path below the base path,
+// so it cannot be used as an open redirect.
+func (server *Server) safeReturnPath(path string) string {
+	if !strings.HasPrefix(path, server.pathPrefix) || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		return server.pathPrefix
+	}
+	return path
+}
+
+func randomToken() string {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/auth/oidctest"
+)
+
+func newOIDCTestServer(t *testing.T, idp *oidctest.Provider, roles string) *httptest.Server {
+	t.Helper()
+	options := &Options{
+		OIDCIssuer:       idp.Issuer(),
+		OIDCClientID:     idp.ClientID,
+		OIDCClientSecret: idp.ClientSecret,
+		OIDCRoleClaim:    "email",
+		OIDCRoles:        roles,
+		SessionSecret:    "test secret",
+		SessionLifetime:  3600,
+	}
+	provider, err := newOIDCProvider(options)
+	if err != nil {
+		t.Fatalf("failed to set up provider: %v", err)
+	}
+	sessions, _ := newSessionCodec(options)
+	server := &Server{logger: testLogger, options: options, oidc: provider, sessions: sessions, pathPrefix: "/"}
+
+	protected := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := auth.FromContext(r.Context())
+		io.WriteString(w, identity.User+" "+identity.Role.String())
+	}))
+	mux := http.NewServeMux()
+	mux.Handle("/", protected)
+	mux.HandleFunc("/auth/login", server.handleLogin)
+	mux.HandleFunc("/auth/callback", server.handleCallback)
+	return httptest.NewServer(mux)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := oidctest.NewProvider("webpsmux", "s3cret")
+	defer idp.Close()
+	ts := newOIDCTestServer(t, idp, "user@example.com=operator")
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// A script without a session is refused rather than redirected.
+	resp, err := client.Get(ts.URL + "/api/layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %d", resp.StatusCode)
+	}
+
+	// A browser is sent through the provider and back to the page.
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", ts.URL+"/?arg=1", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "user@example.com operator" {
+		t.Fatalf("expected to be logged in, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Request.URL.RequestURI() != "/?arg=1" {
+		t.Errorf("expected to return to the original page, got %s", resp.Request.URL)
+	}
+
+	// The session cookie now authenticates other requests, such as the
+	// websocket upgrade.
+	resp, err = client.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the session cookie to be accepted, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCLoginDenied(t *testing.T) {
+	idp := oidctest.NewProvider("webpsmux", "s3cret")
+	defer idp.Close()
+	ts := newOIDCTestServer(t, idp, "someone-else@example.com=admin")
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(ts.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a user without a role, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCCallbackWithoutState(t *testing.T) {
+	idp := oidctest.NewProvider("webpsmux", "s3cret")
+	defer idp.Close()
+	ts := newOIDCTestServer(t, idp, "*=viewer")
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/auth/callback?code=abc&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a callback without login state, got %d", resp.StatusCode)
+	}
+}
+
+func TestSafeReturnPath(t *testing.T) {
+	server := &Server{logger: testLogger, pathPrefix: "/term/"}
+	tests := map[string]string{
+		"/term/?a=b":          "/term/?a=b",
+		"/other/":             "/term/",
+		"//evil.example.com/": "/term/",
+		"https://evil.com/":   "/term/",
+		"":                    "/term/",
+	}
+	for in, expected := range tests {
+		if got := server.safeReturnPath(in); got != expected {
+			t.Errorf("safeReturnPath(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
@@ -1,16 +1,62 @@
 package server
 
 import (
+	"log/slog"
+	"net/http"
+
 	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
 )
 
 type Options struct {
-	Address             string `hcl:"address" flagName:"address" flagSName:"a" flagDescribe:"IP address to listen" default:"0.0.0.0"`
+	Address             string `hcl:"address" flagName:"address" flagSName:"a" flagDescribe:"IP address to listen, or unix:/path/to.sock for a unix socket" default:"0.0.0.0"`
 	Port                string `hcl:"port" flagName:"port" flagSName:"p" flagDescribe:"Port number to liten" default:"8080"`
+	Listen              string `hcl:"listen" flagName:"listen" flagDescribe:"Comma separated listeners replacing --address and --port: http://host:port, https://host:port or unix:/path, optionally with crt, key, ca and auth=none parameters (ex: http://127.0.0.1:8080,https://[::]:8443?ca=ca.crt)" default:""`
+	SocketMode          string `hcl:"socket_mode" flagName:"socket-mode" flagDescribe:"Octal file mode of a unix socket" default:"0660"`
+	SocketOwner         string `hcl:"socket_owner" flagName:"socket-owner" flagDescribe:"Owner of a unix socket as user[:group] or :group" default:""`
 	Path                string `hcl:"path" flagName:"path" flagSName:"m" flagDescribe:"Base path" default:"/"`
 	PermitWrite         bool   `hcl:"permit_write" flagName:"permit-write" flagSName:"w" flagDescribe:"Permit clients to write to the TTY (BE CAREFUL)" default:"false"`
 	EnableBasicAuth     bool   `hcl:"enable_basic_auth" default:"true"`
 	Credential          string `hcl:"credential" flagName:"credential" flagSName:"c" flagDescribe:"Credential for Basic Authentication (ex: user:pass)" default:""`
+	UsersFile           string `hcl:"users_file" flagName:"users-file" flagDescribe:"Users file with hashed passwords and roles for Basic Authentication (see 'passwd' command)" default:""`
+	LDAPURL             string `hcl:"ldap_url" flagName:"ldap-url" flagDescribe:"LDAP or Active Directory server for Basic Authentication (ex: ldaps://dc.corp.example.com)" default:""`
+	LDAPStartTLS        bool   `hcl:"ldap_start_tls" flagName:"ldap-start-tls" flagDescribe:"Upgrade ldap:// connections with StartTLS" default:"false"`
+	LDAPCAFile          string `hcl:"ldap_ca_file" flagName:"ldap-ca-file" flagDescribe:"CA certificate file to verify the LDAP server with (default: system roots)" default:""`
+	LDAPBindDN          string `hcl:"ldap_bind_dn" flagName:"ldap-bind-dn" flagDescribe:"Service account DN that searches for users (default: users bind with their login name)" default:""`
+	LDAPBindPassword    string `hcl:"ldap_bind_password" flagName:"ldap-bind-password" flagDescribe:"Password of the LDAP service account" default:""`
+	LDAPBaseDN          string `hcl:"ldap_base_dn" flagName:"ldap-base-dn" flagDescribe:"DN below which users are searched (ex: DC=corp,DC=example,DC=com)" default:""`
+	LDAPUserFilter      string `hcl:"ldap_user_filter" flagName:"ldap-user-filter" flagDescribe:"LDAP filter finding a user, %s is the login name" default:"(sAMAccountName=%s)"`
+	LDAPGroupAttribute  string `hcl:"ldap_group_attribute" flagName:"ldap-group-attribute" flagDescribe:"Attribute listing the groups of a user" default:"memberOf"`
+	LDAPRoles           string `hcl:"ldap_roles" flagName:"ldap-roles" flagDescribe:"Group names or DNs mapped to roles, * for any user (ex: 'Terminal Admins=admin,*=viewer')" default:""`
+	LDAPCacheTTL        int    `hcl:"ldap_cache_ttl" flagName:"ldap-cache-ttl" flagDescribe:"Seconds a successful LDAP login is cached (0 to disable)" default:"60"`
+	LoginForm           bool   `hcl:"login_form" flagName:"login-form" flagDescribe:"Log in on a page with session cookies instead of Basic Authentication" default:"false"`
+	OIDCIssuer          string `hcl:"oidc_issuer" flagName:"oidc-issuer" flagDescribe:"OpenID Connect issuer URL, enables login through the provider" default:""`
+	OIDCClientID        string `hcl:"oidc_client_id" flagName:"oidc-client-id" flagDescribe:"OpenID Connect client ID" default:""`
+	OIDCClientSecret    string `hcl:"oidc_client_secret" flagName:"oidc-client-secret" flagDescribe:"OpenID Connect client secret" default:""`
+	OIDCRedirectURL     string `hcl:"oidc_redirect_url" flagName:"oidc-redirect-url" flagDescribe:"OpenID Connect callback URL (default: derived from the request, <path>/auth/callback)" default:""`
+	OIDCScopes          string `hcl:"oidc_scopes" flagName:"oidc-scopes" flagDescribe:"Space separated OpenID Connect scopes requested besides openid" default:"email profile"`
+	OIDCRoleClaim       string `hcl:"oidc_role_claim" flagName:"oidc-role-claim" flagDescribe:"ID token claim mapped to roles (e.g. email or groups)" default:"email"`
+	OIDCRoles           string `hcl:"oidc_roles" flagName:"oidc-roles" flagDescribe:"Claim values mapped to roles, * for anyone (ex: admins=admin,devs=operator,*=viewer)" default:""`
+	SessionSecret       string `hcl:"session_secret" flagName:"session-secret" flagDescribe:"Secret signing session cookies (default: random, sessions end on restart)" default:""`
+	SessionLifetime     int    `hcl:"session_lifetime" flagName:"session-lifetime" flagDescribe:"Lifetime of login sessions in seconds" default:"43200"`
+	SessionIdleTimeout  int    `hcl:"session_idle_timeout" flagName:"session-idle-timeout" flagDescribe:"Seconds after which an unused login session ends (0 to disable)" default:"3600"`
+	TrustedProxies      string `hcl:"trusted_proxies" flagName:"trusted-proxies" flagDescribe:"Comma separated addresses or CIDRs of reverse proxies whose forwarding headers are trusted, unix for peers on unix sockets (ex: 127.0.0.1,::1)" default:""`
+	ProxyUserHeader     string `hcl:"proxy_user_header" flagName:"proxy-user-header" flagDescribe:"Header in which a trusted proxy passes the authenticated user (ex: X-Forwarded-User or Remote-User)" default:""`
+	ProxyUserRole       string `hcl:"proxy_user_role" flagName:"proxy-user-role" flagDescribe:"Role of users authenticated by a trusted proxy" default:"viewer"`
+	TokensFile          string `hcl:"tokens_file" flagName:"tokens-file" flagDescribe:"File storing hashed personal API tokens, enables Bearer token authentication" default:""`
+	LockoutIPRules      string `hcl:"lockout_ip_rules" flagName:"lockout-ip-rules" flagDescribe:"Failed logins after which a client IP is locked out, as attempts:duration pairs" default:"5:1m,10:5m,20:15m"`
+	LockoutUserRules    string `hcl:"lockout_user_rules" flagName:"lockout-user-rules" flagDescribe:"Failed logins after which a user name is locked out, as attempts:duration pairs" default:"10:5m,20:30m"`
+	LockoutGlobalRules  string `hcl:"lockout_global_rules" flagName:"lockout-global-rules" flagDescribe:"Failed logins of all clients within the global window after which all logins are locked out, except from --lockout-allow (ex: 100:2m,500:30m, default: off)" default:""`
+	LockoutGlobalWindow int    `hcl:"lockout_global_window" flagName:"lockout-global-window" flagDescribe:"Seconds in which failed logins count towards the global lockout" default:"300"`
+	LockoutAllow        string `hcl:"lockout_allow" flagName:"lockout-allow" flagDescribe:"Comma separated addresses or CIDRs that are never locked out" default:""`
+	LockoutStateFile    string `hcl:"lockout_state_file" flagName:"lockout-state-file" flagDescribe:"File keeping lockouts across restarts" default:""`
+	AuditLog            string `hcl:"audit_log" flagName:"audit-log" flagDescribe:"File to append a hash-chained JSON lines audit trail of logins, connections and psmux actions to" default:""`
+	AuditLogMaxSize     int    `hcl:"audit_log_max_size" flagName:"audit-log-max-size" flagDescribe:"Megabytes after which the audit log is rotated (0 to disable)" default:"100"`
+	AuditLogMaxAge      int    `hcl:"audit_log_max_age" flagName:"audit-log-max-age" flagDescribe:"Seconds after which the audit log is rotated (0 to disable)" default:"86400"`
+	AuditInput          bool   `hcl:"audit_input" flagName:"audit-input" flagDescribe:"Record the keystrokes clients send in the audit log (BE CAREFUL, includes passwords typed into the terminal)" default:"false"`
+	EnableMetrics       bool   `hcl:"enable_metrics" flagName:"metrics" flagDescribe:"Serve Prometheus metrics at <path>/metrics to admins" default:"false"`
+	MetricsAddress      string `hcl:"metrics_address" flagName:"metrics-address" flagDescribe:"Serve Prometheus metrics without authentication at /metrics on this address instead (ex: 127.0.0.1:9100)" default:""`
 	NoAuth              bool   `hcl:"no_auth" flagName:"no-auth" flagDescribe:"Disable authentication (NOT RECOMMENDED)" default:"false"`
 	EnableRandomUrl     bool   `hcl:"enable_random_url" flagName:"random-url" flagSName:"r" flagDescribe:"Add a random string to the URL" default:"false"`
 	RandomUrlLength     int    `hcl:"random_url_length" flagName:"random-url-length" flagDescribe:"Random URL length" default:"8"`
@@ -19,6 +65,9 @@ type Options struct {
 	TLSKeyFile          string `hcl:"tls_key_file" flagName:"tls-key" flagDescribe:"TLS/SSL key file path" default:"~/.gotty.key"`
 	EnableTLSClientAuth bool   `hcl:"enable_tls_client_auth" default:"false"`
 	TLSCACrtFile        string `hcl:"tls_ca_crt_file" flagName:"tls-ca-crt" flagDescribe:"TLS/SSL CA certificate file for client certifications" default:"~/.gotty.ca.crt"`
+	TLSClientMapFile    string `hcl:"tls_client_map_file" flagName:"tls-client-map" flagDescribe:"File mapping client certificate emails, CNs or OUs to users and roles, who then need no password" default:""`
+	TLSClientDenyFile   string `hcl:"tls_client_deny_file" flagName:"tls-client-deny" flagDescribe:"CRL or list of serials and SHA-256 fingerprints of revoked client certificates" default:""`
+	TLSCertAndPassword  bool   `hcl:"tls_client_require_password" flagName:"tls-client-require-password" flagDescribe:"Require a password too, for the user the client certificate maps to" default:"false"`
 	IndexFile           string `hcl:"index_file" flagName:"index" flagDescribe:"Custom index.html file" default:""`
 	TitleFormat         string `hcl:"title_format" flagName:"title-format" flagSName:"" flagDescribe:"Title format of browser window" default:"{{ .command }}@{{ .hostname }}"`
 	EnableReconnect     bool   `hcl:"enable_reconnect" flagName:"reconnect" flagDescribe:"Enable reconnection" default:"false"`
@@ -30,17 +79,99 @@ type Options struct {
 	PassHeaders         bool   `hcl:"pass_headers" flagName:"pass-headers" flagDescribe:"Pass HTTP request headers as environment variables (e.g. Cookie becomes HTTP_COOKIE)" default:"false"`
 	Width               int    `hcl:"width" flagName:"width" flagDescribe:"Static width of the screen, 0(default) means dynamically resize" default:"0"`
 	Height              int    `hcl:"height" flagName:"height" flagDescribe:"Static height of the screen, 0(default) means dynamically resize" default:"0"`
-	WSOrigin            string `hcl:"ws_origin" flagName:"ws-origin" flagDescribe:"A regular expression that matches origin URLs to be accepted by WebSocket. No cross origin requests are acceptable by default" default:""`
+	SecurityHeaders     bool   `hcl:"security_headers" flagName:"security-headers" flagDescribe:"Send Content-Security-Policy, HSTS and other security headers" default:"true"`
+	CSP                 string `hcl:"csp" flagName:"csp" flagDescribe:"Content-Security-Policy replacing the default one, {nonce} stands for the nonce of inline scripts" default:""`
+	CSPReportOnly       bool   `hcl:"csp_report_only" flagName:"csp-report-only" flagDescribe:"Only report violations of the Content-Security-Policy to <path>/csp-report instead of enforcing it" default:"false"`
+	FrameAncestors      string `hcl:"frame_ancestors" flagName:"frame-ancestors" flagDescribe:"Sources allowed to embed the pages in frames (ex: 'self' https://portal.example.com)" default:"'none'"`
+	HSTSMaxAge          int    `hcl:"hsts_max_age" flagName:"hsts-max-age" flagDescribe:"Seconds browsers only use HTTPS after a visit over HTTPS (0 to disable)" default:"31536000"`
+	ReferrerPolicy      string `hcl:"referrer_policy" flagName:"referrer-policy" flagDescribe:"Referrer-Policy of all responses" default:"no-referrer"`
+	WSAllowedOrigins    string `hcl:"ws_allowed_origins" flagName:"ws-allowed-origins" flagDescribe:"Comma separated origins besides the server's own accepted by WebSocket (ex: https://portal.example.com)" default:""`
+	WSOrigin            string `hcl:"ws_origin" flagName:"ws-origin" flagDescribe:"A regular expression that matches further origin URLs to be accepted by WebSocket. No cross origin requests are acceptable by default" default:""`
 	WSQueryArgs         string `hcl:"ws_query_args" flagName:"ws-query-args" flagDescribe:"Querystring arguments to append to the websocket instantiation" default:""`
+	EnableAPI           bool   `hcl:"enable_api" flagName:"api" flagDescribe:"Enable the JSON control API under <path>/api/" default:"true"`
 	EnableWebGL         bool   `hcl:"enable_webgl" flagName:"enable-webgl" flagDescribe:"Enable WebGL renderer" default:"true"`
 	Quiet               bool   `hcl:"quiet" flagName:"quiet" flagDescribe:"Don't log" default:"false"`
+	LogLevel            string `hcl:"log_level" flagName:"log-level" flagDescribe:"Minimum level of log records: debug, info, warn or error" default:"info"`
+	LogFormat           string `hcl:"log_format" flagName:"log-format" flagDescribe:"Format of log records: text or json" default:"text"`
+	LogFile             string `hcl:"log_file" flagName:"log-file" flagDescribe:"File to write log records to instead of standard error" default:""`
+	LogFileMaxSize      int    `hcl:"log_file_max_size" flagName:"log-file-max-size" flagDescribe:"Megabytes after which the log file is rotated (0 to disable)" default:"100"`
+	LogFileMaxAge       int    `hcl:"log_file_max_age" flagName:"log-file-max-age" flagDescribe:"Seconds after which the log file is rotated (0 to disable)" default:"86400"`
 
 	TitleVariables map[string]interface{}
+	// Logger receives the log records of the server, slog.Default() if nil.
+	Logger *slog.Logger
+	// Authenticate lets an application embedding the server authenticate
+	// requests before the built-in methods are tried. It returns nil for
+	// requests it has no identity for.
+	Authenticate func(r *http.Request) *auth.Identity
+}
+
+// authRequired reports whether requests must be authenticated.
+func (options *Options) authRequired() bool {
+	return options.EnableBasicAuth || options.Authenticate != nil
+}
+
+// logger returns the logger of the server.
+func (options *Options) logger() *slog.Logger {
+	if options.Logger != nil {
+		return options.Logger
+	}
+	return slog.Default()
 }
 
 func (options *Options) Validate() error {
 	if options.EnableTLSClientAuth && !options.EnableTLS {
 		return errors.New("TLS client authentication is enabled, but TLS is not enabled")
 	}
+	if (options.TLSClientMapFile != "" || options.TLSClientDenyFile != "") && !options.EnableTLSClientAuth {
+		return errors.New("client certificate mapping and deny lists require TLS client authentication (--tls-ca-crt)")
+	}
+	if options.TLSCertAndPassword && options.TLSClientMapFile == "" {
+		return errors.New("requiring a password for client certificates requires a client certificate mapping")
+	}
+	if options.UsersFile != "" && options.Credential != "" {
+		return errors.New("a credential and a users file cannot be used together")
+	}
+	if options.ProxyUserHeader != "" {
+		if options.TrustedProxies == "" {
+			return errors.New("a proxy user header requires trusted proxies")
+		}
+		if _, err := auth.ParseRole(options.ProxyUserRole); err != nil {
+			return errors.Wrapf(err, "invalid proxy user role")
+		}
+	}
+	if options.AuditInput && options.AuditLog == "" {
+		return errors.New("recording input requires an audit log")
+	}
+	if options.LoginForm {
+		if options.OIDCIssuer != "" {
+			return errors.New("the login form and OIDC login cannot be used together")
+		}
+		if options.Credential == "" && options.UsersFile == "" && options.LDAPURL == "" {
+			return errors.New("the login form requires a credential, a users file or LDAP")
+		}
+	}
+	if options.LDAPURL != "" {
+		if options.Credential != "" || options.UsersFile != "" {
+			return errors.New("LDAP cannot be used together with a credential or a users file")
+		}
+		if options.LDAPBaseDN == "" {
+			return errors.New("LDAP requires a base DN")
+		}
+		if options.LDAPRoles == "" {
+			return errors.New("LDAP requires role mappings (ex: --ldap-roles '*=viewer')")
+		}
+	}
+	if options.OIDCIssuer != "" {
+		if options.Credential != "" {
+			return errors.New("a credential and OIDC login cannot be used together, use a users file instead")
+		}
+		if options.OIDCClientID == "" {
+			return errors.New("OIDC login requires a client ID")
+		}
+		if options.OIDCRoles == "" {
+			return errors.New("OIDC login requires role mappings (ex: --oidc-roles '*=viewer')")
+		}
+	}
 	return nil
 }
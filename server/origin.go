@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+// originChecker holds the origins besides that of the server itself which
+// may open websockets.
+type originChecker struct {
+	allowed map[string]bool
+	// pattern matches further origins, see Options.WSOrigin.
+	pattern *regexp.Regexp
+}
+
+func newOriginChecker(options *Options) (*originChecker, error) {
+	checker := &originChecker{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(options.WSAllowedOrigins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		normalized, err := auth.NormalizeOrigin(origin)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed websocket origin `%s`", origin)
+		}
+		checker.allowed[normalized] = true
+	}
+	if options.WSOrigin != "" {
+		pattern, err := regexp.Compile(options.WSOrigin)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compile regular expression of Websocket Origin: %s", options.WSOrigin)
+		}
+		checker.pattern = pattern
+	}
+	return checker, nil
+}
+
+// checkOrigin accepts websocket upgrades from the origin of the server, as
+// the client sees it through trusted proxies, and from the allowed origins.
+// Upgrades without an Origin header do not come from browsers, which
+// cross-site websocket hijacking needs, and are accepted.
+func (server *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if own, ok := server.originAllowed(r, origin); !ok {
+		args := []interface{}{"origin", origin, "expected", own, "ip", server.clientIP(r)}
+		if r.Header.Get("X-Forwarded-Host") != "" && !server.fromTrustedProxy(r) {
+			args = append(args, "hint", "forwarding headers from "+remoteIP(r.RemoteAddr)+" are ignored, see --trusted-proxies")
+		}
+		server.logger.Warn("Rejected websocket from a foreign origin", args...)
+		return false
+	}
+	return true
+}
+
+// originAllowed reports whether origin is that of the server, which it
+// returns, or one of the allowed origins.
+func (server *Server) originAllowed(r *http.Request, origin string) (string, bool) {
+	own, _ := auth.NormalizeOrigin(server.serverOrigin(r))
+	if normalized, err := auth.NormalizeOrigin(origin); err == nil {
+		if normalized == own {
+			return own, true
+		}
+		if server.origins != nil && server.origins.allowed[normalized] {
+			return own, true
+		}
+	}
+	if server.origins != nil && server.origins.pattern != nil && server.origins.pattern.MatchString(origin) {
+		return own, true
+	}
+	return own, false
+}
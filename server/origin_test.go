@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	trusted, _ := parseTrustedProxies("10.0.0.1")
+	options := &Options{WSAllowedOrigins: "https://Portal.example.com:443, http://localhost:3000", WSOrigin: `^https://[a-z]+\.example\.org$`}
+	origins, err := newOriginChecker(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{logger: testLogger, options: options, trustedProxies: trusted, origins: origins}
+
+	check := func(remote, origin string, headers map[string]string) bool {
+		r := httptest.NewRequest("GET", "http://webpsmux.local:8080/ws", nil)
+		if remote != "" {
+			r.RemoteAddr = remote
+		}
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		return server.checkOrigin(r)
+	}
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "term.example.com"}
+
+	tests := []struct {
+		name    string
+		remote  string
+		origin  string
+		headers map[string]string
+		want    bool
+	}{
+		{"no origin", "", "", nil, true},
+		{"same origin", "", "http://WebPsmux.local:8080", nil, true},
+		{"foreign origin", "", "https://evil.example", nil, false},
+		{"other port", "", "http://webpsmux.local:9090", nil, false},
+		{"null origin", "", "null", nil, false},
+		{"trusted proxy", "10.0.0.1:1234", "https://term.example.com", forwarded, true},
+		{"direct origin behind proxy", "10.0.0.1:1234", "http://webpsmux.local:8080", forwarded, false},
+		{"untrusted forwarded host", "192.0.2.1:1234", "https://term.example.com", forwarded, false},
+		{"allowed origin", "", "https://portal.example.com", nil, true},
+		{"allowed origin with port", "", "http://localhost:3000", nil, true},
+		{"pattern", "", "https://docs.example.org", nil, true},
+	}
+	for _, test := range tests {
+		if got := check(test.remote, test.origin, test.headers); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+// TestCheckOriginBehindLocalProxy covers IIS on the same machine as in
+// deploy/web.config, which is only taken at its word with --trusted-proxies.
+func TestCheckOriginBehindLocalProxy(t *testing.T) {
+	request := func(remote, origin string) *http.Request {
+		r := httptest.NewRequest("GET", "http://localhost:8080/ws", nil)
+		r.RemoteAddr = remote
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "term.example.com")
+		r.Header.Set("X-Forwarded-For", "198.51.100.7")
+		return r
+	}
+
+	untrusted := &Server{logger: testLogger, options: &Options{}}
+	if untrusted.checkOrigin(request("127.0.0.1:50000", "https://term.example.com")) {
+		t.Error("expected the public origin to be rejected without trusted proxies")
+	}
+
+	trusted, _ := parseTrustedProxies("127.0.0.1,::1")
+	server := &Server{logger: testLogger, options: &Options{}, trustedProxies: trusted}
+	for _, remote := range []string{"127.0.0.1:50000", "[::1]:50000"} {
+		if !server.checkOrigin(request(remote, "https://term.example.com")) {
+			t.Errorf("expected the public origin from %s to be accepted", remote)
+		}
+		if got := server.requestOrigin(request(remote, "")); got != "https://term.example.com" {
+			t.Errorf("expected tickets requested through %s to be bound to the public origin, got %s", remote, got)
+		}
+	}
+	if server.checkOrigin(request("127.0.0.1:50000", "http://localhost:8080")) {
+		t.Error("expected the internal origin to be rejected behind the proxy")
+	}
+}
+
+func TestNewOriginCheckerInvalid(t *testing.T) {
+	for _, origins := range []string{"portal.example.com", "https://example.com/path", "ftp://example.com"} {
+		if _, err := newOriginChecker(&Options{WSAllowedOrigins: origins}); err == nil {
+			t.Errorf("expected %q to be rejected", origins)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+// unixPeers among the trusted proxies stands for the peers on unix sockets,
+// which have no address.
+const unixPeers = "unix"
+
+// parseTrustedProxies parses a comma separated list of CIDRs and addresses.
+// unixPeers is left to trustsUnixPeers.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || entry == unixPeers {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy address `%s`", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy network `%s`", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trustsUnixPeers reports whether the trusted proxies include unixPeers.
+func trustsUnixPeers(s string) bool {
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == unixPeers {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy reports whether addr belongs to a trusted proxy.
+func (server *Server) isTrustedProxy(addr string) bool {
+	if addr == "" || addr == "@" {
+		return server.trustUnixPeers
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range server.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether the request was made by a trusted proxy.
+func (server *Server) fromTrustedProxy(r *http.Request) bool {
+	return server.isTrustedProxy(remoteIP(r.RemoteAddr))
+}
+
+// proxyIdentity returns the user a trusted proxy authenticated, as named
+// by the configured user header. The header is ignored from other peers.
+func (server *Server) proxyIdentity(r *http.Request) *auth.Identity {
+	if server.options.ProxyUserHeader == "" {
+		return nil
+	}
+	user := strings.TrimSpace(r.Header.Get(server.options.ProxyUserHeader))
+	if user == "" {
+		return nil
+	}
+	if !server.fromTrustedProxy(r) {
+		server.logger.Warn("Ignoring proxy user header from untrusted peer", "header", server.options.ProxyUserHeader, "peer", r.RemoteAddr)
+		return nil
+	}
+	role, _ := auth.ParseRole(server.options.ProxyUserRole)
+	return &auth.Identity{User: user, Role: role, Method: "proxy"}
+}
+
+// requestScheme returns the scheme the client used, as reported by a
+// trusted proxy in X-Forwarded-Proto.
+func (server *Server) requestScheme(r *http.Request) string {
+	if server.fromTrustedProxy(r) {
+		if proto := forwardedValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client connected to, as reported by a
+// trusted proxy in X-Forwarded-Host.
+func (server *Server) requestHost(r *http.Request) string {
+	if server.fromTrustedProxy(r) {
+		if host := forwardedValue(r, "X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// requestOrigin returns the origin the request was made from: the Origin
+// header if the client sent one, the origin of the server otherwise.
+func (server *Server) requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	return server.serverOrigin(r)
+}
+
+// serverOrigin returns the origin of the server as the client sees it.
+func (server *Server) serverOrigin(r *http.Request) string {
+	return server.requestScheme(r) + "://" + server.requestHost(r)
+}
+
+// forwardedValue returns the first value of a possibly comma separated
+// forwarding header, which was set by the proxy closest to the client.
+func forwardedValue(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.ToLower(strings.TrimSpace(value))
+}
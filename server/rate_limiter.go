@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lockoutRule locks a client out for duration once it reached attempts
+// failures.
+type lockoutRule struct {
+	attempts int
+	duration time.Duration
+}
+
+// parseLockoutRules parses rules written as "attempts:duration" pairs,
+// e.g. "5:1m,10:5m,20:15m".
+func parseLockoutRules(s string) ([]lockoutRule, error) {
+	var rules []lockoutRule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		count, duration, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.Errorf("invalid lockout rule `%s` (expected attempts:duration)", entry)
+		}
+		attempts, err := strconv.Atoi(count)
+		if err != nil || attempts < 1 {
+			return nil, errors.Errorf("invalid number of attempts in lockout rule `%s`", entry)
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid duration in lockout rule `%s`", entry)
+		}
+		rules = append(rules, lockoutRule{attempts, d})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].attempts < rules[j].attempts })
+	return rules, nil
+}
+
+// rateLimiterConfig holds the thresholds of a rateLimiter.
+type rateLimiterConfig struct {
+	ipRules     []lockoutRule
+	userRules   []lockoutRule
+	globalRules []lockoutRule
+	// globalWindow is the sliding window global failures are counted in.
+	globalWindow time.Duration
+	// allow lists networks that are never locked out and whose failures
+	// do not count.
+	allow []*net.IPNet
+	// stateFile persists the lockouts across restarts if set.
+	stateFile string
+	// logger receives failures and save errors, slog.Default() if nil.
+	logger *slog.Logger
+	// metrics counts the lockouts, if not nil.
+	metrics *serverMetrics
+}
+
+func newRateLimiterConfig(options *Options) (rateLimiterConfig, error) {
+	config := rateLimiterConfig{logger: options.logger()}
+	var err error
+	if config.ipRules, err = parseLockoutRules(options.LockoutIPRules); err != nil {
+		return config, err
+	}
+	if config.userRules, err = parseLockoutRules(options.LockoutUserRules); err != nil {
+		return config, err
+	}
+	if config.globalRules, err = parseLockoutRules(options.LockoutGlobalRules); err != nil {
+		return config, err
+	}
+	if config.allow, err = parseTrustedProxies(options.LockoutAllow); err != nil {
+		return config, err
+	}
+	config.globalWindow = time.Duration(options.LockoutGlobalWindow) * time.Second
+	config.stateFile = options.LockoutStateFile
+	return config, nil
+}
+
+// rateLimiter provides brute force protection for authentication
+type rateLimiter struct {
+	config rateLimiterConfig
+
+	// Per-IP and per-user tracking
+	ips   map[string]*attemptInfo
+	users map[string]*attemptInfo
+
+	// Global tracking (sliding window)
+	globalFailures    []time.Time
+	globalLockedUntil time.Time
+
+	dirty bool
+	mu    sync.Mutex
+}
+
+type attemptInfo struct {
+	FailCount   int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// rateLimiterState is the content of the state file.
+type rateLimiterState struct {
+	IPs               map[string]*attemptInfo `json:"ips"`
+	Users             map[string]*attemptInfo `json:"users"`
+	GlobalFailures    []time.Time             `json:"global_failures"`
+	GlobalLockedUntil time.Time               `json:"global_locked_until"`
+}
+
+// lockout describes a tracked client for the admin API.
+type lockout struct {
+	// Kind is "ip", "user" or "global".
+	Kind        string     `json:"kind"`
+	Key         string     `json:"key,omitempty"`
+	Failures    int        `json:"failures"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+func newRateLimiter(config rateLimiterConfig) *rateLimiter {
+	if config.logger == nil {
+		config.logger = slog.Default()
+	}
+	return &rateLimiter{
+		config: config,
+		ips:    make(map[string]*attemptInfo),
+		users:  make(map[string]*attemptInfo),
+	}
+}
+
+// load reads the state file, if one is configured and exists.
+func (rl *rateLimiter) load() error {
+	if rl.config.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(rl.config.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state rateLimiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Wrapf(err, "failed to parse lockout state file `%s`", rl.config.stateFile)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if state.IPs != nil {
+		rl.ips = state.IPs
+	}
+	if state.Users != nil {
+		rl.users = state.Users
+	}
+	rl.globalFailures = state.GlobalFailures
+	rl.globalLockedUntil = state.GlobalLockedUntil
+	return nil
+}
+
+// save writes the state file if anything changed since the last save.
+func (rl *rateLimiter) save() error {
+	rl.mu.Lock()
+	if rl.config.stateFile == "" || !rl.dirty {
+		rl.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(rateLimiterState{
+		IPs:               rl.ips,
+		Users:             rl.users,
+		GlobalFailures:    rl.globalFailures,
+		GlobalLockedUntil: rl.globalLockedUntil,
+	}, "", "  ")
+	rl.dirty = false
+	rl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := rl.config.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rl.config.stateFile)
+}
+
+// run periodically removes old entries and saves the state until ctx is
+// canceled.
+func (rl *rateLimiter) run(ctx context.Context) {
+	cleanup := time.NewTicker(5 * time.Minute)
+	defer cleanup.Stop()
+	flush := time.NewTicker(5 * time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := rl.save(); err != nil {
+				rl.config.logger.Error("Failed to save lockout state", "error", err)
+			}
+			return
+		case <-cleanup.C:
+			rl.cleanup()
+		case <-flush.C:
+			if err := rl.save(); err != nil {
+				rl.config.logger.Error("Failed to save lockout state", "error", err)
+			}
+		}
+	}
+}
+
+// cleanup removes expired entries
+func (rl *rateLimiter) cleanup() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-30 * time.Minute)
+
+	for _, attempts := range []map[string]*attemptInfo{rl.ips, rl.users} {
+		for key, info := range attempts {
+			if info.LockedUntil.Before(now) && info.LastFailure.Before(cutoff) {
+				delete(attempts, key)
+				rl.dirty = true
+			}
+		}
+	}
+
+	// Clean up global failures outside window
+	rl.pruneGlobalFailures(now)
+}
+
+// pruneGlobalFailures removes failures outside the sliding window
+func (rl *rateLimiter) pruneGlobalFailures(now time.Time) {
+	cutoff := now.Add(-rl.config.globalWindow)
+	newFailures := make([]time.Time, 0, len(rl.globalFailures))
+	for _, t := range rl.globalFailures {
+		if t.After(cutoff) {
+			newFailures = append(newFailures, t)
+		}
+	}
+	if len(newFailures) != len(rl.globalFailures) {
+		rl.dirty = true
+	}
+	rl.globalFailures = newFailures
+}
+
+// allowed reports whether ip is on the allowlist.
+func (rl *rateLimiter) allowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipNet := range rl.config.allow {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLocked returns the remaining lockout and its kind if the IP, the
+// user or everyone is locked out. user may be empty.
+func (rl *rateLimiter) checkLocked(ip, user string) (bool, time.Duration, string) {
+	if rl.allowed(ip) {
+		return false, 0, ""
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+
+	// Check global lockout first
+	if now.Before(rl.globalLockedUntil) {
+		return true, rl.globalLockedUntil.Sub(now), "global"
+	}
+
+	if info, exists := rl.ips[ip]; exists && now.Before(info.LockedUntil) {
+		return true, info.LockedUntil.Sub(now), "ip"
+	}
+	if info, exists := rl.users[user]; user != "" && exists && now.Before(info.LockedUntil) {
+		return true, info.LockedUntil.Sub(now), "user"
+	}
+
+	return false, 0, ""
+}
+
+// recordFailure records a failed login attempt
+func (rl *rateLimiter) recordFailure(ip, user string) {
+	if rl.allowed(ip) {
+		rl.config.logger.Info("Auth failure from allowlisted address", "ip", ip, "user", user)
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.dirty = true
+
+	ipFailures := rl.recordAttempt("ip", rl.ips, ip, rl.config.ipRules, now)
+	userFailures := 0
+	if user != "" {
+		userFailures = rl.recordAttempt("user", rl.users, user, rl.config.userRules, now)
+	}
+
+	// Record global failure
+	rl.globalFailures = append(rl.globalFailures, now)
+	rl.pruneGlobalFailures(now)
+
+	// Check global lockout
+	failureCount := len(rl.globalFailures)
+	wasLocked := now.Before(rl.globalLockedUntil)
+	for _, rule := range rl.config.globalRules {
+		if failureCount >= rule.attempts {
+			rl.globalLockedUntil = now.Add(rule.duration)
+		}
+	}
+	if !wasLocked && now.Before(rl.globalLockedUntil) {
+		rl.config.metrics.lockedOut("global")
+	}
+
+	rl.config.logger.Info("Auth failure",
+		"ip", ip,
+		"user", user,
+		"ip_attempts", ipFailures,
+		"user_attempts", userFailures,
+		"global_failures", failureCount,
+	)
+}
+
+func (rl *rateLimiter) recordAttempt(kind string, attempts map[string]*attemptInfo, key string, rules []lockoutRule, now time.Time) int {
+	info, exists := attempts[key]
+	if !exists {
+		info = &attemptInfo{}
+		attempts[key] = info
+	}
+	info.FailCount++
+	info.LastFailure = now
+	wasLocked := now.Before(info.LockedUntil)
+	for _, rule := range rules {
+		if info.FailCount >= rule.attempts {
+			info.LockedUntil = now.Add(rule.duration)
+		}
+	}
+	if !wasLocked && now.Before(info.LockedUntil) {
+		rl.config.metrics.lockedOut(kind)
+	}
+	return info.FailCount
+}
+
+// recordSuccess resets the counters of the IP and the user on successful login
+func (rl *rateLimiter) recordSuccess(ip, user string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for _, entry := range []struct {
+		attempts map[string]*attemptInfo
+		key      string
+	}{{rl.ips, ip}, {rl.users, user}} {
+		if _, exists := entry.attempts[entry.key]; exists {
+			delete(entry.attempts, entry.key)
+			rl.dirty = true
+		}
+	}
+}
+
+// lockouts lists all tracked clients, locked ones first.
+func (rl *rateLimiter) lockouts() []lockout {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	list := []lockout{}
+	if len(rl.globalFailures) > 0 || now.Before(rl.globalLockedUntil) {
+		entry := lockout{Kind: "global", Failures: len(rl.globalFailures)}
+		if now.Before(rl.globalLockedUntil) {
+			until := rl.globalLockedUntil
+			entry.LockedUntil = &until
+		}
+		list = append(list, entry)
+	}
+	for _, tracked := range []struct {
+		kind     string
+		attempts map[string]*attemptInfo
+	}{{"ip", rl.ips}, {"user", rl.users}} {
+		for key, info := range tracked.attempts {
+			entry := lockout{Kind: tracked.kind, Key: key, Failures: info.FailCount}
+			if now.Before(info.LockedUntil) {
+				until := info.LockedUntil
+				entry.LockedUntil = &until
+			}
+			list = append(list, entry)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if (list[i].LockedUntil != nil) != (list[j].LockedUntil != nil) {
+			return list[i].LockedUntil != nil
+		}
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// clear forgets a tracked client. kind is "ip", "user" or "global"; an
+// empty kind clears everything. It reports whether anything was cleared.
+func (rl *rateLimiter) clear(kind, key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cleared := false
+	if kind == "" || kind == "global" {
+		cleared = len(rl.globalFailures) > 0 || !rl.globalLockedUntil.IsZero()
+		rl.globalFailures = nil
+		rl.globalLockedUntil = time.Time{}
+	}
+	for _, tracked := range []struct {
+		kind     string
+		attempts map[string]*attemptInfo
+	}{{"ip", rl.ips}, {"user", rl.users}} {
+		switch {
+		case kind == "" && len(tracked.attempts) > 0:
+			for k := range tracked.attempts {
+				delete(tracked.attempts, k)
+			}
+			cleared = true
+		case kind == tracked.kind:
+			if _, ok := tracked.attempts[key]; ok {
+				delete(tracked.attempts, key)
+				cleared = true
+			}
+		}
+	}
+	if cleared {
+		rl.dirty = true
+	}
+	return cleared
+}
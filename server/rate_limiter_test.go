@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLockoutRules(t *testing.T) {
+	rules, err := parseLockoutRules("10:5m, 5:1m,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lockoutRule{{5, time.Minute}, {10, 5 * time.Minute}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, rules)
+	}
+
+	for _, invalid := range []string{"5", "0:1m", "x:1m", "5:soon"} {
+		if _, err := parseLockoutRules(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimiterUserLockout(t *testing.T) {
+	rl := newRateLimiter(rateLimiterConfig{
+		ipRules:   []lockoutRule{{5, time.Minute}},
+		userRules: []lockoutRule{{3, time.Minute}},
+	})
+
+	// Failures from many addresses add up for the targeted user.
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		rl.recordFailure(ip, "alice")
+	}
+	if locked, _, kind := rl.checkLocked("192.0.2.4", "alice"); !locked || kind != "user" {
+		t.Errorf("expected alice to be locked out, got %v %q", locked, kind)
+	}
+	if locked, _, _ := rl.checkLocked("192.0.2.4", "bob"); locked {
+		t.Error("expected other users not to be locked out")
+	}
+
+	if !rl.clear("user", "alice") {
+		t.Fatal("expected the lockout of alice to be cleared")
+	}
+	if locked, _, _ := rl.checkLocked("192.0.2.4", "alice"); locked {
+		t.Error("expected alice to be able to log in again")
+	}
+	if rl.clear("user", "alice") {
+		t.Error("expected nothing to be cleared twice")
+	}
+}
+
+func TestRateLimiterAllowlist(t *testing.T) {
+	allow, _ := parseTrustedProxies("10.0.0.0/8")
+	rl := newRateLimiter(rateLimiterConfig{
+		ipRules:      []lockoutRule{{1, time.Minute}},
+		globalRules:  []lockoutRule{{1, time.Minute}},
+		globalWindow: time.Minute,
+		allow:        allow,
+	})
+
+	rl.recordFailure("10.1.2.3", "alice")
+	if locked, _, _ := rl.checkLocked("10.1.2.3", "alice"); locked {
+		t.Error("expected an allowlisted address not to be locked out")
+	}
+	if locked, _, _ := rl.checkLocked("192.0.2.1", "bob"); locked {
+		t.Error("expected failures of allowlisted addresses not to count globally")
+	}
+
+	rl.recordFailure("192.0.2.1", "bob")
+	if locked, _, kind := rl.checkLocked("192.0.2.2", "carol"); !locked || kind != "global" {
+		t.Errorf("expected a global lockout, got %v %q", locked, kind)
+	}
+	if locked, _, _ := rl.checkLocked("10.1.2.3", "alice"); locked {
+		t.Error("expected allowlisted addresses to pass a global lockout")
+	}
+}
+
+func TestRateLimiterStateFile(t *testing.T) {
+	config := rateLimiterConfig{
+		ipRules:   []lockoutRule{{2, time.Hour}},
+		stateFile: filepath.Join(t.TempDir(), "lockouts.json"),
+	}
+	rl := newRateLimiter(config)
+	rl.recordFailure("192.0.2.1", "alice")
+	rl.recordFailure("192.0.2.1", "alice")
+	if err := rl.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newRateLimiter(config)
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _, kind := restarted.checkLocked("192.0.2.1", ""); !locked || kind != "ip" {
+		t.Errorf("expected the lockout to survive a restart, got %v %q", locked, kind)
+	}
+}
+
+func TestLockoutsAPI(t *testing.T) {
+	server := &Server{
+		logger:  testLogger,
+		options: &Options{},
+		limiter: newRateLimiter(rateLimiterConfig{ipRules: []lockoutRule{{1, time.Minute}}, globalWindow: time.Minute}),
+	}
+	server.limiter.recordFailure("192.0.2.1", "alice")
+	handler := http.StripPrefix("/api", server.apiHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/lockouts", nil))
+	var list []lockout
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(list) != 3 || list[0].Kind != "ip" || list[0].LockedUntil == nil {
+		t.Fatalf("expected the locked IP first, got %d %+v", w.Code, list)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/lockouts/ip/192.0.2.1", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/lockouts/ip/192.0.2.1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown lockout, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/lockouts", nil))
+	if w.Code != http.StatusNoContent || len(server.limiter.lockouts()) != 0 {
+		t.Fatalf("expected all lockouts to be cleared, got %d %+v", w.Code, server.limiter.lockouts())
+	}
+}
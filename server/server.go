@@ -7,11 +7,13 @@ import (
 	"html/template"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	noesctmpl "text/template"
 	"time"
 
@@ -20,25 +22,76 @@ import (
 	"github.com/pkg/errors"
 
 	"webpsmux/bindata"
+	"webpsmux/pkg/audit"
+	"webpsmux/pkg/auth"
 	"webpsmux/pkg/homedir"
-	"webpsmux/pkg/randomstring"
 	"webpsmux/pkg/psmux"
+	"webpsmux/pkg/randomstring"
 	"webpsmux/webtty"
 )
 
+// wsTicketLifetime is how long a page has to open its websocket after
+// fetching a ticket.
+const wsTicketLifetime = 30 * time.Second
+
 // Server provides a webtty HTTP endpoint.
 type Server struct {
 	factory Factory
 	options *Options
+	logger  *slog.Logger
+
+	authenticator auth.Authenticator
+	oidc          *auth.OIDCProvider
+	sessions      *auth.SessionCodec
+	revoked       revokedSessions
+	pathPrefix    string
+
+	trustedProxies []*net.IPNet
+	trustUnixPeers bool
+	origins        *originChecker
+	limiter        *rateLimiter
+	certMapper     *auth.CertMapper
+	tokens         *auth.TokenStore
+	audit          *audit.Logger
+	shares         *auth.ShareStore
+	shareCodec     *auth.SessionCodec
+	metrics        *serverMetrics
 
 	upgrader         *websocket.Upgrader
 	indexTemplate    *template.Template
 	titleTemplate    *noesctmpl.Template
 	manifestTemplate *template.Template
+	loginTemplate    *template.Template
+
+	connections *connectionRegistry
+	tickets     *auth.TicketIssuer
+
+	// started is when the server was created. Run owns the listeners when
+	// ownsListeners is set: listeners are the configured settings, bound
+	// those of the listeners actually served, addresses where they listen
+	// and listening tells whether they accept connections, with the
+	// certificates of those serving TLS.
+	started       time.Time
+	ownsListeners bool
+	listeners     []*listenerConfig
+	bound         []*listenerConfig
+	addresses     []string
+	listening     atomic.Bool
+	certificates  []*x509.Certificate
+
+	// ctx lives from Start to Close, which cancel ends. handler serves
+	// everything under pathPrefix and counter counts its websockets.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	handler   http.Handler
+	counter   *counter
+	closeOnce sync.Once
 
 	// Psmux support
 	psmuxSession string
-	psmuxCtrl    *psmux.Controller
+	psmuxCtrl    psmuxController
+	layouts      *layoutHub
+	psmuxHealth  psmuxHealth
 }
 
 // New creates a new instance of Server.
@@ -69,51 +122,162 @@ func New(factory Factory, options *Options) (*Server, error) {
 		panic("manifest template parse failed") // must be valid
 	}
 
+	loginData, err := bindata.Fs.ReadFile("static/login.html")
+	if err != nil {
+		panic("login page not found") // must be in bindata
+	}
+	loginTemplate, err := template.New("login").Parse(string(loginData))
+	if err != nil {
+		panic("login template parse failed") // must be valid
+	}
+
 	titleTemplate, err := noesctmpl.New("title").Parse(options.TitleFormat)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to parse window title format `%s`", options.TitleFormat)
 	}
 
-	var originChekcer func(r *http.Request) bool
-	if options.WSOrigin != "" {
-		matcher, err := regexp.Compile(options.WSOrigin)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to compile regular expression of Websocket Origin: %s", options.WSOrigin)
+	origins, err := newOriginChecker(options)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := listenerConfigs(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var authenticator auth.Authenticator
+	var oidc *auth.OIDCProvider
+	var sessions *auth.SessionCodec
+	if options.EnableBasicAuth {
+		if options.OIDCIssuer != "" {
+			oidc, err = newOIDCProvider(options)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to set up OIDC login")
+			}
 		}
-		originChekcer = func(r *http.Request) bool {
-			return matcher.MatchString(r.Header.Get("Origin"))
+		if options.OIDCIssuer != "" || options.LoginForm {
+			sessions, err = newSessionCodec(options)
+			if err != nil {
+				return nil, err
+			}
 		}
-	} else {
-		// Default: allow all origins (auth provides protection)
-		originChekcer = func(r *http.Request) bool {
-			return true
+		if options.Credential != "" || options.UsersFile != "" || options.LDAPURL != "" {
+			authenticator, err = newAuthenticator(options)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	trustedProxies, err := parseTrustedProxies(options.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	certMapper, err := newCertMapper(options)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := newTokenStore(options)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := authenticator.(auth.UserLookup); tokens != nil && !ok {
+		return nil, errors.New("API tokens need --credential or --users-file to look up the current role of their users")
+	}
+
+	auditLogger, err := newAuditLogger(options)
+	if err != nil {
+		return nil, err
+	}
+
+	shares, shareCodec, err := newShareStore(options)
+	if err != nil {
+		return nil, err
+	}
+
+	connections := newConnectionRegistry()
+	metrics := newServerMetrics(options, connections.count)
+
+	limiterConfig, err := newRateLimiterConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	limiterConfig.metrics = metrics
+	limiter := newRateLimiter(limiterConfig)
+	if err := limiter.load(); err != nil {
+		return nil, errors.Wrapf(err, "failed to load lockout state")
+	}
+
 	server := &Server{
-		factory: factory,
-		options: options,
+		factory:       factory,
+		options:       options,
+		logger:        options.logger(),
+		authenticator: authenticator,
+		oidc:          oidc,
+		sessions:      sessions,
+
+		trustedProxies: trustedProxies,
+		trustUnixPeers: trustsUnixPeers(options.TrustedProxies),
+		origins:        origins,
+		limiter:        limiter,
+		certMapper:     certMapper,
+		tokens:         tokens,
+		audit:          auditLogger,
+		shares:         shares,
+		shareCodec:     shareCodec,
+		metrics:        metrics,
 
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 			Subprotocols:    webtty.Protocols,
-			CheckOrigin:     originChekcer,
 		},
 		indexTemplate:    indexTemplate,
 		titleTemplate:    titleTemplate,
 		manifestTemplate: manifestTemplate,
+		loginTemplate:    loginTemplate,
+
+		connections: connections,
+		tickets:     auth.NewTicketIssuer(wsTicketLifetime),
+		listeners:   listeners,
+		started:     time.Now(),
 	}
 
+	server.upgrader.CheckOrigin = server.checkOrigin
+
 	// Detect psmux session from command
 	server.psmuxSession = server.detectPsmuxSession()
 	if server.psmuxSession != "" {
-		log.Printf("Detected psmux session: %s", server.psmuxSession)
+		server.logger.Info("Detected psmux session", "session", server.psmuxSession)
 	}
 
 	return server, nil
 }
 
+// newAuthenticator returns the credential check for Basic Authentication:
+// the LDAP directory or the users file if one is configured, the single
+// credential otherwise.
+func newAuthenticator(options *Options) (auth.Authenticator, error) {
+	if options.LDAPURL != "" {
+		return newLDAPAuthenticator(options)
+	}
+	if options.UsersFile != "" {
+		path := homedir.Expand(options.UsersFile)
+		store, err := auth.LoadUserStore(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load users file `%s`", path)
+		}
+		options.logger().Info("Loaded users file", "path", path, "users", len(store.Users()))
+		return store, nil
+	}
+
+	user, password, _ := strings.Cut(options.Credential, ":")
+	return &auth.StaticCredential{User: user, Password: password}, nil
+}
+
 // detectPsmuxSession checks if we're running psmux and extracts the session name
 func (server *Server) detectPsmuxSession() string {
 	cmd, argv := server.factory.Command()
@@ -138,34 +302,36 @@ func (server *Server) detectPsmuxSession() string {
 	return "default"
 }
 
-// Run starts the main process of the Server.
-// The cancelation of ctx will shutdown the server immediately with aborting
-// existing connections. Use WithGracefullContext() to support gracefull shutdown.
-func (server *Server) Run(ctx context.Context, options ...RunOption) error {
-	cctx, cancel := context.WithCancel(ctx)
-	opts := &RunOptions{gracefullCtx: context.Background()}
-	for _, opt := range options {
-		opt(opts)
+// Start starts the psmux controller and the background work of the server
+// and sets up its handler. The cancelation of ctx or Close stops it.
+func (server *Server) Start(ctx context.Context) error {
+	if server.handler != nil {
+		return errors.New("server already started")
 	}
+	server.ctx, server.cancel = context.WithCancel(ctx)
 
 	// Start psmux controller if we detected a psmux session
 	if server.psmuxSession != "" {
-		var err error
-		server.psmuxCtrl, err = psmux.NewController(server.psmuxSession)
+		logger := server.logger.With("session", server.psmuxSession)
+		ctrl, err := psmux.NewController(server.psmuxSession, logger)
+		if err == nil {
+			ctrl.OnCommand(server.metrics.psmuxCommand)
+			err = ctrl.Start()
+		}
 		if err != nil {
-			log.Printf("Warning: failed to create psmux controller: %v", err)
+			logger.Warn("Failed to start psmux controller", "error", err)
 		} else {
-			if err := server.psmuxCtrl.Start(); err != nil {
-				log.Printf("Warning: failed to start psmux controller: %v", err)
-				server.psmuxCtrl = nil
-			} else {
-				log.Printf("Psmux controller started for session: %s", server.psmuxSession)
-				defer server.psmuxCtrl.Stop()
-			}
+			logger.Info("Psmux controller started")
+			server.psmuxCtrl = ctrl
+
+			server.layouts = newLayoutHub(ctrl, layoutPollInterval, logger, server.metrics)
+			go server.layouts.run(server.ctx)
 		}
 	}
 
-	counter := newCounter(time.Duration(server.options.Timeout) * time.Second)
+	go server.limiter.run(server.ctx)
+
+	server.counter = newCounter(time.Duration(server.options.Timeout) * time.Second)
 
 	path := server.options.Path
 	if server.options.EnableRandomUrl {
@@ -177,62 +343,141 @@ func (server *Server) Run(ctx context.Context, options ...RunOption) error {
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
-	handlers := server.setupHandlers(cctx, cancel, path, counter)
-	srv, err := server.setupHTTPServer(handlers)
-	if err != nil {
-		return errors.Wrapf(err, "failed to setup an HTTP server")
-	}
+	server.pathPrefix = path
+	server.handler = server.setupHandlers(server.ctx, server.cancel, path, server.counter)
 
 	if server.options.PermitWrite {
-		log.Printf("Permitting clients to write input to the PTY.")
+		server.logger.Info("Permitting clients to write input to the PTY")
 	}
 	if server.options.Once {
-		log.Printf("Once option is provided, accepting only one client")
+		server.logger.Info("Once option is provided, accepting only one client")
+	}
+	return nil
+}
+
+// Handler returns the handler of the pages, websockets and API of a
+// started server, all under its path.
+func (server *Server) Handler() http.Handler {
+	return server.handler
+}
+
+// Path returns the path the handler of a started server is rooted at.
+func (server *Server) Path() string {
+	return server.pathPrefix
+}
+
+// Done returns a channel that is closed when a started server stops: on
+// Close, or by itself after its one client with Once or after Timeout
+// without clients.
+func (server *Server) Done() <-chan struct{} {
+	return server.ctx.Done()
+}
+
+// Close aborts the connections of a started server, waits for them to end
+// and stops the psmux controller.
+func (server *Server) Close() error {
+	if server.handler == nil {
+		return nil
+	}
+	server.closeOnce.Do(func() {
+		server.cancel()
+		server.waitConnections()
+		if server.psmuxCtrl != nil {
+			server.psmuxCtrl.Stop()
+		}
+		if server.audit != nil {
+			server.audit.Close()
+		}
+	})
+	return nil
+}
+
+// waitConnections waits for the connections of the server to end.
+func (server *Server) waitConnections() {
+	if conn := server.counter.count(); conn > 0 {
+		server.logger.Info("Waiting for connections to be closed", "connections", conn)
 	}
+	server.counter.wait()
+}
 
-	if server.options.Port == "0" {
-		log.Printf("Port number configured to `0`, choosing a random port")
+// Run starts the server and serves it at the configured address until ctx
+// is canceled or the server stops by itself.
+// The cancelation of ctx will shutdown the server immediately with aborting
+// existing connections. Use WithGracefullContext() to support gracefull shutdown.
+func (server *Server) Run(ctx context.Context, options ...RunOption) error {
+	opts := &RunOptions{gracefullCtx: context.Background()}
+	for _, opt := range options {
+		opt(opts)
 	}
-	hostPort := net.JoinHostPort(server.options.Address, server.options.Port)
-	listener, err := net.Listen("tcp", hostPort)
-	if err != nil {
-		return errors.Wrapf(err, "failed to listen at `%s`", hostPort)
+
+	server.ownsListeners = true
+	if err := server.Start(ctx); err != nil {
+		return err
 	}
+	defer server.Close()
 
-	scheme := "http"
-	if server.options.EnableTLS {
-		scheme = "https"
+	listeners, err := server.listen()
+	if err != nil {
+		return err
 	}
-	host, port, _ := net.SplitHostPort(listener.Addr().String())
-	log.Printf("HTTP server is listening at: %s", scheme+"://"+net.JoinHostPort(host, port)+path)
-	if server.options.Address == "0.0.0.0" {
-		for _, address := range listAddresses() {
-			log.Printf("Alternative URL: %s", scheme+"://"+net.JoinHostPort(address, port)+path)
+	for _, listener := range listeners {
+		if err := server.bind(listener.config); err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
 		}
 	}
+	servers := make([]*http.Server, len(listeners))
+	for i, listener := range listeners {
+		if servers[i], err = server.setupHTTPServer(server.Handler(), listener.config); err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return errors.Wrapf(err, "failed to setup an HTTP server")
+		}
+		defer servers[i].Close()
+	}
 
-	srvErr := make(chan error, 1)
-	go func() {
-		if server.options.EnableTLS {
-			crtFile := homedir.Expand(server.options.TLSCrtFile)
-			keyFile := homedir.Expand(server.options.TLSKeyFile)
-			log.Printf("TLS crt file: " + crtFile)
-			log.Printf("TLS key file: " + keyFile)
+	path := server.Path()
+	for _, listener := range listeners {
+		server.logListener(listener, path)
+	}
 
-			err = srv.ServeTLS(listener, crtFile, keyFile)
-		} else {
-			err = srv.Serve(listener)
-		}
+	if server.metrics != nil && server.options.MetricsAddress != "" {
+		metricsSrv, err := server.listenMetrics()
 		if err != nil {
-			srvErr <- err
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
 		}
-	}()
+		defer metricsSrv.Close()
+	}
+
+	server.listening.Store(true)
+	defer server.listening.Store(false)
+
+	srvErr := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		go func(srv *http.Server, listener boundListener) {
+			if listener.config.tls {
+				server.logger.Info("Serving TLS", "address", listener.Addr().String(), "crt_file", listener.config.crtFile, "key_file", listener.config.keyFile)
+				srvErr <- srv.ServeTLS(listener, listener.config.crtFile, listener.config.keyFile)
+			} else {
+				srvErr <- srv.Serve(listener)
+			}
+		}(servers[i], listener)
+	}
 
 	go func() {
 		select {
 		case <-opts.gracefullCtx.Done():
-			srv.Shutdown(context.Background())
-		case <-cctx.Done():
+			server.listening.Store(false)
+			for _, srv := range servers {
+				srv.Shutdown(context.Background())
+			}
+		case <-server.Done():
 		}
 	}()
 
@@ -240,21 +485,51 @@ func (server *Server) Run(ctx context.Context, options ...RunOption) error {
 	case err = <-srvErr:
 		if err == http.ErrServerClosed { // by gracefull ctx
 			err = nil
-		} else {
-			cancel()
+			server.waitConnections()
 		}
-	case <-cctx.Done():
-		srv.Close()
-		err = cctx.Err()
+	case <-server.Done():
+		err = server.ctx.Err()
 	}
 
-	conn := counter.count()
-	if conn > 0 {
-		log.Printf("Waiting for %d connections to be closed", conn)
+	return err
+}
+
+// bind records config as served, loading its certificate if it serves TLS.
+// The sockets passed by systemd share one config.
+func (server *Server) bind(config *listenerConfig) error {
+	for _, bound := range server.bound {
+		if bound == config {
+			return nil
+		}
 	}
-	counter.wait()
+	if config.tls {
+		certificate, err := loadCertificate(config.crtFile, config.keyFile)
+		if err != nil {
+			return err
+		}
+		server.certificates = append(server.certificates, certificate)
+	}
+	server.bound = append(server.bound, config)
+	return nil
+}
 
-	return err
+// logListener logs the URL of a listener, or the URLs of the addresses of
+// the host for wildcard addresses.
+func (server *Server) logListener(listener boundListener, path string) {
+	address := listener.Addr().String()
+	server.addresses = append(server.addresses, address)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		server.logger.Info("HTTP server is listening", "socket", address, "path", path, "auth", !listener.config.noAuth)
+		return
+	}
+	server.logger.Info("HTTP server is listening", "url", listener.config.url(address, path), "auth", !listener.config.noAuth)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		return
+	}
+	for _, address := range listAddresses() {
+		server.logger.Info("Alternative URL", "url", listener.config.url(net.JoinHostPort(address, port), path))
+	}
 }
 
 func (server *Server) setupHandlers(ctx context.Context, cancel context.CancelFunc, pathPrefix string, counter *counter) http.Handler {
@@ -273,14 +548,22 @@ func (server *Server) setupHandlers(ctx context.Context, cancel context.CancelFu
 	siteMux.Handle(pathPrefix+"icon_192.png", http.StripPrefix(pathPrefix, staticFileHandler))
 
 	siteMux.HandleFunc(pathPrefix+"manifest.json", server.handleManifest)
-	siteMux.HandleFunc(pathPrefix+"auth_token.js", server.handleAuthToken)
+	siteMux.HandleFunc(pathPrefix+"ws_ticket", server.handleWSTicket)
 	siteMux.HandleFunc(pathPrefix+"config.js", server.handleConfig)
+	if server.options.EnableAPI {
+		siteMux.Handle(pathPrefix+"api/", http.StripPrefix(pathPrefix+"api", server.apiHandler()))
+	}
+	if server.metrics != nil && server.options.MetricsAddress == "" {
+		siteMux.HandleFunc(pathPrefix+"metrics", server.handleMetrics)
+	}
 
 	siteHandler := http.Handler(siteMux)
 
-	if server.options.EnableBasicAuth {
-		log.Printf("Using Basic Authentication")
-		siteHandler = server.wrapBasicAuth(siteHandler, server.options.Credential)
+	if server.options.authRequired() {
+		if server.authenticator != nil {
+			server.logger.Info("Using Basic Authentication")
+		}
+		siteHandler = server.wrapAuth(siteHandler)
 	}
 
 	withGz := gziphandler.GzipHandler(server.wrapHeaders(siteHandler))
@@ -288,19 +571,60 @@ func (server *Server) setupHandlers(ctx context.Context, cancel context.CancelFu
 
 	wsMux := http.NewServeMux()
 	wsMux.Handle("/", siteHandler)
-	wsMux.HandleFunc(pathPrefix+"ws", server.generateHandleWS(ctx, cancel, counter))
+	wsHandler := http.Handler(server.generateHandleWS(ctx, cancel, counter))
+	if server.options.authRequired() {
+		wsHandler = server.wrapWSAuth(wsHandler)
+	}
+	wsMux.Handle(pathPrefix+"ws", wsHandler)
+
+	if server.shares != nil {
+		// Share links are the credential themselves.
+		wsMux.Handle(pathPrefix+"share/", server.wrapLogger(server.wrapHeaders(http.HandlerFunc(server.handleShare))))
+	}
+
+	if server.sessions != nil {
+		// The login itself must be reachable without a session.
+		loginMux := http.NewServeMux()
+		loginMux.HandleFunc(pathPrefix+"auth/login", server.handleLogin)
+		loginMux.HandleFunc(pathPrefix+"auth/logout", server.handleLogout)
+		if server.oidc != nil {
+			loginMux.HandleFunc(pathPrefix+"auth/callback", server.handleCallback)
+		}
+		wsMux.Handle(pathPrefix+"auth/", server.wrapLogger(server.wrapHeaders(loginMux)))
+	}
+
+	if server.options.SecurityHeaders {
+		// Browsers send violation reports without credentials.
+		wsMux.Handle(pathPrefix+"csp-report", server.wrapLogger(http.HandlerFunc(server.handleCSPReport)))
+	}
+
+	// Health probes need no credentials.
+	wsMux.Handle(pathPrefix+"healthz", server.wrapHeaders(http.HandlerFunc(server.handleHealthz)))
+	wsMux.Handle(pathPrefix+"readyz", server.wrapHeaders(http.HandlerFunc(server.handleReadyz)))
+
+	if server.options.EnableAPI {
+		// The event stream bypasses gzip, which holds back small writes.
+		eventsHandler := http.Handler(http.HandlerFunc(server.handleEvents))
+		if server.options.authRequired() {
+			eventsHandler = server.wrapAuth(eventsHandler)
+		}
+		wsMux.Handle(pathPrefix+"api/events", server.wrapLogger(server.wrapHeaders(eventsHandler)))
+	}
 	siteHandler = http.Handler(wsMux)
 
 	return siteHandler
 }
 
-func (server *Server) setupHTTPServer(handler http.Handler) (*http.Server, error) {
+func (server *Server) setupHTTPServer(handler http.Handler, config *listenerConfig) (*http.Server, error) {
 	srv := &http.Server{
 		Handler: handler,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, listenerKey{}, config)
+		},
 	}
 
-	if server.options.EnableTLSClientAuth {
-		tlsConfig, err := server.tlsConfig()
+	if config.caFile != "" {
+		tlsConfig, err := server.tlsConfig(config.caFile)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to setup TLS configuration")
 		}
@@ -310,8 +634,8 @@ func (server *Server) setupHTTPServer(handler http.Handler) (*http.Server, error
 	return srv, nil
 }
 
-func (server *Server) tlsConfig() (*tls.Config, error) {
-	caFile := homedir.Expand(server.options.TLSCACrtFile)
+// tlsConfig requires client certificates signed by the CAs in caFile.
+func (server *Server) tlsConfig(caFile string) (*tls.Config, error) {
 	caCert, err := os.ReadFile(caFile)
 	if err != nil {
 		return nil, errors.New("could not open CA crt file " + caFile)
@@ -324,5 +648,11 @@ func (server *Server) tlsConfig() (*tls.Config, error) {
 		ClientCAs:  caCertPool,
 		ClientAuth: tls.RequireAndVerifyClientCert,
 	}
+	if server.options.TLSClientDenyFile != "" {
+		tlsConfig.VerifyConnection, err = verifyNotRevoked(server.options, parseCertificates(caCert))
+		if err != nil {
+			return nil, err
+		}
+	}
 	return tlsConfig, nil
 }
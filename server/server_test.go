@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/utils"
+)
+
+type fakeFactory struct{}
+
+func (fakeFactory) Name() string                { return "fake" }
+func (fakeFactory) Command() (string, []string) { return "sh", nil }
+func (fakeFactory) New(params map[string][]string, headers map[string][]string) (Slave, error) {
+	return nil, nil
+}
+
+func TestEmbeddedHandler(t *testing.T) {
+	options := &Options{}
+	if err := utils.ApplyDefaultValues(options); err != nil {
+		t.Fatal(err)
+	}
+	options.EnableBasicAuth = false
+	options.Path = "/terminal"
+	options.Logger = testLogger
+	options.Authenticate = func(r *http.Request) *auth.Identity {
+		if user := r.Header.Get("X-Portal-User"); user != "" {
+			return &auth.Identity{User: user, Role: auth.RoleViewer, Method: "portal"}
+		}
+		return nil
+	}
+
+	server, err := New(fakeFactory{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := server.Start(context.Background()); err == nil {
+		t.Error("expected a second start to fail")
+	}
+
+	// Mounted next to the routes of the host application.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	mux.Handle(server.Path(), server.Handler())
+	get := func(path, user string) int {
+		r := httptest.NewRequest("GET", "http://portal.example.com"+path, nil)
+		if user != "" {
+			r.Header.Set("X-Portal-User", user)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := get("/terminal/api/status", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a portal user, got %d", code)
+	}
+	if code := get("/terminal/api/status", "alice"); code != http.StatusOK {
+		t.Errorf("expected 200 for a portal user, got %d", code)
+	}
+	if code := get("/terminal/healthz", ""); code != http.StatusOK {
+		t.Errorf("expected the health check without credentials, got %d", code)
+	}
+	if code := get("/other", "alice"); code != http.StatusTeapot {
+		t.Errorf("expected other paths to stay with the host, got %d", code)
+	}
+
+	server.Close()
+	select {
+	case <-server.Done():
+	default:
+		t.Error("expected the server to be done after Close")
+	}
+}
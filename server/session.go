@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+const (
+	sessionCookieName = "webpsmux_session"
+
+	// sessionTouchInterval is how often the last-seen time of a session
+	// cookie is renewed while it is in use.
+	sessionTouchInterval = time.Minute
+
+	// csrfHeader and csrfField carry the CSRF token of a session.
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// newSessionCodec returns the codec for session cookies. Without a
+// configured secret a random one is used, so sessions end on restart.
+func newSessionCodec(options *Options) (*auth.SessionCodec, error) {
+	if options.SessionSecret != "" {
+		return auth.NewSessionCodec([]byte(options.SessionSecret)), nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.Wrapf(err, "failed to generate session secret")
+	}
+	return auth.NewSessionCodec(secret), nil
+}
+
+// revokedSessions remembers logged out sessions until their cookies would
+// have expired anyway.
+type revokedSessions struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+func (rs *revokedSessions) revoke(session *auth.Session) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.ids == nil {
+		rs.ids = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for id, expires := range rs.ids {
+		if now.After(expires) {
+			delete(rs.ids, id)
+		}
+	}
+	rs.ids[session.ID] = session.ExpiresAt()
+}
+
+func (rs *revokedSessions) contains(session *auth.Session) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.ids[session.ID]
+	return ok
+}
+
+// startSession logs identity in by setting a new session cookie.
+func (server *Server) startSession(w http.ResponseWriter, r *http.Request, identity *auth.Identity) error {
+	lifetime := time.Duration(server.options.SessionLifetime) * time.Second
+	return server.writeSession(w, r, auth.NewSession(identity, lifetime))
+}
+
+func (server *Server) writeSession(w http.ResponseWriter, r *http.Request, session *auth.Session) error {
+	value, err := server.sessions.Encode(session)
+	if err != nil {
+		return err
+	}
+	server.setCookie(w, r, sessionCookieName, value, session.ExpiresAt())
+	return nil
+}
+
+// currentSession returns the session of the request if it has neither
+// expired, been idle for too long nor been logged out.
+func (server *Server) currentSession(r *http.Request) *auth.Session {
+	if server.sessions == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	session, err := server.sessions.Decode(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	idle := time.Duration(server.options.SessionIdleTimeout) * time.Second
+	if idle > 0 && session.IdleSince(time.Now()) > idle {
+		return nil
+	}
+	if server.revoked.contains(session) {
+		return nil
+	}
+	return session
+}
+
+// touchSession renews the last-seen time of an active session, at most
+// once per sessionTouchInterval.
+func (server *Server) touchSession(w http.ResponseWriter, r *http.Request, session *auth.Session) {
+	now := time.Now()
+	if session.IdleSince(now) < sessionTouchInterval {
+		return
+	}
+	session.LastSeen = now.Unix()
+	server.writeSession(w, r, session)
+}
+
+// checkCSRF verifies the CSRF token of state-changing requests made with
+// a session cookie. The token is taken from the X-CSRF-Token header or the
+// csrf_token form field.
+func (server *Server) checkCSRF(r *http.Request, session *auth.Session) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		token = r.PostFormValue(csrfField)
+	}
+	return server.sessions.VerifyCSRF(session, token)
+}
+
+// handleLogout ends the session, closes the websockets of its user and
+// returns to the start page.
+func (server *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if session := server.currentSession(r); session != nil {
+		if !server.checkCSRF(r, session) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		server.revoked.revoke(session)
+		closed := server.connections.closeUser(session.User)
+		server.logger.Info("Logout", "user", session.User, "ip", server.clientIP(r), "closed_connections", closed)
+	}
+
+	server.setCookie(w, r, sessionCookieName, "", time.Unix(0, 0))
+	http.Redirect(w, r, server.pathPrefix, http.StatusSeeOther)
+}
+
+func (server *Server) setCookie(w http.ResponseWriter, r *http.Request, name, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     server.pathPrefix,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   server.requestScheme(r) == "https" || strings.HasPrefix(server.options.OIDCRedirectURL, "https:"),
+		// Lax, so the cookies are sent on the redirect back from an OIDC
+		// provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+const (
+	shareCookieName = "webpsmux_share"
+
+	// shareRefreshInterval is how often share viewers get a new snapshot
+	// of their target, and how fast revocations reach them.
+	shareRefreshInterval = time.Second
+)
+
+// sharePayload is the content of the share cookie.
+type sharePayload struct {
+	ID string `json:"i"`
+}
+
+// newShareStore sets up share links, which only make sense when access is
+// otherwise restricted. The cookie key is random, so links end on restart.
+func newShareStore(options *Options) (*auth.ShareStore, *auth.SessionCodec, error) {
+	if !options.EnableBasicAuth {
+		return nil, nil, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to generate share link key")
+	}
+	return auth.NewShareStore(), auth.NewSessionCodec(key), nil
+}
+
+// handleShare opens a share link: it counts the use and hands the visitor a
+// cookie with which the page loads as a share viewer.
+func (server *Server) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := server.clientIP(r)
+	if server.rejectLockedOut(w, ip, "") {
+		return
+	}
+	secret := strings.TrimPrefix(r.URL.Path, server.pathPrefix+"share/")
+	link, err := server.shares.Redeem(secret)
+	if err != nil {
+		server.limiter.recordFailure(ip, "")
+		server.loginFailed("share", "", ip, err)
+		http.Error(w, "This share link is invalid, used up or has expired", http.StatusNotFound)
+		return
+	}
+	value, err := server.shareCodec.Seal(sharePayload{ID: link.ID})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var expires time.Time
+	if link.Expires != nil {
+		expires = *link.Expires
+	}
+	server.setCookie(w, r, shareCookieName, value, expires)
+	server.loginSucceeded("share", shareViewer(link.ID), ip)
+	server.logger.Info("Share link opened", "share", link.ID, "kind", link.Kind, "target", link.Target, "ip", ip, "uses", link.Uses)
+	http.Redirect(w, r, server.pathPrefix, http.StatusSeeOther)
+}
+
+// shareIdentity returns the share viewer behind the share cookie of r, as
+// long as the link is active.
+func (server *Server) shareIdentity(r *http.Request) *auth.Identity {
+	if server.shares == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(shareCookieName)
+	if err != nil {
+		return nil
+	}
+	var payload sharePayload
+	if err := server.shareCodec.Open(cookie.Value, &payload); err != nil {
+		return nil
+	}
+	if _, ok := server.shares.Active(payload.ID); !ok {
+		return nil
+	}
+	return shareViewer(payload.ID)
+}
+
+// shareViewer is the identity of those who opened the share link with id.
+func shareViewer(id string) *auth.Identity {
+	return &auth.Identity{User: "share:" + id, Role: auth.RoleViewer, Method: "share"}
+}
+
+// isShareViewer reports whether identity opened a share link. Share
+// viewers see their target only; they get neither the terminal nor the
+// API.
+func isShareViewer(identity *auth.Identity) bool {
+	return identity != nil && identity.Method == "share"
+}
+
+// newShareSlave returns the slave for a share viewer, which shows snapshots
+// of the target of the link instead of the shared terminal.
+func (server *Server) newShareSlave(identity *auth.Identity) (Slave, error) {
+	id := strings.TrimPrefix(identity.User, "share:")
+	link, ok := server.shares.Active(id)
+	if !ok {
+		return nil, auth.ErrInvalidShare
+	}
+	if server.psmuxCtrl == nil {
+		return nil, errors.New("psmux controller is not running")
+	}
+	return newShareSlave(
+		func() (string, error) { return server.psmuxCtrl.CapturePane(link.Target) },
+		func() bool { _, ok := server.shares.Active(id); return ok },
+		shareRefreshInterval,
+	), nil
+}
+
+// shareSlave captures a psmux target repeatedly and reads as a terminal
+// that redraws whenever the capture changes. It reaches EOF when the link
+// ends. Input is discarded.
+type shareSlave struct {
+	capture func() (string, error)
+	active  func() bool
+	ticker  *time.Ticker
+	done    chan struct{}
+	once    sync.Once
+
+	started bool
+	last    string
+	pending []byte
+}
+
+func newShareSlave(capture func() (string, error), active func() bool, interval time.Duration) *shareSlave {
+	return &shareSlave{
+		capture: capture,
+		active:  active,
+		ticker:  time.NewTicker(interval),
+		done:    make(chan struct{}),
+	}
+}
+
+func (slave *shareSlave) Read(p []byte) (int, error) {
+	for len(slave.pending) == 0 {
+		if slave.started {
+			select {
+			case <-slave.done:
+				return 0, io.EOF
+			case <-slave.ticker.C:
+			}
+		}
+		slave.started = true
+
+		if !slave.active() {
+			return 0, io.EOF
+		}
+		content, err := slave.capture()
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to capture shared target")
+		}
+		if content != slave.last {
+			slave.last = content
+			// Home, clear, then the snapshot with terminal line breaks.
+			frame := "\x1b[H\x1b[2J" + strings.ReplaceAll(strings.TrimRight(content, "\n"), "\n", "\r\n")
+			slave.pending = []byte(frame)
+		}
+	}
+	n := copy(p, slave.pending)
+	slave.pending = slave.pending[n:]
+	return n, nil
+}
+
+func (slave *shareSlave) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (slave *shareSlave) WindowTitleVariables() map[string]interface{} {
+	return map[string]interface{}{"command": "share"}
+}
+
+func (slave *shareSlave) ResizeTerminal(columns int, rows int) error {
+	return nil
+}
+
+func (slave *shareSlave) Close() error {
+	slave.once.Do(func() {
+		slave.ticker.Stop()
+		close(slave.done)
+	})
+	return nil
+}
+
+// apiShare is a share link as the API shows it. URL is only set right
+// after creation.
+type apiShare struct {
+	auth.ShareLink
+	URL string `json:"url,omitempty"`
+}
+
+// requireShares answers 404 instead of calling handle unless share links
+// are enabled.
+func (server *Server) requireShares(handle func(http.ResponseWriter, *http.Request, []string)) func(http.ResponseWriter, *http.Request, []string) {
+	return func(w http.ResponseWriter, r *http.Request, args []string) {
+		if server.shares == nil {
+			writeAPIError(w, http.StatusNotFound, "share links need authentication to be enabled")
+			return
+		}
+		handle(w, r, args)
+	}
+}
+
+func (server *Server) apiListShares(w http.ResponseWriter, r *http.Request, args []string) {
+	writeJSON(w, http.StatusOK, server.shares.Links())
+}
+
+func (server *Server) apiCreateShare(w http.ResponseWriter, r *http.Request, args []string) {
+	var req struct {
+		Kind   string `json:"kind"`
+		Target string `json:"target"`
+		// ExpiresIn is the lifetime in seconds and MaxUses the number of
+		// times the link can be opened, 0 for no limit.
+		ExpiresIn int `json:"expires_in"`
+		MaxUses   int `json:"max_uses"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	target := req.Target
+	var ok bool
+	switch req.Kind {
+	case "pane":
+		target, ok = server.lookupPane(w, req.Target)
+	case "window":
+		target, ok = server.lookupWindow(w, req.Target)
+	case "session":
+		if ok = server.currentLayout().FindSession(req.Target) != nil; !ok {
+			writeAPIError(w, http.StatusNotFound, "session %s not found", req.Target)
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "kind must be session, window or pane")
+	}
+	if !ok {
+		return
+	}
+
+	createdBy := ""
+	if identity := auth.FromContext(r.Context()); identity != nil {
+		createdBy = identity.User
+	}
+	secret, link, err := server.shares.Create(createdBy, req.Kind, target, time.Duration(req.ExpiresIn)*time.Second, req.MaxUses)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	server.logger.Info("Share link created", "share", link.ID, "kind", link.Kind, "target", link.Target, "user", link.CreatedBy, "ip", server.clientIP(r))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, apiShare{
+		ShareLink: link,
+		URL:       server.requestOrigin(r) + server.pathPrefix + "share/" + secret,
+	})
+}
+
+func (server *Server) apiRevokeShare(w http.ResponseWriter, r *http.Request, args []string) {
+	if err := server.shares.Revoke(args[0]); err != nil {
+		writeAPIError(w, http.StatusNotFound, "share link %s not found", args[0])
+		return
+	}
+	server.logger.Info("Share link revoked", "share", args[0], "ip", server.clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
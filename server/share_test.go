@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webpsmux/pkg/auth"
+)
+
+func TestShareLinks(t *testing.T) {
+	shares, codec, err := newShareStore(&Options{EnableBasicAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{EnableBasicAuth: true},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+		shares:        shares,
+		shareCodec:    codec,
+		psmuxCtrl:     newFakeController(),
+		pathPrefix:    "/",
+	}
+	api := server.wrapAuth(http.StripPrefix("/api", server.apiHandler()))
+
+	r := httptest.NewRequest("POST", "http://example.com/api/shares", strings.NewReader(`{"kind":"pane","target":"%1","max_uses":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the share link to be created, got %d %s", w.Code, w.Body)
+	}
+	var created apiShare
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.URL, "http://example.com/share/") {
+		t.Fatalf("unexpected share URL %s", created.URL)
+	}
+
+	w = httptest.NewRecorder()
+	server.handleShare(w, httptest.NewRequest("GET", created.URL, nil))
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("expected a cookie and a redirect, got %d", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	w = httptest.NewRecorder()
+	server.handleShare(w, httptest.NewRequest("GET", created.URL, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a used up link to be rejected, got %d", w.Code)
+	}
+
+	var identity *auth.Identity
+	site := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = auth.FromContext(r.Context())
+	}))
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	site.ServeHTTP(httptest.NewRecorder(), r)
+	if !isShareViewer(identity) || identity.Role != auth.RoleViewer {
+		t.Fatalf("expected the cookie to identify a share viewer, got %+v", identity)
+	}
+
+	r = httptest.NewRequest("GET", "/api/layout", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected share viewers to be denied the API, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("DELETE", "/api/shares/"+created.ID, nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the share link to be revoked, got %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	identity = nil
+	site.ServeHTTP(w, r)
+	if identity != nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked link to end access, got %d %+v", w.Code, identity)
+	}
+}
+
+func TestShareSlave(t *testing.T) {
+	content := "line 1\nline 2\n"
+	active := true
+	slave := newShareSlave(
+		func() (string, error) { return content, nil },
+		func() bool { return active },
+		time.Millisecond,
+	)
+	defer slave.Close()
+
+	buf := make([]byte, 1024)
+	n, err := slave.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "\x1b[H\x1b[2Jline 1\r\nline 2" {
+		t.Errorf("unexpected frame %q", got)
+	}
+
+	active = false
+	if _, err := slave.Read(buf); err != io.EOF {
+		t.Errorf("expected EOF once the link ends, got %v", err)
+	}
+	if n, _ := slave.Write([]byte("rm -rf /\r")); n != 9 {
+		t.Error("expected input to be discarded")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+import (
+	"net"
+)
+
+// systemdListeners returns no sockets, socket activation is only done by
+// systemd.
+func systemdListeners() ([]net.Listener, error) {
+	return nil, nil
+}
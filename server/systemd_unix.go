@@ -0,0 +1,48 @@
+//go:build unix
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// sdListenFdsStart is the first file descriptor systemd passes.
+const sdListenFdsStart = 3
+
+// systemdListeners returns the sockets systemd passed to the process by
+// socket activation, none if it was not started that way.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, errors.Errorf("invalid LISTEN_FDS `%s`", os.Getenv("LISTEN_FDS"))
+	}
+	// The sockets are not meant for the commands the server starts.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, errors.Wrapf(err, "file descriptor %d is not a listening socket", fd)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
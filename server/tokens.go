@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/homedir"
+)
+
+// newTokenStore loads the API tokens configured in options, if any.
+func newTokenStore(options *Options) (*auth.TokenStore, error) {
+	if options.TokensFile == "" {
+		return nil, nil
+	}
+	path := homedir.Expand(options.TokensFile)
+	store, err := auth.LoadTokenStore(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load tokens file `%s`", path)
+	}
+	options.logger().Info("Accepting API tokens", "path", path)
+	return store, nil
+}
+
+// tokenIdentity authenticates an API token. The token stops working when
+// its user is deleted and never has more than the current role of the user.
+func (server *Server) tokenIdentity(token string) (*auth.Identity, error) {
+	identity, err := server.tokens.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	role, ok := server.lookupRole(identity.User)
+	if !ok {
+		return nil, auth.ErrInvalidToken
+	}
+	if role < identity.Role {
+		identity.Role = role
+	}
+	return identity, nil
+}
+
+// lookupRole returns the current role of user, or false if the
+// authenticator does not know the user or cannot look up users.
+func (server *Server) lookupRole(user string) (auth.Role, bool) {
+	users, ok := server.authenticator.(auth.UserLookup)
+	if !ok {
+		return 0, false
+	}
+	return users.LookupRole(user)
+}
+
+// bearerToken returns the API token in the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authenticateBearer checks the Bearer token of r. Failures count towards
+// the lockout of the client IP, and are answered before it returns false.
+func (server *Server) authenticateBearer(w http.ResponseWriter, r *http.Request, token string) (*auth.Identity, bool) {
+	ip := server.clientIP(r)
+	if server.rejectLockedOut(w, ip, "") {
+		return nil, false
+	}
+	identity, err := server.tokenIdentity(token)
+	if err != nil {
+		server.limiter.recordFailure(ip, "")
+		server.loginFailed("token", "", ip, err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="WebPsmux"`)
+		http.Error(w, "Invalid API token", http.StatusUnauthorized)
+		return nil, false
+	}
+	server.metrics.login("token", nil)
+	return identity, true
+}
+
+type initTokenKey struct{}
+
+// wrapWSAuth authenticates websocket upgrades like wrapAuth. With API
+// tokens enabled, upgrades without any credentials are let through as
+// well; they have to present a token in the init message instead, see
+// authenticateInit.
+func (server *Server) wrapWSAuth(handler http.Handler) http.Handler {
+	authed := server.wrapAuth(handler)
+	if server.tokens == nil {
+		return authed
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticated(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") == "" && server.currentSession(r) == nil && server.shareIdentity(r) == nil &&
+			server.certIdentity(r) == nil && server.proxyIdentity(r) == nil && server.embedderIdentity(r) == nil {
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), initTokenKey{}, true)))
+			return
+		}
+		authed.ServeHTTP(w, r)
+	})
+}
+
+// initTokenRequired reports whether the websocket of ctx was upgraded
+// without credentials and must authenticate with an API token.
+func initTokenRequired(ctx context.Context) bool {
+	required, _ := ctx.Value(initTokenKey{}).(bool)
+	return required
+}
+
+// apiToken is a token as the API shows it, without its hash. Token is only
+// set right after creation.
+type apiToken struct {
+	ID       string     `json:"id"`
+	User     string     `json:"user"`
+	Role     auth.Role  `json:"role"`
+	Name     string     `json:"name"`
+	Scopes   auth.Scope `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Token    string     `json:"token,omitempty"`
+}
+
+func newAPIToken(token auth.Token) apiToken {
+	return apiToken{
+		ID:       token.ID,
+		User:     token.User,
+		Role:     token.Role,
+		Name:     token.Name,
+		Scopes:   token.Scopes,
+		Created:  token.Created,
+		Expires:  token.Expires,
+		LastUsed: token.LastUsed,
+	}
+}
+
+// requireTokens answers 404 instead of calling handle unless API tokens are
+// enabled and the request is authenticated.
+func (server *Server) requireTokens(handle func(http.ResponseWriter, *http.Request, []string)) func(http.ResponseWriter, *http.Request, []string) {
+	return func(w http.ResponseWriter, r *http.Request, args []string) {
+		if server.tokens == nil || auth.FromContext(r.Context()) == nil {
+			writeAPIError(w, http.StatusNotFound, "API tokens are not enabled")
+			return
+		}
+		handle(w, r, args)
+	}
+}
+
+// apiListTokens lists the tokens of the user, or of everyone for admins.
+func (server *Server) apiListTokens(w http.ResponseWriter, r *http.Request, args []string) {
+	identity := auth.FromContext(r.Context())
+	user := identity.User
+	if identity.Allows(auth.RoleAdmin) {
+		user = r.URL.Query().Get("user")
+	}
+	tokens := []apiToken{}
+	for _, token := range server.tokens.Tokens(user) {
+		tokens = append(tokens, newAPIToken(token))
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (server *Server) apiCreateToken(w http.ResponseWriter, r *http.Request, args []string) {
+	identity := auth.FromContext(r.Context())
+	if identity.Method == "token" {
+		writeAPIError(w, http.StatusForbidden, "API tokens may not create tokens")
+		return
+	}
+	if _, ok := server.lookupRole(identity.User); !ok {
+		writeAPIError(w, http.StatusForbidden, "API tokens need an account from --credential or --users-file")
+		return
+	}
+	var req struct {
+		Name   string     `json:"name"`
+		Scopes auth.Scope `json:"scopes"`
+		// ExpiresIn is the lifetime in seconds, 0 for none.
+		ExpiresIn int `json:"expires_in"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.ExpiresIn < 0 {
+		writeAPIError(w, http.StatusBadRequest, "expires_in must not be negative")
+		return
+	}
+	value, token, err := server.tokens.Create(identity, req.Name, req.Scopes, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	server.logger.Info("API token created", "token", token.ID, "scopes", token.Scopes.String(), "user", token.User, "ip", server.clientIP(r))
+	created := newAPIToken(token)
+	created.Token = value
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// apiRevokeToken deletes a token of the user; admins may delete any token.
+func (server *Server) apiRevokeToken(w http.ResponseWriter, r *http.Request, args []string) {
+	identity := auth.FromContext(r.Context())
+	token, ok := server.tokens.Lookup(args[0])
+	if !ok || (token.User != identity.User && !identity.Allows(auth.RoleAdmin)) {
+		writeAPIError(w, http.StatusNotFound, "token %s not found", args[0])
+		return
+	}
+	if err := server.tokens.Revoke(token.ID); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "failed to revoke token: %s", err)
+		return
+	}
+	server.logger.Info("API token revoked", "token", token.ID, "user", token.User, "ip", server.clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
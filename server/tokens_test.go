@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/utils"
+)
+
+func TestAPITokens(t *testing.T) {
+	tokens, err := auth.LoadTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := newFakeController()
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{PermitWrite: true},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+		tokens:        tokens,
+		psmuxCtrl:     ctrl,
+	}
+	handler := server.wrapAuth(http.StripPrefix("/api", server.apiHandler()))
+
+	request := func(method, path, body string, authorize func(*http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		authorize(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	basic := func(r *http.Request) { r.SetBasicAuth("admin", "secret") }
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	w := request("POST", "/api/tokens", `{"name":"ci","scopes":["layout:read","panes:write"]}`, basic)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the token to be created, got %d %s", w.Code, w.Body)
+	}
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	if w := request("GET", "/api/layout", "", bearer(created.Token)); w.Code != http.StatusOK {
+		t.Errorf("expected the token to read the layout, got %d", w.Code)
+	}
+	if w := request("POST", "/api/panes/0/split", `{}`, bearer(created.Token)); w.Code != http.StatusCreated {
+		t.Errorf("expected the token to split panes, got %d", w.Code)
+	}
+	if w := request("POST", "/api/panes/0/keys", `{"keys":["ls"]}`, bearer(created.Token)); w.Code != http.StatusForbidden {
+		t.Errorf("expected sending input without input:send to be forbidden, got %d", w.Code)
+	}
+	if w := request("GET", "/api/layout", "", bearer("wpt_0000_invalid")); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown token to be rejected, got %d", w.Code)
+	}
+
+	w = request("GET", "/api/tokens", "", basic)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), created.ID) || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("expected the token to be listed without its hash, got %d %s", w.Code, w.Body)
+	}
+
+	if w := request("DELETE", "/api/tokens/"+created.ID, "", basic); w.Code != http.StatusNoContent {
+		t.Errorf("expected the token to be revoked, got %d", w.Code)
+	}
+	if w := request("GET", "/api/layout", "", bearer(created.Token)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAPITokensCannotCreateTokens(t *testing.T) {
+	tokens, _ := auth.LoadTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	value, _, err := tokens.Create(&auth.Identity{User: "admin", Role: auth.RoleAdmin}, "ci", auth.ScopeAdmin, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		logger:        testLogger,
+		options:       &Options{},
+		authenticator: &auth.StaticCredential{User: "admin", Password: "secret"},
+		limiter:       newRateLimiter(rateLimiterConfig{}),
+		tokens:        tokens,
+	}
+	handler := server.wrapAuth(http.StripPrefix("/api", server.apiHandler()))
+
+	r := httptest.NewRequest("POST", "/api/tokens", strings.NewReader(`{"scopes":["admin"]}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+value)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a token not to create tokens, got %d", w.Code)
+	}
+}
+
+func TestTokensFollowUserRole(t *testing.T) {
+	dir := t.TempDir()
+	users := auth.NewUserStore(filepath.Join(dir, "users"))
+	users.SetPassword("alice", "secret")
+	users.SetRole("alice", auth.RoleAdmin)
+	tokens, _ := auth.LoadTokenStore(filepath.Join(dir, "tokens.json"))
+	value, _, err := tokens.Create(&auth.Identity{User: "alice", Role: auth.RoleAdmin}, "ci", auth.ScopeAdmin, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{logger: testLogger, authenticator: users, tokens: tokens}
+
+	if identity, err := server.tokenIdentity(value); err != nil || identity.Role != auth.RoleAdmin {
+		t.Fatalf("expected the token to act as admin, got %+v, %v", identity, err)
+	}
+	if err := users.SetRole("alice", auth.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if identity, err := server.tokenIdentity(value); err != nil || identity.Role != auth.RoleViewer {
+		t.Errorf("expected the token to follow the demotion, got %+v, %v", identity, err)
+	}
+	if err := users.Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.tokenIdentity(value); err == nil {
+		t.Error("expected the token of a deleted user to be rejected")
+	}
+
+	server.authenticator = nil
+	if _, err := server.tokenIdentity(value); err == nil {
+		t.Error("expected tokens to be rejected when users cannot be looked up")
+	}
+}
+
+func TestTokensNeedUserLookup(t *testing.T) {
+	options := &Options{}
+	if err := utils.ApplyDefaultValues(options); err != nil {
+		t.Fatal(err)
+	}
+	options.EnableBasicAuth = true
+	options.LDAPURL = "ldap://127.0.0.1:1"
+	options.LDAPBaseDN = "DC=corp"
+	options.TokensFile = filepath.Join(t.TempDir(), "tokens.json")
+	options.Logger = testLogger
+	if _, err := New(fakeFactory{}, options); err == nil || !strings.Contains(err.Error(), "API tokens need") {
+		t.Errorf("expected tokens to be refused with LDAP, got %v", err)
+	}
+}
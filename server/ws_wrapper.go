@@ -2,6 +2,8 @@ package server
 
 import (
 	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
@@ -9,6 +11,15 @@ import (
 
 type wsWrapper struct {
 	*websocket.Conn
+
+	// bytesIn and bytesOut count the bytes received and sent, and lastRead
+	// is the time of the last message received in Unix nanoseconds, all
+	// accessed atomically.
+	bytesIn  int64
+	bytesOut int64
+	lastRead int64
+	// metrics counts the messages, if not nil.
+	metrics *serverMetrics
 }
 
 func (wsw *wsWrapper) Write(p []byte) (n int, err error) {
@@ -17,7 +28,10 @@ func (wsw *wsWrapper) Write(p []byte) (n int, err error) {
 		return 0, err
 	}
 	defer writer.Close()
-	return writer.Write(p)
+	n, err = writer.Write(p)
+	atomic.AddInt64(&wsw.bytesOut, int64(n))
+	wsw.metrics.websocketMessage("out", p[:n])
+	return n, err
 }
 
 func (wsw *wsWrapper) Read(p []byte) (n int, err error) {
@@ -36,6 +50,9 @@ func (wsw *wsWrapper) Read(p []byte) (n int, err error) {
 			return 0, errors.Wrapf(err, "Client message exceeded buffer size")
 		}
 		n = copy(p, b)
+		atomic.AddInt64(&wsw.bytesIn, int64(n))
+		atomic.StoreInt64(&wsw.lastRead, time.Now().UnixNano())
+		wsw.metrics.websocketMessage("in", p[:n])
 		return n, err
 	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	cli "github.com/urfave/cli/v2"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/homedir"
+)
+
+func totpCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "totp",
+		Usage:     "Enable two-factor authentication with an authenticator app for a user",
+		ArgsUsage: "<user>",
+		Description: "Generates a TOTP secret and one-time recovery codes and prints them. They are shown only once.\n" +
+			"The user then logs in with the password followed by the current code, or by a recovery code.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "file",
+				Aliases:  []string{"f"},
+				Usage:    "Users file (HCL format)",
+				EnvVars:  []string{"GOTTY_USERS_FILE"},
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "issuer",
+				Usage: "Name the authenticator app shows for the account",
+				Value: "webpsmux",
+			},
+			&cli.BoolFlag{
+				Name:  "recovery-codes",
+				Usage: "Only replace the recovery codes",
+			},
+			&cli.BoolFlag{
+				Name:  "disable",
+				Usage: "Turn off two-factor authentication for the user",
+			},
+		},
+		Action: runTOTP,
+	}
+}
+
+func runTOTP(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("Error: exactly one user name is required", 1)
+	}
+	name := c.Args().First()
+	path := homedir.Expand(c.String("file"))
+
+	store, err := auth.LoadUserStore(path)
+	if err != nil {
+		return cli.Exit(err, 2)
+	}
+
+	switch {
+	case c.Bool("disable"):
+		if err := store.DisableTOTP(name); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return saveUsers(store, fmt.Sprintf("Disabled two-factor authentication for %s", name))
+
+	case c.Bool("recovery-codes"):
+		codes, err := store.ResetRecoveryCodes(name)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		if err := saveUsers(store, fmt.Sprintf("Replaced the recovery codes of %s", name)); err != nil {
+			return err
+		}
+		printRecoveryCodes(codes)
+		return nil
+	}
+
+	secret, codes, err := store.EnableTOTP(name)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if err := saveUsers(store, fmt.Sprintf("Enabled two-factor authentication for %s", name)); err != nil {
+		return err
+	}
+	fmt.Printf("\nSecret: %s\n", secret)
+	fmt.Printf("URI:    %s\n", auth.TOTPURI(c.String("issuer"), name, secret))
+	printRecoveryCodes(codes)
+	return nil
+}
+
+func printRecoveryCodes(codes []string) {
+	fmt.Println("\nRecovery codes, each usable once in place of a code:")
+	for _, code := range codes {
+		fmt.Printf("  %s\n", code)
+	}
+	fmt.Fprintln(os.Stderr, "\nStore these now, they cannot be shown again.")
+}
@@ -58,3 +58,49 @@ const (
 	// Switch session by name
 	PsmuxSwitchSession = 'E'
 )
+
+var inputNames = map[byte]string{
+	UnknownInput:       "unknown",
+	Input:              "input",
+	Ping:               "ping",
+	ResizeTerminal:     "resize_terminal",
+	SetEncoding:        "set_encoding",
+	PsmuxSelectPane:    "psmux_select_pane",
+	PsmuxSelectWindow:  "psmux_select_window",
+	PsmuxSplitPane:     "psmux_split_pane",
+	PsmuxClosePane:     "psmux_close_pane",
+	PsmuxNewWindow:     "psmux_new_window",
+	PsmuxSwitchSession: "psmux_switch_session",
+}
+
+var outputNames = map[byte]string{
+	UnknownOutput:     "unknown",
+	Output:            "output",
+	Pong:              "pong",
+	SetWindowTitle:    "set_window_title",
+	SetPreferences:    "set_preferences",
+	SetReconnect:      "set_reconnect",
+	SetBufferSize:     "set_buffer_size",
+	PsmuxLayoutUpdate: "psmux_layout_update",
+	PsmuxPaneOutput:   "psmux_pane_output",
+	PsmuxSessionInfo:  "psmux_session_info",
+	PsmuxError:        "psmux_error",
+}
+
+// InputName returns the name of a client message type, e.g.
+// "resize_terminal", or "unknown".
+func InputName(msgType byte) string {
+	if name, ok := inputNames[msgType]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// OutputName returns the name of a server message type, e.g. "output", or
+// "unknown".
+func OutputName(msgType byte) string {
+	if name, ok := outputNames[msgType]; ok {
+		return name
+	}
+	return "unknown"
+}
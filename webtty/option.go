@@ -2,8 +2,11 @@ package webtty
 
 import (
 	"encoding/json"
+	"log/slog"
 
 	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
 )
 
 // Option is an option for WebTTY.
@@ -12,7 +15,25 @@ type Option func(*WebTTY) error
 // WithPermitWrite sets a WebTTY to accept input from slaves.
 func WithPermitWrite() Option {
 	return func(wt *WebTTY) error {
-		wt.permitWrite = true
+		wt.permitWrite.Store(true)
+		return nil
+	}
+}
+
+// WithIdentity sets the authenticated user of the master.
+// Input and psmux actions are limited to what the user's role permits.
+func WithIdentity(identity *auth.Identity) Option {
+	return func(wt *WebTTY) error {
+		wt.identity = identity
+		return nil
+	}
+}
+
+// WithLogger sets the logger of a WebTTY, which should carry the fields of
+// the connection. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(wt *WebTTY) error {
+		wt.logger = logger
 		return nil
 	}
 }
@@ -0,0 +1,87 @@
+package webtty
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
+)
+
+// messagePolicy is the authorization of one client message type.
+type messagePolicy struct {
+	// action describes the message in denials, e.g. "close panes".
+	action string
+	// role is the minimum role of the connection.
+	role auth.Role
+	// scope is the scope API tokens need.
+	scope auth.Scope
+	// write marks messages that change the terminal or psmux state. They
+	// are refused on read-only connections, see WithPermitWrite.
+	write bool
+	// local marks navigation that connections which may not perform it
+	// get within their own view instead, see navigateLocally.
+	local bool
+}
+
+// messagePolicies holds the policy of every client message type. Types
+// missing here are protocol errors.
+var messagePolicies = map[byte]messagePolicy{
+	Input:              {action: "send input", role: auth.RoleOperator, scope: auth.ScopeInputSend, write: true},
+	Ping:               {action: "ping", role: auth.RoleViewer},
+	ResizeTerminal:     {action: "resize the terminal", role: auth.RoleViewer},
+	SetEncoding:        {action: "set the encoding", role: auth.RoleViewer},
+	PsmuxSelectPane:    {action: "select panes", role: auth.RoleOperator, scope: auth.ScopePanesWrite, write: true, local: true},
+	PsmuxSelectWindow:  {action: "select windows", role: auth.RoleOperator, scope: auth.ScopePanesWrite, write: true, local: true},
+	PsmuxSplitPane:     {action: "split panes", role: auth.RoleOperator, scope: auth.ScopePanesWrite, write: true},
+	PsmuxClosePane:     {action: "close panes", role: auth.RoleOperator, scope: auth.ScopePanesWrite, write: true},
+	PsmuxNewWindow:     {action: "create windows", role: auth.RoleOperator, scope: auth.ScopePanesWrite, write: true},
+	PsmuxSwitchSession: {action: "switch sessions", role: auth.RoleAdmin, scope: auth.ScopeAdmin, write: true},
+}
+
+type verdict int
+
+const (
+	permitted verdict = iota
+	// viewLocal permits navigation within the view of the connection only.
+	viewLocal
+	denied
+)
+
+// authorize evaluates the policy of a known message type for the
+// connection. Denials come with the reason sent to the client.
+func (wt *WebTTY) authorize(msgType byte) (verdict, string) {
+	policy := messagePolicies[msgType]
+	var reason string
+	switch {
+	case !wt.identity.Allows(policy.role):
+		reason = fmt.Sprintf("role %s may not %s", wt.identity.Role, policy.action)
+	case !wt.identity.HasScope(policy.scope):
+		reason = fmt.Sprintf("API token lacks scope %s to %s", policy.scope, policy.action)
+	case policy.write && !wt.permitWrite.Load():
+		reason = fmt.Sprintf("read-only connections may not %s", policy.action)
+	default:
+		return permitted, ""
+	}
+	if policy.local {
+		return viewLocal, ""
+	}
+	return denied, reason
+}
+
+// psmuxError is the payload of PsmuxError messages.
+type psmuxError struct {
+	// Type is the client message type that failed.
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// sendPsmuxError tells the client that a message of msgType was refused.
+func (wt *WebTTY) sendPsmuxError(msgType byte, message string) error {
+	data, err := json.Marshal(psmuxError{Type: string(msgType), Message: message})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal psmux error")
+	}
+	return wt.masterWrite(append([]byte{PsmuxError}, data...))
+}
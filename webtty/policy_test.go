@@ -0,0 +1,144 @@
+package webtty
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"webpsmux/pkg/auth"
+	"webpsmux/pkg/psmux"
+)
+
+type fakePsmux struct {
+	mu     sync.Mutex
+	calls  []string
+	layout *psmux.Layout
+}
+
+func newFakePsmux() *fakePsmux {
+	return &fakePsmux{layout: &psmux.Layout{
+		ActiveWinID:  "@0",
+		ActivePaneID: "%0",
+		Windows: []psmux.Window{
+			{ID: "@0", Active: true, Panes: []psmux.Pane{{ID: "%0", Active: true}}},
+			{ID: "@1", Panes: []psmux.Pane{{ID: "%1"}, {ID: "%2", Active: true}}},
+		},
+	}}
+}
+
+func (fp *fakePsmux) record(call string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.calls = append(fp.calls, call)
+	return nil
+}
+
+func (fp *fakePsmux) called() []string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return append([]string(nil), fp.calls...)
+}
+
+func (fp *fakePsmux) GetLayout() *psmux.Layout              { return fp.layout }
+func (fp *fakePsmux) RefreshLayout() error                  { return nil }
+func (fp *fakePsmux) SelectPane(id string) error            { return fp.record("select-pane " + id) }
+func (fp *fakePsmux) SelectWindow(id string) error          { return fp.record("select-window " + id) }
+func (fp *fakePsmux) SwitchSession(name string) error       { return fp.record("switch-client " + name) }
+func (fp *fakePsmux) SplitPane(horizontal bool) error       { return fp.record("split-window") }
+func (fp *fakePsmux) ClosePane(id string) error             { return fp.record("kill-pane " + id) }
+func (fp *fakePsmux) NewWindow() error                      { return fp.record("new-window") }
+func (fp *fakePsmux) Events() <-chan psmux.Event            { return nil }
+func (fp *fakePsmux) CapturePane(id string) (string, error) { return "contents of " + id, nil }
+
+func preparePsmuxSUT(t *testing.T, wg *sync.WaitGroup, options ...Option) (*mockMaster, *fakePsmux, context.CancelFunc) {
+	fp := newFakePsmux()
+	mMaster := newMockMaster()
+	wt, err := New(mMaster, newMockSlave(), options...)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	wt.SetPsmuxController(fp)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		wg.Done()
+		wt.Run(ctx)
+	}()
+
+	// Absorb initialization messages
+	checkNextMsgType(t, mMaster.gottyToMasterReader, SetWindowTitle)
+	checkNextMsgType(t, mMaster.gottyToMasterReader, SetBufferSize)
+	checkNextMsgType(t, mMaster.gottyToMasterReader, PsmuxLayoutUpdate)
+	return mMaster, fp, cancel
+}
+
+func TestPsmuxMessagesOnReadOnlyConnection(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	admin := &auth.Identity{User: "alice", Role: auth.RoleAdmin}
+	mMaster, fp, cancel := preparePsmuxSUT(t, &wg, WithIdentity(admin))
+	defer cancel()
+
+	for _, msg := range []string{"8%0", "D", "7h", "Emain"} {
+		mMaster.masterToGottyWriter.Write([]byte(msg))
+		checkPsmuxError(t, mMaster.gottyToMasterReader, msg[0])
+	}
+	if calls := fp.called(); len(calls) != 0 {
+		t.Errorf("expected no psmux commands without -w, got %v", calls)
+	}
+}
+
+func TestPsmuxMessagesByRole(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	operator := &auth.Identity{User: "bob", Role: auth.RoleOperator}
+	mMaster, fp, cancel := preparePsmuxSUT(t, &wg, WithPermitWrite(), WithIdentity(operator))
+	defer cancel()
+
+	mMaster.masterToGottyWriter.Write([]byte("Emain"))
+	checkPsmuxError(t, mMaster.gottyToMasterReader, PsmuxSwitchSession)
+
+	mMaster.masterToGottyWriter.Write([]byte("8%1"))
+	checkNextMsgType(t, mMaster.gottyToMasterReader, PsmuxLayoutUpdate)
+	if calls := fp.called(); len(calls) != 1 || calls[0] != "kill-pane %1" {
+		t.Errorf("expected the operator to close the pane, got %v", calls)
+	}
+}
+
+func TestPsmuxLocalNavigation(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	viewer := &auth.Identity{User: "carol", Role: auth.RoleViewer}
+	mMaster, fp, cancel := preparePsmuxSUT(t, &wg, WithPermitWrite(), WithIdentity(viewer))
+	defer cancel()
+
+	mMaster.masterToGottyWriter.Write([]byte("6@1"))
+	msgType, payload := nextMsg(t, mMaster.gottyToMasterReader)
+	if msgType != PsmuxLayoutUpdate {
+		t.Fatalf("Unexpected message type `%c`", msgType)
+	}
+	var layout psmux.Layout
+	json.Unmarshal(trimMsg(payload), &layout)
+	if layout.ActiveWinID != "@1" || layout.ActivePaneID != "%2" || layout.Windows[0].Active || !layout.Windows[1].Active {
+		t.Errorf("expected the layout of the local view, got %+v", layout)
+	}
+
+	msgType, payload = nextMsg(t, mMaster.gottyToMasterReader)
+	var output paneOutput
+	json.Unmarshal(trimMsg(payload), &output)
+	if msgType != PsmuxPaneOutput || output.PaneID != "%2" || output.Content != "contents of %2" {
+		t.Errorf("expected the contents of the selected pane, got `%c` %+v", msgType, output)
+	}
+
+	if calls := fp.called(); len(calls) != 0 {
+		t.Errorf("expected local navigation not to touch psmux, got %v", calls)
+	}
+	if fp.layout.ActiveWinID != "@0" || !fp.layout.Windows[0].Active {
+		t.Error("expected the shared layout to stay unchanged")
+	}
+}
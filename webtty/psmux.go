@@ -2,8 +2,10 @@ package webtty
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/pkg/errors"
+
 	"webpsmux/pkg/psmux"
 )
 
@@ -20,6 +22,18 @@ type PsmuxController interface {
 	Events() <-chan psmux.Event
 }
 
+// paneCapturer is implemented by controllers that can return the visible
+// contents of a pane, which connections navigating locally are shown.
+type paneCapturer interface {
+	CapturePane(paneID string) (string, error)
+}
+
+// paneOutput is the payload of PsmuxPaneOutput messages.
+type paneOutput struct {
+	PaneID  string `json:"paneId"`
+	Content string `json:"content"`
+}
+
 // SetPsmuxController sets the psmux controller for the WebTTY instance
 func (wt *WebTTY) SetPsmuxController(pc PsmuxController) {
 	wt.psmuxCtrl = pc
@@ -36,7 +50,7 @@ func (wt *WebTTY) SendPsmuxLayout() error {
 		return nil
 	}
 
-	data, err := json.Marshal(layout)
+	data, err := json.Marshal(wt.localLayout(layout))
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal psmux layout")
 	}
@@ -49,6 +63,7 @@ func (wt *WebTTY) handlePsmuxMessage(msgType byte, payload []byte) error {
 	if wt.psmuxCtrl == nil {
 		return nil // Silently ignore if no psmux controller
 	}
+	wt.logger.Debug("Psmux action", "type", string(msgType), "target", string(payload))
 
 	switch msgType {
 	case PsmuxSelectPane:
@@ -97,6 +112,97 @@ func (wt *WebTTY) handlePsmuxMessage(msgType byte, payload []byte) error {
 	}
 }
 
+// navigateLocally selects a pane or window in the view of this connection
+// only, leaving psmux and other clients alone. The client gets the layout
+// as seen from its view and the contents of the selected pane.
+func (wt *WebTTY) navigateLocally(msgType byte, payload []byte) error {
+	if wt.psmuxCtrl == nil {
+		return nil
+	}
+	layout := wt.psmuxCtrl.GetLayout()
+	if layout == nil {
+		return nil
+	}
+
+	var windowID, paneID string
+	switch msgType {
+	case PsmuxSelectWindow:
+		window := layout.FindWindow(string(payload))
+		if window == nil {
+			return wt.sendPsmuxError(msgType, fmt.Sprintf("window %s not found", payload))
+		}
+		windowID = window.ID
+		for _, pane := range window.Panes {
+			if pane.Active {
+				paneID = pane.ID
+			}
+		}
+	case PsmuxSelectPane:
+		for _, window := range layout.Windows {
+			for _, pane := range window.Panes {
+				if pane.ID == string(payload) {
+					windowID, paneID = window.ID, pane.ID
+				}
+			}
+		}
+		if paneID == "" {
+			return wt.sendPsmuxError(msgType, fmt.Sprintf("pane %s not found", payload))
+		}
+	}
+
+	wt.viewMutex.Lock()
+	wt.viewWindow, wt.viewPane = windowID, paneID
+	wt.viewMutex.Unlock()
+
+	if err := wt.SendPsmuxLayout(); err != nil {
+		return err
+	}
+	capturer, ok := wt.psmuxCtrl.(paneCapturer)
+	if !ok || paneID == "" {
+		return nil
+	}
+	content, err := capturer.CapturePane(paneID)
+	if err != nil {
+		return wt.sendPsmuxError(msgType, fmt.Sprintf("failed to capture pane %s", paneID))
+	}
+	data, err := json.Marshal(paneOutput{PaneID: paneID, Content: content})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal pane output")
+	}
+	return wt.masterWrite(append([]byte{PsmuxPaneOutput}, data...))
+}
+
+// localLayout returns layout with the active window and pane replaced by
+// those of the local view, if any. Windows and panes that went away reset
+// the view.
+func (wt *WebTTY) localLayout(layout *psmux.Layout) *psmux.Layout {
+	wt.viewMutex.Lock()
+	defer wt.viewMutex.Unlock()
+	if wt.viewWindow == "" {
+		return layout
+	}
+	if layout.FindWindow(wt.viewWindow) == nil {
+		wt.viewWindow, wt.viewPane = "", ""
+		return layout
+	}
+
+	local := *layout
+	local.Windows = make([]psmux.Window, len(layout.Windows))
+	for i, window := range layout.Windows {
+		window.Active = window.ID == wt.viewWindow
+		if window.Active {
+			window.Panes = append([]psmux.Pane(nil), window.Panes...)
+			for j := range window.Panes {
+				window.Panes[j].Active = window.Panes[j].ID == wt.viewPane
+			}
+		}
+		local.Windows[i] = window
+	}
+	local.ActiveWinID = wt.viewWindow
+	local.ActivePaneID = wt.viewPane
+	return &local
+}
+
 // isPsmuxMessage returns true if the message type is a psmux-specific message
 func isPsmuxMessage(msgType byte) bool {
 	switch msgType {
@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
+
+	"webpsmux/pkg/auth"
 )
 
 // WebTTY bridges a PTY slave and its PTY master.
@@ -19,7 +23,10 @@ type WebTTY struct {
 	slave Slave
 
 	windowTitle []byte
-	permitWrite bool
+	// permitWrite may change while running, see SetPermitWrite.
+	permitWrite atomic.Bool
+	// identity is the user on the master side, nil without authentication
+	identity    *auth.Identity
 	columns     int
 	rows        int
 	reconnect   int // in seconds
@@ -28,9 +35,15 @@ type WebTTY struct {
 
 	bufferSize int
 	writeMutex sync.Mutex
+	logger     *slog.Logger
 
 	// Psmux controller for psmux-specific operations
 	psmuxCtrl PsmuxController
+	// viewWindow and viewPane are the window and pane selected by a
+	// connection that navigates locally, see navigateLocally.
+	viewMutex  sync.Mutex
+	viewWindow string
+	viewPane   string
 }
 
 // New creates a new instance of WebTTY.
@@ -42,12 +55,12 @@ func New(masterConn Master, slave Slave, options ...Option) (*WebTTY, error) {
 		masterConn: masterConn,
 		slave:      slave,
 
-		permitWrite: false,
-		columns:     0,
-		rows:        0,
+		columns: 0,
+		rows:    0,
 
 		bufferSize: 1024,
 		decoder:    &NullCodec{},
+		logger:     slog.Default(),
 	}
 
 	for _, option := range options {
@@ -119,6 +132,18 @@ func (wt *WebTTY) Run(ctx context.Context) error {
 	return err
 }
 
+// PermitWrite reports whether the master may write to the slave and change
+// the psmux layout.
+func (wt *WebTTY) PermitWrite() bool {
+	return wt.permitWrite.Load()
+}
+
+// SetPermitWrite changes whether the master may write, e.g. to make a
+// running connection read-only. It is safe to call while running.
+func (wt *WebTTY) SetPermitWrite(permit bool) {
+	wt.permitWrite.Store(permit)
+}
+
 func (wt *WebTTY) sendInitializeMessage() error {
 	err := wt.masterWrite(append([]byte{SetWindowTitle}, wt.windowTitle...))
 	if err != nil {
@@ -184,12 +209,20 @@ func (wt *WebTTY) handleMasterReadEvent(data []byte) error {
 		return errors.New("unexpected zero length read from master")
 	}
 
+	if _, ok := messagePolicies[data[0]]; !ok {
+		return errors.Errorf("unknown message type `%c`", data[0])
+	}
+	switch verdict, reason := wt.authorize(data[0]); verdict {
+	case denied:
+		wt.logger.Debug("Denied client message", "type", string(data[0]), "reason", reason)
+		return wt.sendPsmuxError(data[0], reason)
+	case viewLocal:
+		wt.logger.Debug("Navigating locally", "type", string(data[0]), "target", string(data[1:]))
+		return wt.navigateLocally(data[0], data[1:])
+	}
+
 	switch data[0] {
 	case Input:
-		if !wt.permitWrite {
-			return nil
-		}
-
 		if len(data) <= 1 {
 			return nil
 		}
@@ -246,11 +279,9 @@ func (wt *WebTTY) handleMasterReadEvent(data []byte) error {
 		wt.slave.ResizeTerminal(columns, rows)
 
 	default:
-		// Check if it's a psmux message
 		if isPsmuxMessage(data[0]) {
 			return wt.handlePsmuxMessage(data[0], data[1:])
 		}
-		return errors.Errorf("unknown message type `%c`", data[0])
 	}
 
 	return nil
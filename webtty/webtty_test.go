@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"sync"
 	"testing"
+
+	"webpsmux/pkg/auth"
 )
 
 func TestInitialization(t *testing.T) {
@@ -113,6 +116,29 @@ func TestWriteFromFrontend(t *testing.T) {
 	}
 }
 
+func TestWriteFromFrontendAsViewer(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	viewer := &auth.Identity{User: "bob", Role: auth.RoleViewer}
+	mMaster, _, _, cancel := prepareSUT(t, &wg, WithPermitWrite(), WithIdentity(viewer))
+	defer cancel()
+
+	// Absorb initialization messages
+	checkNextMsgType(t, mMaster.gottyToMasterReader, SetWindowTitle)
+	checkNextMsgType(t, mMaster.gottyToMasterReader, SetBufferSize)
+
+	// The slave pipe is unbuffered, so had the input been forwarded the
+	// denial would never be sent.
+	mMaster.masterToGottyWriter.Write([]byte("1rm -rf /\n"))
+	checkPsmuxError(t, mMaster.gottyToMasterReader, Input)
+	mMaster.masterToGottyWriter.Write([]byte("2"))
+	checkNextMsgType(t, mMaster.gottyToMasterReader, Pong)
+
+	cancel()
+	wg.Wait()
+}
+
 func TestPing(t *testing.T) {
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -223,6 +249,21 @@ func checkNextMsgType(t *testing.T, reader io.Reader, expected byte) {
 	}
 }
 
+func checkPsmuxError(t *testing.T, reader io.Reader, deniedType byte) {
+	t.Helper()
+	msgType, payload := nextMsg(t, reader)
+	if msgType != PsmuxError {
+		t.Fatalf("Unexpected message type `%c`, expected a denial", msgType)
+	}
+	var denial psmuxError
+	if err := json.Unmarshal(trimMsg(payload), &denial); err != nil {
+		t.Fatalf("Malformed denial `%s`: %s", payload, err)
+	}
+	if denial.Type != string(deniedType) || denial.Message == "" {
+		t.Fatalf("Unexpected denial %+v", denial)
+	}
+}
+
 func nextMsg(t *testing.T, reader io.Reader) (byte, []byte) {
 	buf := make([]byte, 1024)
 	_, err := reader.Read(buf)
@@ -232,6 +273,11 @@ func nextMsg(t *testing.T, reader io.Reader) (byte, []byte) {
 	return buf[0], buf[1:]
 }
 
+// trimMsg strips the unused part of the read buffer from a payload.
+func trimMsg(payload []byte) []byte {
+	return bytes.TrimRight(payload, "\x00")
+}
+
 func newMockMaster() *mockMaster {
 	rv := &mockMaster{}
 	rv.gottyToMasterReader, rv.gottyToMasterWriter = io.Pipe()